@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// APIKeyConfig checks API keys against a local store of salted hashes.
+//
+//	apiKeys:
+//	  storeFile: /etc/extproc/api-keys.yaml
+//	  header: x-api-key
+//	  queryParam: api_key
+//	  requiredScopes: [orders:read]
+type APIKeyConfig struct {
+	// StoreFile lists the keys (see APIKeyStore). It is reloaded when it
+	// changes (checked every Refresh, default 30s).
+	StoreFile string        `yaml:"storeFile" json:"storeFile"`
+	Refresh   time.Duration `yaml:"refresh" json:"refresh"`
+
+	// Header and QueryParam say where the key is read from. The header is
+	// checked first. Default: header x-api-key, no query parameter.
+	Header     string `yaml:"header" json:"header"`
+	QueryParam string `yaml:"queryParam" json:"queryParam"`
+
+	// RequiredScopes must all be granted to the key, otherwise the request
+	// gets a 403
+	RequiredScopes []string `yaml:"requiredScopes" json:"requiredScopes"`
+
+	// KeepKey forwards the API key to the backend; by default it is removed
+	KeepKey bool `yaml:"keepKey" json:"keepKey"`
+
+	// ForwardHeaders names the request headers for the key metadata.
+	// Defaults: x-api-key-id, x-api-key-owner, x-tenant-id, x-api-key-scopes
+	ForwardHeaders APIKeyHeaders `yaml:"forwardHeaders" json:"forwardHeaders"`
+
+	// Match limits the check to matching requests (default: all)
+	Match *MatchConfig `yaml:"match" json:"match"`
+}
+
+// APIKeyHeaders are the headers the key metadata is forwarded in
+type APIKeyHeaders struct {
+	ID     string `yaml:"id" json:"id"`
+	Owner  string `yaml:"owner" json:"owner"`
+	Tenant string `yaml:"tenant" json:"tenant"`
+	Scopes string `yaml:"scopes" json:"scopes"`
+}
+
+// APIKeyStore is the content of the store file. Keys are never stored in
+// plain text, only as "sha256:<salt>:<hash>" (see HashAPIKey).
+//
+//	keys:
+//	  - id: acme-prod
+//	    hash: "sha256:3q2+7w...:Yk9x..."
+//	    owner: acme
+//	    tenant: acme
+//	    scopes: [orders:read, orders:write]
+//	    expiresAt: 2027-01-01T00:00:00Z
+type APIKeyStore struct {
+	Keys []APIKeyEntry `yaml:"keys" json:"keys"`
+}
+
+// APIKeyEntry is one key and its metadata
+type APIKeyEntry struct {
+	ID        string    `yaml:"id" json:"id"`
+	Hash      string    `yaml:"hash" json:"hash"`
+	Owner     string    `yaml:"owner" json:"owner"`
+	Tenant    string    `yaml:"tenant" json:"tenant"`
+	Scopes    []string  `yaml:"scopes" json:"scopes"`
+	ExpiresAt time.Time `yaml:"expiresAt" json:"expiresAt"`
+
+	salt []byte
+	sum  []byte
+}
+
+// apiKeyHashPrefix marks the hash format, so it can change later
+const apiKeyHashPrefix = "sha256"
+
+// HashAPIKey returns the store form of a key: "sha256:<salt>:<hash>" with a
+// fresh random salt. API keys are long random strings, so a salted SHA-256
+// is enough; a slow password hash would only add latency to every request.
+func HashAPIKey(key string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	sum := saltedSum(salt, key)
+	return fmt.Sprintf("%s:%s:%s", apiKeyHashPrefix,
+		base64.StdEncoding.EncodeToString(salt), base64.StdEncoding.EncodeToString(sum)), nil
+}
+
+func saltedSum(salt []byte, key string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(key))
+	return h.Sum(nil)
+}
+
+// parseAPIKeyStore parses and checks a store file
+func parseAPIKeyStore(data []byte) (*APIKeyStore, error) {
+	store := &APIKeyStore{}
+	if err := yaml.Unmarshal(data, store); err != nil {
+		return nil, fmt.Errorf("parsing API key store: %w", err)
+	}
+	ids := map[string]bool{}
+	for i := range store.Keys {
+		entry := &store.Keys[i]
+		if entry.ID == "" {
+			return nil, fmt.Errorf("keys[%d]: id is required", i)
+		}
+		if ids[entry.ID] {
+			return nil, fmt.Errorf("keys[%d]: duplicate id %q", i, entry.ID)
+		}
+		ids[entry.ID] = true
+
+		parts := strings.Split(entry.Hash, ":")
+		if len(parts) != 3 || parts[0] != apiKeyHashPrefix {
+			return nil, fmt.Errorf("keys[%d] (%s): hash must look like sha256:<salt>:<hash>", i, entry.ID)
+		}
+		var err error
+		if entry.salt, err = base64.StdEncoding.DecodeString(parts[1]); err != nil {
+			return nil, fmt.Errorf("keys[%d] (%s): invalid salt: %w", i, entry.ID, err)
+		}
+		if entry.sum, err = base64.StdEncoding.DecodeString(parts[2]); err != nil || len(entry.sum) != sha256.Size {
+			return nil, fmt.Errorf("keys[%d] (%s): invalid hash", i, entry.ID)
+		}
+	}
+	return store, nil
+}
+
+// lookup finds the entry for a presented key. Every entry is compared in
+// constant time so the response time doesn't reveal which keys exist.
+func (s *APIKeyStore) lookup(key string) *APIKeyEntry {
+	var found *APIKeyEntry
+	for i := range s.Keys {
+		entry := &s.Keys[i]
+		if subtle.ConstantTimeCompare(saltedSum(entry.salt, key), entry.sum) == 1 {
+			found = entry
+		}
+	}
+	return found
+}
+
+func (c *APIKeyConfig) validate() error {
+	if c.StoreFile == "" {
+		return fmt.Errorf("storeFile is required")
+	}
+	if c.Refresh < 0 {
+		return fmt.Errorf("refresh must not be negative")
+	}
+	if _, err := CompileMatcher(c.Match); err != nil {
+		return fmt.Errorf("match.%w", err)
+	}
+	return nil
+}
+
+// APIKeyProcessor authenticates requests by API key
+type APIKeyProcessor struct {
+	BaseProcessor
+
+	cfg      *APIKeyConfig
+	store    *watchedFile[*APIKeyStore]
+	header   string
+	forward  APIKeyHeaders
+	renderer *DenyRenderer
+}
+
+// NewAPIKeyProcessor loads the key store and prepares the processor
+func NewAPIKeyProcessor(cfg *APIKeyConfig, renderer *DenyRenderer) (*APIKeyProcessor, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	refresh := cfg.Refresh
+	if refresh == 0 {
+		refresh = 30 * time.Second
+	}
+	store, err := newWatchedFile(cfg.StoreFile, refresh, parseAPIKeyStore)
+	if err != nil {
+		return nil, fmt.Errorf("loading API key store: %w", err)
+	}
+
+	p := &APIKeyProcessor{
+		cfg:      cfg,
+		store:    store,
+		header:   strings.ToLower(cfg.Header),
+		forward:  cfg.ForwardHeaders,
+		renderer: renderer,
+	}
+	if p.header == "" {
+		p.header = "x-api-key"
+	}
+	if p.forward.ID == "" {
+		p.forward.ID = "x-api-key-id"
+	}
+	if p.forward.Owner == "" {
+		p.forward.Owner = "x-api-key-owner"
+	}
+	if p.forward.Tenant == "" {
+		p.forward.Tenant = "x-tenant-id"
+	}
+	if p.forward.Scopes == "" {
+		p.forward.Scopes = "x-api-key-scopes"
+	}
+	return p, nil
+}
+
+func (p *APIKeyProcessor) Name() string { return "api-key" }
+
+func (p *APIKeyProcessor) checksAccess() {}
+
+// apiKeyPrincipalKey is where the matched key is kept in the stream state
+const apiKeyPrincipalKey = "api-key:entry"
+
+// APIKeyPrincipal returns the API key entry that authenticated this stream, or nil
+func APIKeyPrincipal(sc *StreamContext) *APIKeyEntry {
+	entry, _ := sc.State(apiKeyPrincipalKey).(*APIKeyEntry)
+	return entry
+}
+
+// RequestHeaders checks the API key and forwards its metadata
+func (p *APIKeyProcessor) RequestHeaders(sc *StreamContext, headers *extprocv3.HttpHeaders) (*Result, error) {
+	key, fromQuery := p.extractKey(headers)
+	if key == "" {
+		return p.deny(sc, http.StatusUnauthorized, "api_key_missing", "an API key is required"), nil
+	}
+
+	entry := p.store.Get().lookup(key)
+	if entry == nil {
+		return p.deny(sc, http.StatusUnauthorized, "api_key_invalid", "the API key is not valid"), nil
+	}
+	if !entry.ExpiresAt.IsZero() && time.Now().After(entry.ExpiresAt) {
+		return p.deny(sc, http.StatusUnauthorized, "api_key_expired", "the API key has expired"), nil
+	}
+	for _, scope := range p.cfg.RequiredScopes {
+		if !containsString(entry.Scopes, scope) {
+			sc.Logger().Infow("API key lacks scope", "processor", p.Name(), "key_id", entry.ID, "scope", scope)
+			return p.deny(sc, http.StatusForbidden, "api_key_scope", "the API key is not allowed to do this"), nil
+		}
+	}
+	sc.Logger().Debugw("Request authenticated", "processor", p.Name(), "key_id", entry.ID, "owner", entry.Owner)
+	sc.SetState(apiKeyPrincipalKey, entry)
+
+	// Overwrite whatever the client sent in the metadata headers
+	mutation := &extprocv3.HeaderMutation{}
+	for _, h := range []struct{ key, value string }{
+		{p.forward.ID, entry.ID},
+		{p.forward.Owner, entry.Owner},
+		{p.forward.Tenant, entry.Tenant},
+		{p.forward.Scopes, strings.Join(entry.Scopes, ",")},
+	} {
+		if h.value == "" {
+			mutation.RemoveHeaders = append(mutation.RemoveHeaders, h.key)
+			continue
+		}
+		mutation.SetHeaders = append(mutation.SetHeaders, setHeader(h.key, h.value))
+	}
+
+	// Don't pass the secret on to the backend
+	if !p.cfg.KeepKey {
+		if fromQuery {
+			if path, ok := p.pathWithoutKey(headers); ok {
+				mutation.SetHeaders = append(mutation.SetHeaders, &corev3.HeaderValueOption{
+					Header:       &corev3.HeaderValue{Key: ":path", Value: path},
+					AppendAction: corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+				})
+			}
+		} else {
+			mutation.RemoveHeaders = append(mutation.RemoveHeaders, p.header)
+		}
+	}
+	return &Result{HeaderMutation: mutation}, nil
+}
+
+// extractKey reads the key from the header, then from the query string
+func (p *APIKeyProcessor) extractKey(headers *extprocv3.HttpHeaders) (key string, fromQuery bool) {
+	if value, ok := getHeader(headers, p.header); ok && strings.TrimSpace(value) != "" {
+		return strings.TrimSpace(value), false
+	}
+	if p.cfg.QueryParam == "" {
+		return "", false
+	}
+	path, _ := getHeader(headers, ":path")
+	_, query, found := strings.Cut(path, "?")
+	if !found {
+		return "", false
+	}
+	// A malformed parameter elsewhere in the query doesn't hide the key
+	for _, segment := range strings.Split(query, "&") {
+		name, rawValue, _ := strings.Cut(segment, "=")
+		if unescaped, err := url.QueryUnescape(name); err != nil || unescaped != p.cfg.QueryParam {
+			continue
+		}
+		if value, err := url.QueryUnescape(rawValue); err == nil && value != "" {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// pathWithoutKey returns :path without the API key query parameter. Only
+// the key's name=value segments are dropped; the rest of the query is
+// kept byte for byte, so its encoding and order reach the backend as sent.
+func (p *APIKeyProcessor) pathWithoutKey(headers *extprocv3.HttpHeaders) (string, bool) {
+	path, _ := getHeader(headers, ":path")
+	base, query, found := strings.Cut(path, "?")
+	if !found {
+		return "", false
+	}
+	var kept []string
+	for _, segment := range strings.Split(query, "&") {
+		name, _, _ := strings.Cut(segment, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil && unescaped == p.cfg.QueryParam {
+			continue
+		}
+		kept = append(kept, segment)
+	}
+	if len(kept) == 0 {
+		return base, true
+	}
+	return base + "?" + strings.Join(kept, "&"), true
+}
+
+func (p *APIKeyProcessor) deny(sc *StreamContext, status int, reason, message string) *Result {
+	sc.Logger().Infow("Rejecting request", "processor", p.Name(), "decision", "deny", "reason", reason, "status", status)
+	d := &Denial{Status: status, Reason: reason, Message: message}
+	if status == http.StatusUnauthorized {
+		d.Headers = map[string]string{"www-authenticate": `ApiKey header="` + p.header + `"`}
+	}
+	return d.Result(sc, p.renderer)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAPIKeyProcessor writes a store with the keys acme-key (full
+// metadata), bare-key (ID only) and old-key (expired)
+func newTestAPIKeyProcessor(t *testing.T, cfg APIKeyConfig) *APIKeyProcessor {
+	t.Helper()
+	hash := func(key string) string {
+		h, err := HashAPIKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	store := fmt.Sprintf(`keys:
+  - id: acme-prod
+    hash: %q
+    owner: acme-corp
+    tenant: acme
+    scopes: [orders:read, orders:write]
+  - id: bare
+    hash: %q
+  - id: old
+    hash: %q
+    scopes: [orders:read]
+    expiresAt: %s
+`, hash("acme-key"), hash("bare-key"), hash("old-key"), time.Now().Add(-time.Hour).UTC().Format(time.RFC3339))
+	cfg.StoreFile = filepath.Join(t.TempDir(), "api-keys.yaml")
+	writeTestFile(t, cfg.StoreFile, []byte(store))
+	p, err := NewAPIKeyProcessor(&cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestAPIKeyHash(t *testing.T) {
+	first, err := HashAPIKey("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := HashAPIKey("secret")
+	if first == second {
+		t.Error("two hashes of the same key share a salt")
+	}
+	if !strings.HasPrefix(first, "sha256:") || strings.Contains(first, "secret") {
+		t.Errorf("hash %q is not in the store form", first)
+	}
+
+	store, err := parseAPIKeyStore([]byte(fmt.Sprintf("keys:\n  - id: a\n    hash: %q\n  - id: b\n    hash: %q\n", first, second)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry := store.lookup("secret"); entry == nil {
+		t.Error("key not found by its hash")
+	}
+	for _, key := range []string{"Secret", "secret ", "", first} {
+		if entry := store.lookup(key); entry != nil {
+			t.Errorf("key %q matched %s", key, entry.ID)
+		}
+	}
+
+	invalid := map[string]string{
+		"no id":        fmt.Sprintf("keys:\n  - hash: %q\n", first),
+		"duplicate id": fmt.Sprintf("keys:\n  - id: a\n    hash: %q\n  - id: a\n    hash: %q\n", first, second),
+		"plain text":   "keys:\n  - id: a\n    hash: secret\n",
+		"other scheme": "keys:\n  - id: a\n    hash: md5:c2FsdA==:c2FsdA==\n",
+		"short hash":   "keys:\n  - id: a\n    hash: sha256:c2FsdA==:c2FsdA==\n",
+	}
+	for name, data := range invalid {
+		if _, err := parseAPIKeyStore([]byte(data)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestAPIKeyMetadataHeaders(t *testing.T) {
+	p := newTestAPIKeyProcessor(t, APIKeyConfig{
+		RequiredScopes: []string{"orders:read"},
+		ForwardHeaders: APIKeyHeaders{Tenant: "x-org"},
+	})
+
+	sc := NewStreamContext(context.Background())
+	result, err := p.RequestHeaders(sc, testHeaders(":path", "/orders", "x-api-key", "acme-key", "x-api-key-owner", "spoofed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ImmediateResponse != nil {
+		t.Fatalf("valid key denied with %d", result.ImmediateResponse.GetStatus().GetCode())
+	}
+	set, removed := headerChanges(result.HeaderMutation)
+	want := map[string]string{
+		"x-api-key-id":     "acme-prod",
+		"x-api-key-owner":  "acme-corp",
+		"x-org":            "acme",
+		"x-api-key-scopes": "orders:read,orders:write",
+	}
+	for name, value := range want {
+		if set[name] != value {
+			t.Errorf("%s = %q, want %q", name, set[name], value)
+		}
+	}
+	if len(removed) != 1 || removed[0] != "x-api-key" {
+		t.Errorf("removed %v, want the key header", removed)
+	}
+	if entry := APIKeyPrincipal(sc); entry == nil || entry.ID != "acme-prod" {
+		t.Errorf("principal %v, want acme-prod", entry)
+	}
+
+	// Metadata a key doesn't have is removed, so clients can't supply it
+	p.cfg.RequiredScopes = nil
+	result, err = p.RequestHeaders(NewStreamContext(context.Background()), testHeaders(":path", "/", "x-api-key", "bare-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, removed = headerChanges(result.HeaderMutation)
+	if len(set) != 1 || set["x-api-key-id"] != "bare" {
+		t.Errorf("set headers %v, want only x-api-key-id", set)
+	}
+	for _, name := range []string{"x-api-key-owner", "x-org", "x-api-key-scopes"} {
+		if !containsString(removed, name) {
+			t.Errorf("%s not removed (removed %v)", name, removed)
+		}
+	}
+}
+
+func TestAPIKeyRejected(t *testing.T) {
+	p := newTestAPIKeyProcessor(t, APIKeyConfig{RequiredScopes: []string{"orders:write"}})
+	tests := []struct {
+		name    string
+		headers []string
+		status  int
+		reason  string
+	}{
+		{"missing", []string{":path", "/"}, 401, "api_key_missing"},
+		{"unknown", []string{":path", "/", "x-api-key", "guess"}, 401, "api_key_invalid"},
+		{"expired", []string{":path", "/", "x-api-key", "old-key"}, 401, "api_key_expired"},
+		{"missing scope", []string{":path", "/", "x-api-key", "bare-key"}, 403, "api_key_scope"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := p.RequestHeaders(NewStreamContext(context.Background()), testHeaders(tt.headers...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			immediate := result.ImmediateResponse
+			if int(immediate.GetStatus().GetCode()) != tt.status || immediate.GetDetails() != "ext_proc_"+tt.reason {
+				t.Errorf("got %d %q, want %d %q", immediate.GetStatus().GetCode(), immediate.GetDetails(), tt.status, tt.reason)
+			}
+		})
+	}
+}
+
+func TestAPIKeyQueryParam(t *testing.T) {
+	p := newTestAPIKeyProcessor(t, APIKeyConfig{QueryParam: "api_key"})
+	tests := []struct {
+		path string
+		// want is the forwarded :path, or "" if the request is denied
+		want string
+	}{
+		{"/orders?api_key=acme-key", "/orders"},
+		{"/orders?page=2&api_key=acme-key&sort=desc", "/orders?page=2&sort=desc"},
+		// The rest of the query is passed on exactly as sent
+		{"/search?q=a+b%2Fc&api_key=acme-key&tag=x&tag=y", "/search?q=a+b%2Fc&tag=x&tag=y"},
+		{"/search?z=1&a=2&api_key=acme-key", "/search?z=1&a=2"},
+		{"/x?api%5Fkey=acme-key&a=1", "/x?a=1"},
+		// A malformed parameter neither hides the key nor keeps it in the path
+		{"/x?bad=%zz&api_key=acme-key", "/x?bad=%zz"},
+		{"/x?api_key=acme-key&api_key=other", "/x"},
+		{"/x?api_key=guess", ""},
+		{"/x?not_api_key=acme-key", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			result, err := p.RequestHeaders(NewStreamContext(context.Background()), testHeaders(":path", tt.path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == "" {
+				if result.ImmediateResponse == nil {
+					t.Error("request was not denied")
+				}
+				return
+			}
+			if result.ImmediateResponse != nil {
+				t.Fatalf("denied with %q", result.ImmediateResponse.GetDetails())
+			}
+			set, _ := headerChanges(result.HeaderMutation)
+			if set[":path"] != tt.want {
+				t.Errorf(":path = %q, want %q", set[":path"], tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"github.com/solo-io/go-utils/contextutils"
+)
+
+// AuditConfig writes one JSON line per request to an append-only audit
+// log: who made it, which rules acted on it, what was changed and whether
+// it was rejected.
+//
+//	audit:
+//	  path: /var/log/extproc/audit.log
+//	  maxSizeMB: 100
+//	  rotateEvery: 24h
+//	  hmacKeyFile: /etc/extproc/audit-key
+type AuditConfig struct {
+	// Path is the file records are appended to. Its directory must exist.
+	Path string `yaml:"path" json:"path"`
+
+	// MaxSizeMB starts a new file once the current one would grow past
+	// this size (default 100)
+	MaxSizeMB int `yaml:"maxSizeMB" json:"maxSizeMB"`
+	// RotateEvery also starts a new file at every multiple of this
+	// interval, counted in UTC (24h rotates at midnight; 0 disables)
+	RotateEvery time.Duration `yaml:"rotateEvery" json:"rotateEvery"`
+	// MaxBackups is the number of rotated files kept (default 0 keeps all)
+	MaxBackups int `yaml:"maxBackups" json:"maxBackups"`
+
+	// HMACKey or HMACKeyFile turn on the HMAC chain: every record carries
+	// an HMAC-SHA256 of itself and the previous record's HMAC, so an edited,
+	// removed or reordered record breaks the chain
+	HMACKey     string `yaml:"hmacKey" json:"hmacKey"`
+	HMACKeyFile string `yaml:"hmacKeyFile" json:"hmacKeyFile"`
+}
+
+func (c *AuditConfig) validate() error {
+	if c.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+	if c.MaxSizeMB < 0 || c.MaxBackups < 0 || c.RotateEvery < 0 {
+		return fmt.Errorf("maxSizeMB, maxBackups and rotateEvery must not be negative")
+	}
+	if c.HMACKey != "" && c.HMACKeyFile != "" {
+		return fmt.Errorf("only one of hmacKey and hmacKeyFile can be set")
+	}
+	return nil
+}
+
+// AuditRecord is one line of the audit log
+type AuditRecord struct {
+	Time      time.Time       `json:"ts"`
+	RequestID string          `json:"request_id"`
+	TraceID   string          `json:"trace_id,omitempty"`
+	Principal *AuditPrincipal `json:"principal,omitempty"`
+	ClientIP  string          `json:"client_ip,omitempty"`
+	Method    string          `json:"method"`
+	Authority string          `json:"authority"`
+	Path      string          `json:"path"`
+	Route     string          `json:"route"`
+
+	// Rules are the processors that changed or rejected the request, in
+	// the order they acted; config rules are named rule:<name>[:<kind>]
+	Rules     []string       `json:"rules"`
+	Mutations AuditMutations `json:"mutations"`
+
+	// Decision is continue or deny; Status and Reason are set for denials
+	Decision string `json:"decision"`
+	Status   int    `json:"status,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+
+	// Error is set if the stream failed
+	Error string `json:"error,omitempty"`
+
+	// PrevHMAC and HMAC form the chain when it is turned on. HMAC is
+	// always the last field of the line.
+	PrevHMAC *string `json:"prev_hmac,omitempty"`
+	HMAC     string  `json:"hmac,omitempty"`
+}
+
+// AuditPrincipal is the authenticated caller
+type AuditPrincipal struct {
+	Type   string `json:"type"` // jwt or api_key
+	ID     string `json:"id"`
+	Issuer string `json:"issuer,omitempty"`
+	Owner  string `json:"owner,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// AuditMutations are the changes sent to Envoy over the whole request.
+// Only header names are logged, never values.
+type AuditMutations struct {
+	HeadersSet     []string `json:"headers_set"`
+	HeadersRemoved []string `json:"headers_removed"`
+	BodyMutations  int      `json:"body_mutations"`
+}
+
+// AuditLog appends records to a rotating file
+type AuditLog struct {
+	mu sync.Mutex
+
+	path        string
+	maxSize     int64
+	rotateEvery time.Duration
+	maxBackups  int
+	key         []byte
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	prevHMAC string
+}
+
+// auditLogs keeps one writer per file across config reloads, so two
+// writers never append to the same file
+var auditLogs = struct {
+	sync.Mutex
+	byPath map[string]*AuditLog
+}{byPath: map[string]*AuditLog{}}
+
+// NewAuditLog returns the audit log for cfg.Path, opening the file on
+// first use. Changed settings apply to the existing writer.
+func NewAuditLog(cfg *AuditConfig) (*AuditLog, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	key := []byte(cfg.HMACKey)
+	if cfg.HMACKeyFile != "" {
+		data, err := os.ReadFile(cfg.HMACKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading hmacKeyFile: %w", err)
+		}
+		key = bytes.TrimSpace(data)
+		if len(key) == 0 {
+			return nil, fmt.Errorf("hmacKeyFile %s is empty", cfg.HMACKeyFile)
+		}
+	}
+	maxSize := int64(cfg.MaxSizeMB) << 20
+	if maxSize == 0 {
+		maxSize = 100 << 20
+	}
+
+	auditLogs.Lock()
+	defer auditLogs.Unlock()
+	l, ok := auditLogs.byPath[cfg.Path]
+	if !ok {
+		l = &AuditLog{path: cfg.Path}
+		if err := l.open(); err != nil {
+			return nil, err
+		}
+		auditLogs.byPath[cfg.Path] = l
+	}
+	l.mu.Lock()
+	l.maxSize, l.rotateEvery, l.maxBackups, l.key = maxSize, cfg.RotateEvery, cfg.MaxBackups, key
+	l.mu.Unlock()
+	return l, nil
+}
+
+// open opens the file for appending and picks up the HMAC chain where
+// the last record in it left off
+func (l *AuditLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("opening audit log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("opening audit log: %w", err)
+	}
+	l.file, l.size, l.openedAt = f, info.Size(), time.Now()
+	if l.size > 0 {
+		l.openedAt = info.ModTime()
+		if last, err := lastLine(l.path, l.size); err == nil {
+			var r struct {
+				HMAC string `json:"hmac"`
+			}
+			if json.Unmarshal(last, &r) == nil {
+				l.prevHMAC = r.HMAC
+			}
+		}
+	}
+	return nil
+}
+
+// lastLine returns the last line of a file, reading at most its last 64KB
+func lastLine(path string, size int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	offset := size - 64<<10
+	if offset < 0 {
+		offset = 0
+	}
+	buf := make([]byte, size-offset)
+	if _, err := f.ReadAt(buf, offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	buf = bytes.TrimRight(buf, "\n")
+	if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+		buf = buf[i+1:]
+	}
+	return buf, nil
+}
+
+// Write appends a record, chaining it to the previous one if an HMAC key
+// is set
+func (l *AuditLog) Write(r *AuditRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r.PrevHMAC, r.HMAC = nil, ""
+	if len(l.key) > 0 {
+		prev := l.prevHMAC
+		r.PrevHMAC = &prev
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if len(l.key) > 0 {
+		r.HMAC = auditHMAC(l.key, line)
+		line = append(line[:len(line)-1], `,"hmac":"`+r.HMAC+`"}`...)
+	}
+	line = append(line, '\n')
+
+	if l.shouldRotate(int64(len(line))) {
+		// A failed rotation is retried on the next record; this one still
+		// goes to the current file rather than being lost
+		if err := l.rotate(); err != nil {
+			contextutils.LoggerFrom(context.Background()).Warnw("Failed to rotate audit log", "path", l.path, "error", err)
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if r.HMAC != "" {
+		l.prevHMAC = r.HMAC
+	}
+	return nil
+}
+
+// auditHMAC is the HMAC of a record as written without its hmac field.
+// The record includes prev_hmac, which is what chains the records.
+func auditHMAC(key, record []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(record)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (l *AuditLog) shouldRotate(next int64) bool {
+	if l.size > 0 && l.size+next > l.maxSize {
+		return true
+	}
+	if l.rotateEvery > 0 && l.size > 0 {
+		now := time.Now().UTC()
+		return now.Truncate(l.rotateEvery) != l.openedAt.UTC().Truncate(l.rotateEvery)
+	}
+	return false
+}
+
+// rotate renames the current file to <path>.<UTC timestamp> and starts a
+// new one. The HMAC chain carries on into the new file. The old file is
+// only closed once the new one is open, so on error l.file is still the
+// file being written.
+func (l *AuditLog) rotate() error {
+	backup := l.path + "." + time.Now().UTC().Format(auditBackupSuffix)
+	if err := os.Rename(l.path, backup); err != nil {
+		return fmt.Errorf("rotating audit log: %w", err)
+	}
+	old, prev := l.file, l.prevHMAC
+	if err := l.open(); err != nil {
+		// Put the file back, so records keep going to l.path
+		if err := os.Rename(backup, l.path); err != nil {
+			contextutils.LoggerFrom(context.Background()).Warnw("Failed to restore audit log", "path", backup, "error", err)
+		}
+		return err
+	}
+	l.prevHMAC = prev
+	if err := old.Close(); err != nil {
+		contextutils.LoggerFrom(context.Background()).Warnw("Failed to close rotated audit log", "path", backup, "error", err)
+	}
+	l.removeOldBackups()
+	return nil
+}
+
+// auditBackupSuffix is the timestamp rotate appends to the file name. It
+// sorts in time order.
+const auditBackupSuffix = "20060102T150405.000Z"
+
+// removeOldBackups deletes the oldest rotated files beyond MaxBackups. Only
+// names rotate wrote count as backups; other files next to the log, such
+// as audit.log.gz or audit.log.lock, are left alone.
+func (l *AuditLog) removeOldBackups() {
+	if l.maxBackups == 0 {
+		return
+	}
+	dir, base := filepath.Split(l.path)
+	entries, err := os.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		contextutils.LoggerFrom(context.Background()).Warnw("Failed to list old audit logs", "path", l.path, "error", err)
+		return
+	}
+	var backups []string
+	for _, entry := range entries {
+		suffix, ok := strings.CutPrefix(entry.Name(), base+".")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(auditBackupSuffix, suffix); err == nil {
+			backups = append(backups, filepath.Join(dir, entry.Name()))
+		}
+	}
+	if len(backups) <= l.maxBackups {
+		return
+	}
+	sort.Strings(backups)
+	for _, old := range backups[:len(backups)-l.maxBackups] {
+		if err := os.Remove(old); err != nil {
+			contextutils.LoggerFrom(context.Background()).Warnw("Failed to remove old audit log", "path", old, "error", err)
+		}
+	}
+}
+
+// Close closes the current file
+func (l *AuditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// VerifyAuditLog checks the HMAC chain of an audit log file. It returns the
+// number of records checked, and an error naming the first line that
+// doesn't match. Each file can be checked on its own; the first record's
+// prev_hmac should equal the last hmac of the file rotated before it.
+func VerifyAuditLog(r io.Reader, key []byte) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	var prev *string
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := scanner.Bytes()
+		var rec struct {
+			PrevHMAC *string `json:"prev_hmac"`
+			HMAC     string  `json:"hmac"`
+		}
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return n - 1, fmt.Errorf("line %d: %w", n, err)
+		}
+		suffix := `,"hmac":"` + rec.HMAC + `"}`
+		if rec.HMAC == "" || rec.PrevHMAC == nil || !bytes.HasSuffix(line, []byte(suffix)) {
+			return n - 1, fmt.Errorf("line %d: record is not chained", n)
+		}
+		if prev != nil && *rec.PrevHMAC != *prev {
+			return n - 1, fmt.Errorf("line %d: prev_hmac does not match the line before it", n)
+		}
+		body := append(append([]byte{}, line[:len(line)-len(suffix)]...), '}')
+		if !hmac.Equal([]byte(auditHMAC(key, body)), []byte(rec.HMAC)) {
+			return n - 1, fmt.Errorf("line %d: hmac does not match the record", n)
+		}
+		h := rec.HMAC
+		prev = &h
+	}
+	return n, scanner.Err()
+}
+
+// AuditEntry collects the audit record of one stream as its messages are
+// processed. All methods do nothing on a nil AuditEntry.
+type AuditEntry struct {
+	log    *AuditLog
+	record AuditRecord
+
+	// mu guards fired and record.Rules, which a fork's processors may
+	// still add to while a fallback joins them
+	mu    sync.Mutex
+	fired map[string]bool
+}
+
+// StartAudit starts the audit record for a stream once its request
+// headers have arrived
+func (l *AuditLog) StartAudit(sc *StreamContext, headers *extprocv3.HttpHeaders, start time.Time) *AuditEntry {
+	method, _ := getHeader(headers, ":method")
+	path, _ := getHeader(headers, ":path")
+	authority, _ := getHeader(headers, ":authority")
+	route, _, _ := strings.Cut(path, "?")
+	e := &AuditEntry{log: l, fired: map[string]bool{}, record: AuditRecord{
+		Time:      start.UTC(),
+		RequestID: sc.RequestID,
+		Method:    method,
+		Authority: authority,
+		Path:      path,
+		Route:     routeName(headers, route),
+		Rules:     []string{},
+		Mutations: AuditMutations{HeadersSet: []string{}, HeadersRemoved: []string{}},
+		Decision:  "continue",
+	}}
+	if sc.Trace != nil {
+		e.record.TraceID = sc.Trace.TraceIDString()
+	}
+	return e
+}
+
+// Fired notes a processor that changed or rejected the request
+func (e *AuditEntry) Fired(name string, result *Result) {
+	if e == nil || result == nil {
+		return
+	}
+	if result.ImmediateResponse == nil && result.BodyMutation == nil &&
+		len(result.HeaderMutation.GetSetHeaders()) == 0 && len(result.HeaderMutation.GetRemoveHeaders()) == 0 {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.fired[name] {
+		return
+	}
+	e.fired[name] = true
+	e.record.Rules = append(e.record.Rules, name)
+}
+
+// fork returns an entry that collects the rules fired on a forked stream
+// context, for join
+func (e *AuditEntry) fork() *AuditEntry {
+	if e == nil {
+		return nil
+	}
+	f := &AuditEntry{log: e.log, fired: make(map[string]bool, len(e.fired))}
+	for name := range e.fired {
+		f.fired[name] = true
+	}
+	return f
+}
+
+// join adds the rules fired on a fork
+func (e *AuditEntry) join(f *AuditEntry) {
+	if e == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, name := range f.record.Rules {
+		e.fired[name] = true
+		e.record.Rules = append(e.record.Rules, name)
+	}
+}
+
+// Record adds the reply to one message to the record
+func (e *AuditEntry) Record(response *extprocv3.ProcessingResponse) {
+	if e == nil {
+		return
+	}
+	if immediate := response.GetImmediateResponse(); immediate != nil {
+		e.record.Decision = "deny"
+		e.record.Status = int(immediate.GetStatus().GetCode())
+		e.record.Reason = strings.TrimPrefix(immediate.GetDetails(), "ext_proc_")
+		return
+	}
+	headers, body := responseMutations(response)
+	for _, h := range headers.GetSetHeaders() {
+		e.record.Mutations.HeadersSet = append(e.record.Mutations.HeadersSet, h.GetHeader().GetKey())
+	}
+	e.record.Mutations.HeadersRemoved = append(e.record.Mutations.HeadersRemoved, headers.GetRemoveHeaders()...)
+	if body != nil {
+		e.record.Mutations.BodyMutations++
+	}
+}
+
+// End writes the record. The principal is read now, after the
+// authentication processors have run. err is the error the stream ended
+// with, if any.
+func (e *AuditEntry) End(sc *StreamContext, err error) {
+	if e == nil {
+		return
+	}
+	if claims := JWTClaims(sc); claims != nil {
+		sub, _ := claimString(claims["sub"])
+		iss, _ := claimString(claims["iss"])
+		e.record.Principal = &AuditPrincipal{Type: "jwt", ID: sub, Issuer: iss}
+	} else if key := APIKeyPrincipal(sc); key != nil {
+		e.record.Principal = &AuditPrincipal{Type: "api_key", ID: key.ID, Owner: key.Owner, Tenant: key.Tenant}
+	}
+	if addr, ok := ClientAddr(sc); ok {
+		e.record.ClientIP = addr.String()
+	}
+	if err != nil {
+		e.record.Error = err.Error()
+	}
+	if err := e.log.Write(&e.record); err != nil {
+		metrics.AuditRecords.Inc("failed")
+		sc.Logger().Errorw("Failed to write audit record", "error", err)
+		return
+	}
+	metrics.AuditRecords.Inc("written")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestAuditLog returns an audit log in a temporary directory that
+// rotates once a file holds maxSize bytes
+func newTestAuditLog(t *testing.T, maxSize int64) *AuditLog {
+	t.Helper()
+	l, err := NewAuditLog(&AuditConfig{Path: filepath.Join(t.TempDir(), "audit.log"), HMACKey: "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.mu.Lock()
+	l.maxSize = maxSize
+	l.mu.Unlock()
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestAuditLogRotate(t *testing.T) {
+	l := newTestAuditLog(t, 1)
+	for _, id := range []string{"first", "second"} {
+		if err := l.Write(&AuditRecord{RequestID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backups, _ := filepath.Glob(l.path + ".*")
+	if len(backups) != 1 {
+		t.Fatalf("got backups %v, want one", backups)
+	}
+	var all []byte
+	for _, path := range []string{backups[0], l.path} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Count(data, []byte("\n")) != 1 {
+			t.Errorf("%s has %q, want one record", path, data)
+		}
+		all = append(all, data...)
+	}
+	// The chain carries on into the new file
+	if n, err := VerifyAuditLog(bytes.NewReader(all), []byte("key")); err != nil || n != 2 {
+		t.Errorf("VerifyAuditLog = %d, %v; want 2 records", n, err)
+	}
+}
+
+func TestAuditLogRotateFails(t *testing.T) {
+	l := newTestAuditLog(t, 1)
+	if err := l.Write(&AuditRecord{RequestID: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	// With the file gone the rename fails, and the open file must stay
+	// usable
+	if err := os.Remove(l.path); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Write(&AuditRecord{RequestID: "second"}); err != nil {
+		t.Errorf("Write after a failed rotation: %v", err)
+	}
+	if _, err := l.file.Stat(); err != nil {
+		t.Errorf("audit file after a failed rotation: %v", err)
+	}
+	if backups, _ := filepath.Glob(l.path + ".*"); len(backups) != 0 {
+		t.Errorf("got backups %v after a failed rotation", backups)
+	}
+}
+
+func TestAuditLogRemovesOnlyBackups(t *testing.T) {
+	l := newTestAuditLog(t, 1)
+	l.mu.Lock()
+	l.maxBackups = 1
+	l.mu.Unlock()
+	others := []string{".gz", ".lock", ".20260101", ".20260101T000000Z", ".20260101T000000.000Z.gz"}
+	for _, suffix := range others {
+		writeTestFile(t, l.path+suffix, nil)
+	}
+
+	for _, id := range []string{"first", "second", "third"} {
+		if err := l.Write(&AuditRecord{RequestID: id}); err != nil {
+			t.Fatal(err)
+		}
+		// Backups are named by the millisecond
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	for _, suffix := range others {
+		if _, err := os.Stat(l.path + suffix); err != nil {
+			t.Errorf("%s was removed as a backup: %v", suffix, err)
+		}
+	}
+	backups, _ := filepath.Glob(l.path + ".*T*.???Z")
+	if len(backups) != 1 {
+		t.Fatalf("got backups %v, want one", backups)
+	}
+	if data, _ := os.ReadFile(backups[0]); !bytes.Contains(data, []byte(`"second"`)) {
+		t.Errorf("kept backup %s has %q, want the newest one", backups[0], data)
+	}
+}
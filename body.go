@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/template"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// BodyConfig lists the body changes for each direction of traffic.
+// Body changes need the body to be sent to us: JSON changes need
+// requestBodyMode / responseBodyMode BUFFERED, stream changes work in any mode.
+type BodyConfig struct {
+	Request  []BodyOp `yaml:"request" json:"request"`
+	Response []BodyOp `yaml:"response" json:"response"`
+
+	// Stream changes are applied chunk by chunk as the body streams through
+	Stream StreamBodyConfig `yaml:"stream" json:"stream"`
+}
+
+// BodyOp is one change to a JSON body. Paths are JSON pointers (RFC 6901).
+//
+// Op is one of:
+//   - set: store Value at Path, creating missing objects along the way
+//   - delete: remove the field at Path
+//   - rename: move the field at From to Path
+//
+// A string Value may be a Go template with the request as data, e.g.
+// "{{ .Header \"x-tenant-id\" }}" or "{{ .Method }} {{ .Path }}".
+type BodyOp struct {
+	Op    string      `yaml:"op" json:"op"`
+	Path  string      `yaml:"path" json:"path"`
+	From  string      `yaml:"from" json:"from"`
+	Value interface{} `yaml:"value" json:"value"`
+}
+
+// Body operations understood in BodyOp.Op
+const (
+	BodyOpSet    = "set"
+	BodyOpDelete = "delete"
+	BodyOpRename = "rename"
+)
+
+// HasJSONOps reports whether there are any JSON body changes
+func (b BodyConfig) HasJSONOps() bool {
+	return len(b.Request) > 0 || len(b.Response) > 0
+}
+
+func (b BodyConfig) validate() error {
+	if _, err := compileBodyOps(b.Request); err != nil {
+		return fmt.Errorf("request%w", err)
+	}
+	if _, err := compileBodyOps(b.Response); err != nil {
+		return fmt.Errorf("response%w", err)
+	}
+	if err := b.Stream.validate(); err != nil {
+		return fmt.Errorf("stream.%w", err)
+	}
+	return nil
+}
+
+// TemplateData is what config templates can use to refer to the request
+type TemplateData struct {
+	Method string
+	Path   string
+	Host   string
+
+	headers *extprocv3.HttpHeaders
+}
+
+// NewTemplateData collects the template fields from the request headers
+func NewTemplateData(headers *extprocv3.HttpHeaders) *TemplateData {
+	d := &TemplateData{headers: headers}
+	d.Method, _ = getHeader(headers, ":method")
+	d.Path, _ = getHeader(headers, ":path")
+	d.Host, _ = getHeader(headers, ":authority")
+	return d
+}
+
+// Header returns the value of a request header, or "" if it is missing
+func (d *TemplateData) Header(name string) string {
+	v, _ := getHeader(d.headers, name)
+	return v
+}
+
+// compiledBodyOp is a BodyOp with its pointers parsed and template compiled
+type compiledBodyOp struct {
+	op    string
+	path  jsonPointer
+	from  jsonPointer
+	value interface{}
+	tmpl  *template.Template
+}
+
+func compileBodyOps(ops []BodyOp) ([]*compiledBodyOp, error) {
+	var compiled []*compiledBodyOp
+	for i, op := range ops {
+		c, err := compileBodyOp(op)
+		if err != nil {
+			return nil, fmt.Errorf("[%d]: %w", i, err)
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+func compileBodyOp(op BodyOp) (*compiledBodyOp, error) {
+	path, err := parseJSONPointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	if len(path) == 0 {
+		return nil, fmt.Errorf("path is required")
+	}
+	// Config values are checked here, so a value that can't be JSON fails
+	// the config instead of every request
+	value, err := jsonValue(op.Value)
+	if err != nil {
+		return nil, fmt.Errorf("value: %w", err)
+	}
+	c := &compiledBodyOp{op: strings.ToLower(op.Op), path: path, value: value}
+
+	switch c.op {
+	case BodyOpSet:
+		if s, ok := op.Value.(string); ok && strings.Contains(s, "{{") {
+			c.tmpl, err = template.New(op.Path).Option("missingkey=zero").Parse(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value template: %w", err)
+			}
+		}
+	case BodyOpDelete:
+	case BodyOpRename:
+		c.from, err = parseJSONPointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if len(c.from) == 0 {
+			return nil, fmt.Errorf("from is required for rename")
+		}
+	default:
+		return nil, fmt.Errorf("unknown body op %q", op.Op)
+	}
+	return c, nil
+}
+
+// apply runs the op against a decoded JSON document
+func (c *compiledBodyOp) apply(doc interface{}, data *TemplateData) (interface{}, error) {
+	switch c.op {
+	case BodyOpSet:
+		// Copy so later ops can't modify the configured value through this request
+		value := deepCopyJSON(c.value)
+		if c.tmpl != nil {
+			var buf bytes.Buffer
+			if err := c.tmpl.Execute(&buf, data); err != nil {
+				return doc, fmt.Errorf("rendering value for %s: %w", c.path, err)
+			}
+			value = buf.String()
+		}
+		return c.path.set(doc, value)
+
+	case BodyOpDelete:
+		doc, _ = c.path.remove(doc)
+		return doc, nil
+
+	case BodyOpRename:
+		value, ok := c.from.get(doc)
+		if !ok {
+			return doc, nil
+		}
+		// Move it in a copy, so the field stays where it was if the target
+		// can't be set (an array index out of range, a string in the way)
+		moved, _ := c.from.remove(deepCopyJSON(doc))
+		moved, err := c.path.set(moved, value)
+		if err != nil {
+			return doc, err
+		}
+		return moved, nil
+	}
+	return doc, nil
+}
+
+// JSONBodyProcessor rewrites JSON request and response bodies.
+// It works on complete bodies, so Gloo has to be configured with
+// requestBodyMode / responseBodyMode BUFFERED for it to do anything.
+type JSONBodyProcessor struct {
+	BaseProcessor
+
+	name     string
+	request  []*compiledBodyOp
+	response []*compiledBodyOp
+}
+
+// NewJSONBodyProcessor builds the processor for a set of configured body changes
+func NewJSONBodyProcessor(name string, cfg BodyConfig) (*JSONBodyProcessor, error) {
+	request, err := compileBodyOps(cfg.Request)
+	if err != nil {
+		return nil, fmt.Errorf("request%w", err)
+	}
+	response, err := compileBodyOps(cfg.Response)
+	if err != nil {
+		return nil, fmt.Errorf("response%w", err)
+	}
+	return &JSONBodyProcessor{name: name, request: request, response: response}, nil
+}
+
+func (p *JSONBodyProcessor) Name() string { return p.name }
+
+// RequestBody applies the request body changes
+func (p *JSONBodyProcessor) RequestBody(sc *StreamContext, body *extprocv3.HttpBody) (*Result, error) {
+	return p.rewrite(sc, body, p.request, sc.RequestHeaders, &sc.RequestBody)
+}
+
+// ResponseBody applies the response body changes
+func (p *JSONBodyProcessor) ResponseBody(sc *StreamContext, body *extprocv3.HttpBody) (*Result, error) {
+	return p.rewrite(sc, body, p.response, sc.ResponseHeaders, &sc.ResponseBody)
+}
+
+func (p *JSONBodyProcessor) rewrite(sc *StreamContext, body *extprocv3.HttpBody, ops []*compiledBodyOp, headers *extprocv3.HttpHeaders, stream *BodyStream) (*Result, error) {
+	if len(ops) == 0 {
+		return nil, nil
+	}
+	// Only complete bodies can be parsed as JSON
+	if !stream.Whole() {
+		if stream.Index == 0 {
+			sc.Logger().Warnw("Body chunk is not the whole body, skipping JSON rewrite (use BUFFERED mode)", "processor", p.name)
+		}
+		return nil, nil
+	}
+	if len(body.GetBody()) == 0 || !isJSONContentType(headers) {
+		return nil, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body.GetBody()))
+	decoder.UseNumber() // keep numbers exactly as they were sent
+	doc, err := decodeJSON(decoder)
+	if err == nil {
+		// Anything after the first value would be lost by re-encoding it
+		if _, next := decoder.Token(); next != io.EOF {
+			err = fmt.Errorf("unexpected data after the JSON value")
+		}
+	}
+	if err != nil {
+		// Not our job to reject bad JSON, let the backend decide
+		sc.Logger().Infow("Body is not valid JSON, leaving it unchanged", "processor", p.name, "error", err)
+		return nil, nil
+	}
+
+	data := NewTemplateData(sc.RequestHeaders)
+	for _, op := range ops {
+		next, err := op.apply(doc, data)
+		if err != nil {
+			sc.Logger().Infow("Skipping body op", "processor", p.name, "op", op.op, "path", op.path.String(), "error", err)
+			continue
+		}
+		doc = next
+	}
+
+	var encoded bytes.Buffer
+	if err := encodeJSON(&encoded, doc); err != nil {
+		return nil, fmt.Errorf("encoding JSON body: %w", err)
+	}
+	newBody := encoded.Bytes()
+	sc.Logger().Debugw("Rewrote JSON body", "processor", p.name, "bytes_in", len(body.GetBody()), "bytes_out", len(newBody))
+
+	// The body length changed, so content-length has to follow
+	return &Result{
+		HeaderMutation: &extprocv3.HeaderMutation{
+			SetHeaders: []*corev3.HeaderValueOption{setHeader("content-length", strconv.Itoa(len(newBody)))},
+		},
+		BodyMutation: &extprocv3.BodyMutation{
+			Mutation: &extprocv3.BodyMutation_Body{Body: newBody},
+		},
+	}, nil
+}
+
+// deepCopyJSON copies the objects and arrays of a JSON document
+func deepCopyJSON(v interface{}) interface{} {
+	switch n := v.(type) {
+	case *jsonObject:
+		c := &jsonObject{keys: append([]string(nil), n.keys...), values: make(map[string]interface{}, len(n.values))}
+		for k, child := range n.values {
+			c.values[k] = deepCopyJSON(child)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(n))
+		for i, child := range n {
+			c[i] = deepCopyJSON(child)
+		}
+		return c
+	default:
+		return v
+	}
+}
+
+// isJSONContentType reports whether the headers declare a JSON body
+// (application/json or any application/*+json type)
+func isJSONContentType(headers *extprocv3.HttpHeaders) bool {
+	contentType, ok := getHeader(headers, "content-type")
+	if !ok {
+		return false
+	}
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	return contentType == "application/json" ||
+		(strings.HasPrefix(contentType, "application/") && strings.HasSuffix(contentType, "+json"))
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+func TestJSONBodyRewrite(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  []BodyOp
+		body string
+		// want is the rewritten body, or "" if the body must be left alone
+		want string
+	}{
+		{
+			name: "set",
+			ops:  []BodyOp{{Op: "set", Path: "/tenant/id", Value: "t1"}},
+			body: `{"keep":"me"}`,
+			want: `{"keep":"me","tenant":{"id":"t1"}}`,
+		},
+		{
+			name: "set out of range keeps the document",
+			ops:  []BodyOp{{Op: "set", Path: "/items/5", Value: 3}},
+			body: `{"items":[1,2],"keep":"me"}`,
+			want: `{"items":[1,2],"keep":"me"}`,
+		},
+		{
+			name: "set into a scalar keeps the document",
+			ops:  []BodyOp{{Op: "set", Path: "/keep/inner", Value: 1}},
+			body: `{"keep":"me"}`,
+			want: `{"keep":"me"}`,
+		},
+		{
+			name: "failed op does not stop later ops",
+			ops: []BodyOp{
+				{Op: "set", Path: "/items/5", Value: 3},
+				{Op: "delete", Path: "/keep"},
+			},
+			body: `{"items":[1,2],"keep":"me"}`,
+			want: `{"items":[1,2]}`,
+		},
+		{
+			name: "rename",
+			ops:  []BodyOp{{Op: "rename", From: "/old", Path: "/new"}},
+			body: `{"old":1}`,
+			want: `{"new":1}`,
+		},
+		{
+			name: "rename to an unsettable target keeps the field",
+			ops:  []BodyOp{{Op: "rename", From: "/keep", Path: "/items/5"}},
+			body: `{"items":[1,2],"keep":"me"}`,
+			want: `{"items":[1,2],"keep":"me"}`,
+		},
+		{
+			// Removing /items/0 shifts /items/1 out of range
+			name: "rename to an index the removal shifts keeps the field",
+			ops:  []BodyOp{{Op: "rename", From: "/items/0", Path: "/items/1"}},
+			body: `{"items":[1,2]}`,
+			want: `{"items":[1,2]}`,
+		},
+		{
+			name: "trailing value",
+			ops:  []BodyOp{{Op: "set", Path: "/a", Value: 1}},
+			body: `{"b":2} {"c":3}`,
+		},
+		{
+			name: "trailing garbage",
+			ops:  []BodyOp{{Op: "set", Path: "/a", Value: 1}},
+			body: `{"b":2}]`,
+		},
+		{
+			name: "trailing whitespace",
+			ops:  []BodyOp{{Op: "set", Path: "/a", Value: 1}},
+			body: "{\"b\":2}\n",
+			want: `{"b":2,"a":1}`,
+		},
+		{
+			name: "keys keep their order",
+			ops:  []BodyOp{{Op: "set", Path: "/m", Value: "new"}, {Op: "set", Path: "/b", Value: 3}},
+			body: `{"z":1,"b":2,"m":{"y":1,"x":2}}`,
+			want: `{"z":1,"b":3,"m":"new"}`,
+		},
+		{
+			name: "numbers keep their form",
+			ops:  []BodyOp{{Op: "delete", Path: "/gone"}},
+			body: `{"gone":1,"float":1.0,"exp":1e3,"big":12345678901234567890123,"neg":-0.50}`,
+			want: `{"float":1.0,"exp":1e3,"big":12345678901234567890123,"neg":-0.50}`,
+		},
+		{
+			name: "HTML characters are not escaped",
+			ops:  []BodyOp{{Op: "set", Path: "/q", Value: "a<b && c>d"}},
+			body: `{"html":"<p>&amp;</p>"}`,
+			want: `{"html":"<p>&amp;</p>","q":"a<b && c>d"}`,
+		},
+		{
+			name: "configured objects have sorted keys",
+			ops:  []BodyOp{{Op: "set", Path: "/meta", Value: map[string]interface{}{"z": 1, "a": []interface{}{true, nil}}}},
+			body: `{}`,
+			want: `{"meta":{"a":[true,null],"z":1}}`,
+		},
+		{
+			name: "invalid JSON",
+			ops:  []BodyOp{{Op: "set", Path: "/a", Value: 1}},
+			body: `{"b":`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewJSONBodyProcessor("body", BodyConfig{Request: tt.ops})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sc := NewStreamContext(context.Background())
+			sc.RequestHeaders = testHeaders("content-type", "application/json")
+			body := &extprocv3.HttpBody{Body: []byte(tt.body), EndOfStream: true}
+			sc.RequestBody.next(body)
+
+			result, err := p.RequestBody(sc, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == "" {
+				if result != nil {
+					t.Fatalf("body changed to %s, want it unchanged", result.BodyMutation.GetBody())
+				}
+				return
+			}
+			if got := string(result.BodyMutation.GetBody()); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBodyOpValueValidation(t *testing.T) {
+	_, err := ParseConfig([]byte(`
+body:
+  request:
+    - op: set
+      path: /limits
+      value:
+        1: one
+`))
+	if err == nil || !strings.Contains(err.Error(), "not a string") {
+		t.Errorf("ParseConfig with a non-string key = %v, want an error", err)
+	}
+	if _, err := ParseConfig([]byte(`
+body:
+  request:
+    - op: set
+      path: /limits
+      value: {max: 1, tiers: [{name: free}]}
+`)); err != nil {
+		t.Errorf("ParseConfig with string keys: %v", err)
+	}
+}
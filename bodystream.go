@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	extprocfilterv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// BodyStream tracks one direction of a body (request or response) across
+// the Recv calls of a stream. Envoy sends the body as one or more HttpBody
+// messages depending on the body send mode:
+//
+//   - NONE: no body messages at all
+//   - STREAMED: one message per chunk as it arrives; the last one has EndOfStream
+//   - BUFFERED: exactly one message with the whole body and EndOfStream
+//   - BUFFERED_PARTIAL: exactly one message; EndOfStream is false if the body
+//     was larger than Envoy's buffer, and the rest goes upstream without us
+//
+// The server updates the BodyStream before the processors see each chunk,
+// so processors can tell where in the body they are.
+type BodyStream struct {
+	// Index is the 0-based number of the current chunk
+	Index int
+	// Offset is how many bytes came before the current chunk
+	Offset int64
+	// Received is the total number of bytes seen so far, current chunk included
+	Received int64
+	// EndOfStream is true once the last chunk has been seen
+	EndOfStream bool
+	// Expected is false when the headers said there is no body at all
+	Expected bool
+
+	// chunks counts the chunks received so far
+	chunks int
+}
+
+// next records a newly received chunk
+func (b *BodyStream) next(body *extprocv3.HttpBody) {
+	b.Index = b.chunks
+	b.chunks++
+	b.Offset = b.Received
+	b.Received += int64(len(body.GetBody()))
+	b.EndOfStream = body.GetEndOfStream()
+}
+
+// Whole reports whether the current chunk is the complete body, which is
+// always the case in BUFFERED mode and for small bodies in STREAMED mode
+func (b *BodyStream) Whole() bool {
+	return b.Index == 0 && b.EndOfStream
+}
+
+// ReplaceChunk returns a result that replaces the current chunk with data.
+// In STREAMED mode only this chunk changes; the rest of the body is untouched.
+func ReplaceChunk(data []byte) *Result {
+	return &Result{
+		BodyMutation: &extprocv3.BodyMutation{
+			Mutation: &extprocv3.BodyMutation_Body{Body: data},
+		},
+	}
+}
+
+// ClearChunk returns a result that drops the current chunk entirely
+func ClearChunk() *Result {
+	return &Result{
+		BodyMutation: &extprocv3.BodyMutation{
+			Mutation: &extprocv3.BodyMutation_ClearBody{ClearBody: true},
+		},
+	}
+}
+
+// parseBodySendMode parses one of the Envoy body send mode names.
+// The empty string means STREAMED.
+func parseBodySendMode(s string) (extprocfilterv3.ProcessingMode_BodySendMode, error) {
+	if s == "" {
+		return extprocfilterv3.ProcessingMode_STREAMED, nil
+	}
+	v, ok := extprocfilterv3.ProcessingMode_BodySendMode_value[strings.ToUpper(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown body mode %q (want NONE, STREAMED, BUFFERED or BUFFERED_PARTIAL)", s)
+	}
+	return extprocfilterv3.ProcessingMode_BodySendMode(v), nil
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the declarative configuration loaded at startup.
+// It can be written as YAML or JSON (JSON is valid YAML, so one parser reads both).
+//
+//	headers:
+//	  request:
+//	    - name: x-processed-by
+//	      value: eag-extproc
+//	  response:
+//	    - name: server
+//	      action: remove
+//	rules:
+//	  - name: admin
+//	    match:
+//	      path: { prefix: /admin }
+//	    headers:
+//	      request:
+//	        - name: x-admin-route
+//	          value: "true"
+type Config struct {
+	// Headers are applied to every request/response
+	Headers HeadersConfig `yaml:"headers" json:"headers"`
+
+	// Body changes are applied to every JSON request/response body
+	Body BodyConfig `yaml:"body" json:"body"`
+
+	// Security adds security headers to every response (off if not set)
+	Security *SecurityConfig `yaml:"security" json:"security"`
+
+	// Deny sets the templates used for rejected requests
+	Deny *DenyConfig `yaml:"deny" json:"deny"`
+
+	// RequestID sets the format of generated request IDs and turns trace
+	// context propagation off (both on by default)
+	RequestID *RequestIDConfig `yaml:"requestID" json:"requestID"`
+
+	// ClientIP says how the client address is taken from x-forwarded-for.
+	// The client-ip processor runs when this or any rule's ipFilter is set.
+	ClientIP *ClientIPConfig `yaml:"clientIP" json:"clientIP"`
+
+	// JWT validates bearer tokens before anything else runs (off if not set)
+	JWT *JWTConfig `yaml:"jwt" json:"jwt"`
+
+	// APIKeys checks API keys against a hashed key store (off if not set)
+	APIKeys *APIKeyConfig `yaml:"apiKeys" json:"apiKeys"`
+
+	// RateLimitStore shares rate limit counts between replicas (in memory if not set)
+	RateLimitStore *RateLimitStoreConfig `yaml:"rateLimitStore" json:"rateLimitStore"`
+
+	// Tracing exports spans to an OpenTelemetry collector (off if not set)
+	Tracing *TracingConfig `yaml:"tracing" json:"tracing"`
+
+	// Audit writes a JSON line per request to a rotating file (off if not set)
+	Audit *AuditConfig `yaml:"audit" json:"audit"`
+
+	// FailurePolicy decides whether a processor that panics or fails is
+	// skipped or rejects the request (rejects if not set)
+	FailurePolicy *FailurePolicyConfig `yaml:"failurePolicy" json:"failurePolicy"`
+
+	// MessageTimeout gives every message a deadline, asking Envoy for more
+	// time when the processors are slow (no deadline if not set)
+	MessageTimeout *MessageTimeoutConfig `yaml:"messageTimeout" json:"messageTimeout"`
+
+	// Rules are applied only to requests that match, in the order listed
+	Rules []RuleConfig `yaml:"rules" json:"rules"`
+}
+
+// RuleConfig is a named set of header and body changes guarded by a matcher.
+// If Deny is set, matching requests are rejected instead. IPFilter and
+// RateLimit reject matching requests from the wrong clients (403) or over
+// the limit (429).
+type RuleConfig struct {
+	Name      string           `yaml:"name" json:"name"`
+	Match     *MatchConfig     `yaml:"match" json:"match"`
+	Headers   HeadersConfig    `yaml:"headers" json:"headers"`
+	Body      BodyConfig       `yaml:"body" json:"body"`
+	Deny      *DenyRuleConfig  `yaml:"deny" json:"deny"`
+	IPFilter  *IPFilterConfig  `yaml:"ipFilter" json:"ipFilter"`
+	RateLimit *RateLimitConfig `yaml:"rateLimit" json:"rateLimit"`
+}
+
+// HeadersConfig lists the header changes for each direction of traffic
+type HeadersConfig struct {
+	Request  []HeaderRule `yaml:"request" json:"request"`
+	Response []HeaderRule `yaml:"response" json:"response"`
+}
+
+// HeaderRule is one header change.
+//
+// Action is one of:
+//   - set (default): overwrite the header, or add it if missing
+//   - append: add another value, or add the header if missing
+//   - add_if_absent: add the header only if it is not already present
+//   - remove: remove the header (value is ignored)
+//
+// The Envoy enum names (OVERWRITE_IF_EXISTS_OR_ADD, APPEND_IF_EXISTS_OR_ADD,
+// ADD_IF_ABSENT) are accepted as well.
+type HeaderRule struct {
+	Name   string `yaml:"name" json:"name"`
+	Value  string `yaml:"value" json:"value"`
+	Action string `yaml:"action" json:"action"`
+}
+
+// Header actions understood in HeaderRule.Action
+const (
+	ActionSet         = "set"
+	ActionAppend      = "append"
+	ActionAddIfAbsent = "add_if_absent"
+	ActionRemove      = "remove"
+)
+
+// DefaultConfig is used when no config file is given.
+// It keeps the original behaviour of the service: one x-processed-by header.
+func DefaultConfig() *Config {
+	return &Config{
+		Headers: HeadersConfig{
+			Request: []HeaderRule{
+				{Name: "x-processed-by", Value: "eag-extproc", Action: ActionSet},
+			},
+		},
+	}
+}
+
+// LoadConfig reads and validates a YAML or JSON config file
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+
+	cfg, err := ParseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// ParseConfig parses and validates YAML or JSON config data
+func ParseConfig(data []byte) (*Config, error) {
+	cfg := &Config{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing config: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return cfg, nil
+}
+
+// Validate checks the config for mistakes we can catch before serving traffic
+func (c *Config) Validate() error {
+	if err := c.Headers.validate(); err != nil {
+		return fmt.Errorf("headers.%w", err)
+	}
+	if err := c.Body.validate(); err != nil {
+		return fmt.Errorf("body.%w", err)
+	}
+	if c.Security != nil {
+		if err := c.Security.validate(); err != nil {
+			return fmt.Errorf("security: %w", err)
+		}
+	}
+	if _, err := NewDenyRenderer(c.Deny); err != nil {
+		return fmt.Errorf("deny: %w", err)
+	}
+	if c.RequestID != nil {
+		if err := c.RequestID.validate(); err != nil {
+			return fmt.Errorf("requestID: %w", err)
+		}
+	}
+	if c.ClientIP != nil {
+		if err := c.ClientIP.validate(); err != nil {
+			return fmt.Errorf("clientIP: %w", err)
+		}
+	}
+	if c.JWT != nil {
+		if err := c.JWT.validate(); err != nil {
+			return fmt.Errorf("jwt: %w", err)
+		}
+	}
+	if c.APIKeys != nil {
+		if err := c.APIKeys.validate(); err != nil {
+			return fmt.Errorf("apiKeys: %w", err)
+		}
+	}
+	if c.RateLimitStore != nil {
+		if err := c.RateLimitStore.validate(); err != nil {
+			return fmt.Errorf("rateLimitStore: %w", err)
+		}
+	}
+	if c.Tracing != nil {
+		if err := c.Tracing.validate(); err != nil {
+			return fmt.Errorf("tracing: %w", err)
+		}
+		if c.RequestID != nil && c.RequestID.DisableTraceContext {
+			return fmt.Errorf("tracing: needs trace context, but requestID.disableTraceContext is set")
+		}
+	}
+	if c.Audit != nil {
+		if err := c.Audit.validate(); err != nil {
+			return fmt.Errorf("audit: %w", err)
+		}
+	}
+	if c.FailurePolicy != nil {
+		if err := c.FailurePolicy.validate(); err != nil {
+			return fmt.Errorf("failurePolicy.%w", err)
+		}
+	}
+	if c.MessageTimeout != nil {
+		if err := c.MessageTimeout.validate(); err != nil {
+			return fmt.Errorf("messageTimeout: %w", err)
+		}
+	}
+
+	names := map[string]bool{}
+	for i, rule := range c.Rules {
+		if rule.Name == "" {
+			return fmt.Errorf("rules[%d]: name is required", i)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("rules[%d]: duplicate rule name %q", i, rule.Name)
+		}
+		names[rule.Name] = true
+
+		if _, err := CompileMatcher(rule.Match); err != nil {
+			return fmt.Errorf("rules[%d] (%s): match.%w", i, rule.Name, err)
+		}
+		if err := rule.Headers.validate(); err != nil {
+			return fmt.Errorf("rules[%d] (%s): headers.%w", i, rule.Name, err)
+		}
+		if err := rule.Body.validate(); err != nil {
+			return fmt.Errorf("rules[%d] (%s): body.%w", i, rule.Name, err)
+		}
+		if rule.Deny != nil {
+			if err := rule.Deny.validate(); err != nil {
+				return fmt.Errorf("rules[%d] (%s): deny: %w", i, rule.Name, err)
+			}
+		}
+		if rule.IPFilter != nil {
+			if err := rule.IPFilter.validate(); err != nil {
+				return fmt.Errorf("rules[%d] (%s): ipFilter.%w", i, rule.Name, err)
+			}
+		}
+		if rule.RateLimit != nil {
+			if err := rule.RateLimit.validate(); err != nil {
+				return fmt.Errorf("rules[%d] (%s): rateLimit: %w", i, rule.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (h HeadersConfig) validate() error {
+	for i, rule := range h.Request {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("request[%d]: %w", i, err)
+		}
+	}
+	for i, rule := range h.Response {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("response[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (r HeaderRule) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("header name is required")
+	}
+	if _, _, err := r.appendAction(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// appendAction maps the rule's action to the Envoy append action.
+// remove is true when the header should be removed instead of set.
+func (r HeaderRule) appendAction() (action corev3.HeaderValueOption_HeaderAppendAction, remove bool, err error) {
+	switch strings.ToLower(r.Action) {
+	case "", ActionSet, "overwrite_if_exists_or_add":
+		return corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD, false, nil
+	case ActionAppend, "append_if_exists_or_add":
+		return corev3.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD, false, nil
+	case ActionAddIfAbsent:
+		return corev3.HeaderValueOption_ADD_IF_ABSENT, false, nil
+	case ActionRemove:
+		return 0, true, nil
+	default:
+		return 0, false, fmt.Errorf("unknown header action %q", r.Action)
+	}
+}
+
+// usesIPFilter reports whether any rule filters by client address
+func (c *Config) usesIPFilter() bool {
+	for _, rule := range c.Rules {
+		if rule.IPFilter != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// BuildChain creates the processor chain described by the config.
+// The request ID, client address and authentication come first, then the
+// global header and body changes, then the security headers, then each rule
+// in the order listed.
+func BuildChain(cfg *Config) (*Chain, error) {
+	chain := NewChain()
+
+	renderer, err := NewDenyRenderer(cfg.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
+
+	var store *RedisStore
+	if cfg.RateLimitStore != nil {
+		if store, err = NewRedisStore(cfg.RateLimitStore); err != nil {
+			return nil, fmt.Errorf("rateLimitStore: %w", err)
+		}
+	}
+
+	// Every request gets an ID and trace context, whatever the config
+	ids, err := NewRequestIDProcessor(cfg.RequestID)
+	if err != nil {
+		return nil, fmt.Errorf("requestID: %w", err)
+	}
+	chain.AddRequestID(ids)
+
+	if cfg.Tracing != nil {
+		tracer, err := NewTracer(cfg.Tracing)
+		if err != nil {
+			return nil, fmt.Errorf("tracing: %w", err)
+		}
+		chain.SetTracer(tracer)
+	}
+	if cfg.Audit != nil {
+		audit, err := NewAuditLog(cfg.Audit)
+		if err != nil {
+			return nil, fmt.Errorf("audit: %w", err)
+		}
+		chain.SetAuditLog(audit)
+	}
+	if cfg.MessageTimeout != nil {
+		deadline, err := NewMessageDeadline(cfg.MessageTimeout, renderer)
+		if err != nil {
+			return nil, fmt.Errorf("messageTimeout: %w", err)
+		}
+		chain.SetMessageDeadline(deadline)
+	}
+
+	// The client address is resolved before anything uses it
+	if cfg.ClientIP != nil || cfg.usesIPFilter() {
+		clientIP, err := NewClientIPProcessor(cfg.ClientIP)
+		if err != nil {
+			return nil, fmt.Errorf("clientIP: %w", err)
+		}
+		chain.Add(clientIP)
+	}
+
+	// Authentication runs first so nothing else is done for rejected requests
+	if cfg.JWT != nil {
+		jwt, err := NewJWTProcessor(cfg.JWT, renderer)
+		if err != nil {
+			return nil, fmt.Errorf("jwt: %w", err)
+		}
+		matcher, err := CompileMatcher(cfg.JWT.Match)
+		if err != nil {
+			return nil, fmt.Errorf("jwt: match.%w", err)
+		}
+		chain.AddWithMatcher(jwt, matcher)
+	}
+	if cfg.APIKeys != nil {
+		apiKeys, err := NewAPIKeyProcessor(cfg.APIKeys, renderer)
+		if err != nil {
+			return nil, fmt.Errorf("apiKeys: %w", err)
+		}
+		matcher, err := CompileMatcher(cfg.APIKeys.Match)
+		if err != nil {
+			return nil, fmt.Errorf("apiKeys: match.%w", err)
+		}
+		chain.AddWithMatcher(apiKeys, matcher)
+	}
+
+	global, err := NewHeaderMutationProcessor("headers", cfg.Headers)
+	if err != nil {
+		return nil, fmt.Errorf("headers: %w", err)
+	}
+	chain.Add(global)
+	if cfg.Body.HasJSONOps() {
+		body, err := NewJSONBodyProcessor("body", cfg.Body)
+		if err != nil {
+			return nil, fmt.Errorf("body.%w", err)
+		}
+		chain.Add(body)
+	}
+	if !cfg.Body.Stream.IsEmpty() {
+		stream, err := NewStreamReplaceProcessor("body-stream", cfg.Body.Stream)
+		if err != nil {
+			return nil, fmt.Errorf("body.stream.%w", err)
+		}
+		chain.Add(stream)
+	}
+
+	if cfg.Security != nil {
+		security, err := NewSecurityHeadersProcessor(cfg.Security)
+		if err != nil {
+			return nil, fmt.Errorf("security: %w", err)
+		}
+		chain.Add(security)
+	}
+
+	for _, rule := range cfg.Rules {
+		matcher, err := CompileMatcher(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+		if rule.IPFilter != nil {
+			filter, err := NewIPFilterProcessor("rule:"+rule.Name+":ipfilter", rule.IPFilter, renderer)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: ipFilter.%w", rule.Name, err)
+			}
+			chain.AddWithMatcher(filter, matcher)
+		}
+		if rule.Deny != nil {
+			deny, err := NewDenyProcessor("rule:"+rule.Name+":deny", rule.Deny, renderer)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: deny: %w", rule.Name, err)
+			}
+			chain.AddWithMatcher(deny, matcher)
+		}
+		if rule.RateLimit != nil {
+			limit, err := NewRateLimitProcessor("rule:"+rule.Name+":ratelimit", rule.RateLimit, store, renderer)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: rateLimit: %w", rule.Name, err)
+			}
+			chain.AddWithMatcher(limit, matcher)
+		}
+		p, err := NewHeaderMutationProcessor("rule:"+rule.Name, rule.Headers)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+		chain.AddWithMatcher(p, matcher)
+
+		if rule.Body.HasJSONOps() {
+			body, err := NewJSONBodyProcessor("rule:"+rule.Name+":body", rule.Body)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: body.%w", rule.Name, err)
+			}
+			chain.AddWithMatcher(body, matcher)
+		}
+		if !rule.Body.Stream.IsEmpty() {
+			stream, err := NewStreamReplaceProcessor("rule:"+rule.Name+":body-stream", rule.Body.Stream)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: body.stream.%w", rule.Name, err)
+			}
+			chain.AddWithMatcher(stream, matcher)
+		}
+	}
+
+	if err := chain.SetFailurePolicy(cfg.FailurePolicy, renderer); err != nil {
+		return nil, fmt.Errorf("failurePolicy.%w", err)
+	}
+	return chain, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+)
+
+func writeTestFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeConfig writes a config file into a test directory
+func writeConfig(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	writeTestFile(t, path, []byte(data))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	yamlPath := writeConfig(t, "config.yaml", `
+headers:
+  request:
+    - name: x-processed-by
+      value: eag-extproc
+  response:
+    - name: server
+      action: remove
+`)
+	jsonPath := writeConfig(t, "config.json", `{
+  "headers": {
+    "request": [{"name": "x-processed-by", "value": "eag-extproc"}],
+    "response": [{"name": "server", "action": "remove"}]
+  }
+}`)
+	want := HeadersConfig{
+		Request:  []HeaderRule{{Name: "x-processed-by", Value: "eag-extproc"}},
+		Response: []HeaderRule{{Name: "server", Action: ActionRemove}},
+	}
+	for _, path := range []string{yamlPath, jsonPath} {
+		cfg, err := LoadConfig(path)
+		if err != nil {
+			t.Fatalf("%s: %v", filepath.Base(path), err)
+		}
+		if !reflect.DeepEqual(cfg.Headers, want) {
+			t.Errorf("%s: headers %+v, want %+v", filepath.Base(path), cfg.Headers, want)
+		}
+	}
+
+	if _, err := LoadConfig("config.example.yaml"); err != nil {
+		t.Errorf("config.example.yaml: %v", err)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name, data string
+		// want is a part of the error message
+		want string
+	}{
+		{"not YAML", "headers: [", "config"},
+		{"wrong type", "headers:\n  request: x-processed-by\n", "config"},
+		{"no header name", "headers:\n  request:\n    - value: x\n", "headers.request[0]: header name is required"},
+		{"unknown action", "headers:\n  response:\n    - name: a\n    - name: b\n      action: replace\n", `headers.response[1]: unknown header action "replace"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, "config.yaml", tt.data)
+			_, err := LoadConfig(path)
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if !strings.Contains(err.Error(), tt.want) || !strings.Contains(err.Error(), path) {
+				t.Errorf("error %q does not name %s and %q", err, path, tt.want)
+			}
+		})
+	}
+
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("missing file: no error")
+	}
+}
+
+func TestHeaderRuleActions(t *testing.T) {
+	tests := []struct {
+		action string
+		want   corev3.HeaderValueOption_HeaderAppendAction
+		remove bool
+	}{
+		{"", corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD, false},
+		{"set", corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD, false},
+		{"OVERWRITE_IF_EXISTS_OR_ADD", corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD, false},
+		{"append", corev3.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD, false},
+		{"APPEND_IF_EXISTS_OR_ADD", corev3.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD, false},
+		{"add_if_absent", corev3.HeaderValueOption_ADD_IF_ABSENT, false},
+		{"ADD_IF_ABSENT", corev3.HeaderValueOption_ADD_IF_ABSENT, false},
+		{"Remove", 0, true},
+	}
+	for _, tt := range tests {
+		action, remove, err := HeaderRule{Name: "x", Action: tt.action}.appendAction()
+		if err != nil || action != tt.want || remove != tt.remove {
+			t.Errorf("action %q = %v, %v, %v; want %v, %v", tt.action, action, remove, err, tt.want, tt.remove)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// MessageTimeoutConfig gives every message a server-side deadline, so a
+// slow processor (an external lookup, a big body) doesn't run into Envoy's
+// message_timeout, which fails the request.
+//
+//	messageTimeout:
+//	  deadline: 2s
+//	  overrideAfter: 150ms
+//	  overrideTimeout: 3s
+//	  fallback: deny
+//
+// If the processors are still busy after overrideAfter, Envoy is asked to
+// wait overrideTimeout longer (override_message_timeout, once per phase).
+// If they are still busy at the deadline, the fallback response is sent in
+// their place and whatever they produce later is thrown away.
+type MessageTimeoutConfig struct {
+	// Deadline is how long the processors get for one message (required).
+	// Without overrideAfter it must be below Envoy's message_timeout.
+	Deadline time.Duration `yaml:"deadline" json:"deadline"`
+
+	// OverrideAfter is when to ask Envoy for more time; it must be below
+	// Envoy's message_timeout (200ms by default). 0 never asks.
+	OverrideAfter time.Duration `yaml:"overrideAfter" json:"overrideAfter"`
+	// OverrideTimeout is the new message timeout sent to Envoy. Envoy only
+	// accepts it up to the filter's max_message_timeout.
+	OverrideTimeout time.Duration `yaml:"overrideTimeout" json:"overrideTimeout"`
+
+	// Fallback is the response sent at the deadline: deny (default)
+	// rejects the request, continue lets the message through unchanged.
+	// continue still denies unless every processor that hadn't finished
+	// fails open, and, for request headers, none of them decides whether
+	// the request gets in (authentication, IP filters, deny rules, rate
+	// limits).
+	Fallback string `yaml:"fallback" json:"fallback"`
+	// FallbackStatus is the status for deny (default 504)
+	FallbackStatus int `yaml:"fallbackStatus" json:"fallbackStatus"`
+}
+
+// Fallback responses understood in MessageTimeoutConfig.Fallback
+const (
+	FallbackContinue = "continue"
+	FallbackDeny     = "deny"
+)
+
+func (c *MessageTimeoutConfig) validate() error {
+	if c.Deadline <= 0 {
+		return fmt.Errorf("deadline is required")
+	}
+	if c.OverrideAfter < 0 || c.OverrideTimeout < 0 {
+		return fmt.Errorf("overrideAfter and overrideTimeout must not be negative")
+	}
+	if c.OverrideAfter > 0 {
+		if c.OverrideAfter >= c.Deadline {
+			return fmt.Errorf("overrideAfter must be below deadline")
+		}
+		// Envoy restarts its timer when the override arrives
+		if c.OverrideAfter+c.OverrideTimeout <= c.Deadline {
+			return fmt.Errorf("overrideTimeout must be longer than deadline - overrideAfter (%s), or Envoy gives up first",
+				c.Deadline-c.OverrideAfter)
+		}
+	} else if c.OverrideTimeout > 0 {
+		return fmt.Errorf("overrideTimeout needs overrideAfter")
+	}
+	switch c.Fallback {
+	case "", FallbackDeny, FallbackContinue:
+	default:
+		return fmt.Errorf("unknown fallback %q (use %s or %s)", c.Fallback, FallbackDeny, FallbackContinue)
+	}
+	if c.FallbackStatus != 0 && (c.FallbackStatus < 400 || c.FallbackStatus > 599) {
+		return fmt.Errorf("fallbackStatus must be a 4xx or 5xx status")
+	}
+	return nil
+}
+
+// MessageDeadline enforces a MessageTimeoutConfig
+type MessageDeadline struct {
+	cfg      MessageTimeoutConfig
+	renderer *DenyRenderer
+}
+
+// NewMessageDeadline creates the deadline; renderer answers deny fallbacks
+func NewMessageDeadline(cfg *MessageTimeoutConfig, renderer *DenyRenderer) (*MessageDeadline, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	d := &MessageDeadline{cfg: *cfg, renderer: renderer}
+	if d.cfg.FallbackStatus == 0 {
+		d.cfg.FallbackStatus = http.StatusGatewayTimeout
+	}
+	return d, nil
+}
+
+// SetMessageDeadline gives every message the chain handles a deadline
+func (c *Chain) SetMessageDeadline(d *MessageDeadline) {
+	c.deadline = d
+}
+
+// Handle runs the processor chain for one message with the chain's
+// deadline, or without one if none is set. send is only called before
+// Handle returns, to ask Envoy for more time or to send the fallback; sent
+// reports that the fallback went out, and is what is returned in place of
+// the processors' response.
+//
+// With a deadline the processors run on a goroutine of their own and a
+// fork of sc, so the fallback goes out, and the stream moves on, without
+// waiting for them. What they return or store after that is dropped,
+// except for the state fork lists as kept.
+func (c *Chain) Handle(sc *StreamContext, req *extprocv3.ProcessingRequest, send func(*extprocv3.ProcessingResponse) error) (response *extprocv3.ProcessingResponse, sent bool, err error) {
+	d := c.deadline
+	// In async mode Envoy isn't waiting for a reply
+	if d == nil || req.AsyncMode {
+		response, err := handleMessage(c, sc, req)
+		return response, false, err
+	}
+
+	// A phase gets one extension. A later message of it (a body chunk)
+	// has to be answered before Envoy's own timeout instead.
+	extend := d.cfg.OverrideAfter > 0 && !sc.extended[sc.Phase]
+	timeout := d.cfg.Deadline
+	if d.cfg.OverrideAfter > 0 && !extend {
+		timeout = d.cfg.OverrideAfter
+	}
+
+	// The processors get a context that ends at the deadline, so lookups
+	// that take sc as their context give up in time. It is cancelled on
+	// return, which also stops processors that missed the deadline.
+	trackMessage(sc, req)
+	ctx, cancel := context.WithTimeout(sc.Context, timeout)
+	defer cancel()
+	work := sc.fork(ctx)
+	finished := make(chan messageResult, 1)
+	go func() {
+		response, err := runMessage(c, work, req)
+		finished <- messageResult{response, err}
+	}()
+
+	var override <-chan time.Time
+	if extend {
+		t := time.NewTimer(d.cfg.OverrideAfter)
+		defer t.Stop()
+		override = t.C
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	var late *messageResult
+	for {
+		select {
+		case result := <-finished:
+			// Processors that stopped because their context ran out are
+			// past the deadline too; the timer is about to send the fallback
+			if ctx.Err() == context.DeadlineExceeded {
+				late = &result
+				continue
+			}
+			sc.join(work)
+			return result.response, false, result.err
+
+		case <-override:
+			override = nil
+			if err := send(&extprocv3.ProcessingResponse{
+				OverrideMessageTimeout: durationpb.New(d.cfg.OverrideTimeout),
+			}); err != nil {
+				metrics.StreamErrors.Inc("send", status.Code(err).String())
+				return nil, false, err
+			}
+			if sc.extended == nil {
+				sc.extended = map[Phase]bool{}
+			}
+			sc.extended[sc.Phase] = true
+			metrics.MessageDeadlines.Inc(string(sc.Phase), "extended")
+			sc.Logger().Infow("Processors are slow, asked Gloo for more time",
+				"after", d.cfg.OverrideAfter, "override_message_timeout", d.cfg.OverrideTimeout)
+
+		case <-deadline.C:
+			sc.keep(work)
+			fallback := d.fallback(c, sc, req, int(work.running.Load()))
+			if err := send(fallback); err != nil {
+				metrics.StreamErrors.Inc("send", status.Code(err).String())
+				return nil, false, err
+			}
+			metrics.MessageDeadlines.Inc(string(sc.Phase), "fallback")
+			sc.Logger().Warnw("Processors missed the deadline, sent the fallback response",
+				"deadline", timeout, "fallback", fallbackDecision(fallback))
+			if late != nil {
+				logDropped(sc, timeout, late.err)
+			} else {
+				go func() { logDropped(work, timeout, (<-finished).err) }()
+			}
+			return fallback, true, nil
+		}
+	}
+}
+
+// messageResult is what the processors returned for a message
+type messageResult struct {
+	response *extprocv3.ProcessingResponse
+	err      error
+}
+
+func logDropped(sc *StreamContext, deadline time.Duration, err error) {
+	sc.Logger().Warnw("Processors finished after the deadline, their response was dropped",
+		"deadline", deadline, "error", err)
+}
+
+// fallback builds the response sent in place of the processors' one.
+// running is the index in the chain of the processor that hadn't finished.
+func (d *MessageDeadline) fallback(c *Chain, sc *StreamContext, req *extprocv3.ProcessingRequest, running int) *extprocv3.ProcessingResponse {
+	if d.cfg.Fallback == FallbackContinue && c.skippable(sc, sc.Phase, running) {
+		if result, ok := c.flushHeldBack(sc, req); ok {
+			return phaseResponse(sc.Phase, result)
+		}
+	}
+	denial := &Denial{
+		Status:  d.cfg.FallbackStatus,
+		Reason:  "processing_timeout",
+		Message: "the request took too long to process",
+	}
+	return &extprocv3.ProcessingResponse{
+		Response: &extprocv3.ProcessingResponse_ImmediateResponse{
+			ImmediateResponse: denial.Result(sc, d.renderer).ImmediateResponse,
+		},
+	}
+}
+
+// skippable reports whether the processors from index running on can be
+// left out of the message: they fail open, and for request headers none
+// of them decides whether the request gets in
+func (c *Chain) skippable(sc *StreamContext, phase Phase, running int) bool {
+	for _, e := range c.entries[running:] {
+		if !e.enabled || !e.matcher.Match(sc.RequestHeaders) {
+			continue
+		}
+		if !e.failOpen {
+			return false
+		}
+		if _, ok := e.processor.(accessCheck); ok && phase == PhaseRequestHeaders {
+			return false
+		}
+	}
+	return true
+}
+
+// bodyHolder is implemented by processors that hold back the end of a body
+// chunk until the next one arrives, like StreamReplaceProcessor.
+// heldBackKey names the state the bytes held back from the body the
+// message of phase belongs to are stored under.
+type bodyHolder interface {
+	heldBackKey(phase Phase) string
+}
+
+// flushHeldBack returns the continue reply for a message that falls back.
+// Body bytes held back from earlier chunks can't wait for a next chunk the
+// processors will see, so they go out in front of this one. ok is false if
+// there are such bytes but the message can't carry them (trailers).
+func (c *Chain) flushHeldBack(sc *StreamContext, req *extprocv3.ProcessingRequest) (result *Result, ok bool) {
+	var held []byte
+	var keys []string
+	// A later processor's bytes came out of the earlier ones first
+	for i := len(c.entries) - 1; i >= 0; i-- {
+		h, isHolder := c.entries[i].processor.(bodyHolder)
+		if !isHolder {
+			continue
+		}
+		key := h.heldBackKey(sc.Phase)
+		if pending, _ := sc.State(key).([]byte); len(pending) > 0 {
+			held = append(held, pending...)
+			keys = append(keys, key)
+		}
+	}
+	if len(held) == 0 {
+		return &Result{}, true
+	}
+
+	var body *extprocv3.HttpBody
+	switch r := req.Request.(type) {
+	case *extprocv3.ProcessingRequest_RequestBody:
+		body = r.RequestBody
+	case *extprocv3.ProcessingRequest_ResponseBody:
+		body = r.ResponseBody
+	default:
+		return nil, false
+	}
+	for _, key := range keys {
+		sc.SetState(key, nil)
+	}
+	return ReplaceChunk(append(held, body.GetBody()...)), true
+}
+
+func fallbackDecision(response *extprocv3.ProcessingResponse) string {
+	if response.GetImmediateResponse() != nil {
+		return FallbackDeny
+	}
+	return FallbackContinue
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// slowProcessor answers request headers once release is closed or, unless
+// it ignores its context, the context ends. done is closed when it has
+// answered.
+type slowProcessor struct {
+	BaseProcessor
+	name          string
+	release       chan struct{}
+	ignoreContext bool
+	done          chan struct{}
+}
+
+func (p *slowProcessor) Name() string { return p.name }
+
+func (p *slowProcessor) RequestHeaders(sc *StreamContext, _ *extprocv3.HttpHeaders) (*Result, error) {
+	defer close(p.done)
+	cancelled := sc.Done()
+	if p.ignoreContext {
+		cancelled = nil
+	}
+	select {
+	case <-p.release:
+	case <-cancelled:
+	}
+	sc.SetState(p.name, "done")
+	return setHeaderResult("x-"+p.name, "done"), nil
+}
+
+// fastProcessor sets a header right away. It stores state under its name,
+// and kept state under name + ":kept".
+type fastProcessor struct {
+	BaseProcessor
+	name string
+}
+
+func (p *fastProcessor) Name() string { return p.name }
+
+func (p *fastProcessor) RequestHeaders(sc *StreamContext, _ *extprocv3.HttpHeaders) (*Result, error) {
+	sc.SetState(p.name, "done")
+	sc.KeepState(p.name+":kept", "done")
+	return setHeaderResult("x-"+p.name, "done"), nil
+}
+
+// slowBodyProcessor holds up one request body chunk, and the request
+// trailers, until its context ends
+type slowBodyProcessor struct {
+	BaseProcessor
+	chunk int
+}
+
+func (p *slowBodyProcessor) Name() string { return "slow-body" }
+
+func (p *slowBodyProcessor) RequestBody(sc *StreamContext, _ *extprocv3.HttpBody) (*Result, error) {
+	if sc.RequestBody.Index == p.chunk {
+		<-sc.Done()
+	}
+	return nil, nil
+}
+
+func (p *slowBodyProcessor) RequestTrailers(sc *StreamContext, _ *extprocv3.HttpTrailers) (*Result, error) {
+	<-sc.Done()
+	return nil, nil
+}
+
+// slowGate is a slow processor that decides whether requests get in
+type slowGate struct{ slowProcessor }
+
+func (p *slowGate) checksAccess() {}
+
+func newSlowProcessor(name string) *slowProcessor {
+	return &slowProcessor{name: name, release: make(chan struct{}), done: make(chan struct{})}
+}
+
+// handleWithDeadline runs one request headers message through the chain
+// and returns what was answered
+func handleWithDeadline(t *testing.T, c *Chain, sc *StreamContext) (*extprocv3.ProcessingResponse, bool) {
+	t.Helper()
+	sc.Phase = PhaseRequestHeaders
+	var sends []*extprocv3.ProcessingResponse
+	response, sent, err := c.Handle(sc, requestHeadersMessage(), func(r *extprocv3.ProcessingResponse) error {
+		sends = append(sends, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent && (len(sends) != 1 || sends[0] != response) {
+		t.Fatalf("fallback reported as sent, but %d responses went out", len(sends))
+	}
+	return response, sent
+}
+
+func TestDeadlineFallback(t *testing.T) {
+	fast := func(name string) Processor { return &fastProcessor{name: name} }
+	tests := []struct {
+		name       string
+		fallback   string
+		processors []Processor
+		failOpen   []string
+		wantDeny   bool
+	}{
+		{
+			name:       "deny by default",
+			processors: []Processor{newSlowProcessor("slow")},
+			failOpen:   []string{"slow"},
+			wantDeny:   true,
+		},
+		{
+			name:       "continue past a processor that fails open",
+			fallback:   FallbackContinue,
+			processors: []Processor{newSlowProcessor("slow")},
+			failOpen:   []string{"slow"},
+		},
+		{
+			name:       "continue denies for a processor that fails closed",
+			fallback:   FallbackContinue,
+			processors: []Processor{newSlowProcessor("slow")},
+			wantDeny:   true,
+		},
+		{
+			name:       "continue denies for a processor not reached yet that fails closed",
+			fallback:   FallbackContinue,
+			processors: []Processor{newSlowProcessor("slow"), fast("later")},
+			failOpen:   []string{"slow"},
+			wantDeny:   true,
+		},
+		{
+			name:       "continue ignores finished processors that fail closed",
+			fallback:   FallbackContinue,
+			processors: []Processor{fast("earlier"), newSlowProcessor("slow")},
+			failOpen:   []string{"slow"},
+		},
+		{
+			name:       "continue never skips an access check on request headers",
+			fallback:   FallbackContinue,
+			processors: []Processor{&slowGate{*newSlowProcessor("gate")}},
+			failOpen:   []string{"gate"},
+			wantDeny:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewChain(tt.processors...)
+			policy := &FailurePolicyConfig{Processors: map[string]string{}}
+			for _, name := range tt.failOpen {
+				policy.Processors[name] = FailOpen
+			}
+			if err := c.SetFailurePolicy(policy, nil); err != nil {
+				t.Fatal(err)
+			}
+			d, err := NewMessageDeadline(&MessageTimeoutConfig{Deadline: 20 * time.Millisecond, Fallback: tt.fallback}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.SetMessageDeadline(d)
+
+			response, sent := handleWithDeadline(t, c, NewStreamContext(context.Background()))
+			if !sent {
+				t.Fatal("no fallback was sent")
+			}
+			immediate := response.GetImmediateResponse()
+			if tt.wantDeny != (immediate != nil) {
+				t.Fatalf("fallback %v, want deny %v", describeResponse(response), tt.wantDeny)
+			}
+			if immediate != nil && immediate.GetStatus().GetCode() != 504 {
+				t.Errorf("fallback status %d, want 504", immediate.GetStatus().GetCode())
+			}
+			if !tt.wantDeny && len(response.GetRequestHeaders().GetResponse().GetHeaderMutation().GetSetHeaders()) > 0 {
+				t.Error("continue fallback carries header changes")
+			}
+		})
+	}
+}
+
+func TestMessageTimeoutConfigValidate(t *testing.T) {
+	valid := []MessageTimeoutConfig{
+		{Deadline: time.Second},
+		{Deadline: time.Second, Fallback: FallbackDeny, FallbackStatus: 503},
+		// continue can still deny, so it takes a status too
+		{Deadline: time.Second, Fallback: FallbackContinue, FallbackStatus: 503},
+	}
+	for _, cfg := range valid {
+		if err := cfg.validate(); err != nil {
+			t.Errorf("%+v: %v", cfg, err)
+		}
+	}
+	invalid := []MessageTimeoutConfig{
+		{},
+		{Deadline: time.Second, Fallback: "retry"},
+		{Deadline: time.Second, FallbackStatus: 200},
+	}
+	for _, cfg := range invalid {
+		if err := cfg.validate(); err == nil {
+			t.Errorf("%+v: no error", cfg)
+		}
+	}
+}
+
+func TestDeadlineDoesNotWaitForProcessors(t *testing.T) {
+	slow := newSlowProcessor("slow")
+	slow.ignoreContext = true
+	c := NewChain(&fastProcessor{name: "fast"}, slow)
+	d, err := NewMessageDeadline(&MessageTimeoutConfig{Deadline: 20 * time.Millisecond}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetMessageDeadline(d)
+	sc := NewStreamContext(context.Background())
+	sc.Audit = &AuditEntry{fired: map[string]bool{}}
+
+	returned := make(chan struct{})
+	go func() {
+		defer close(returned)
+		if response, sent := handleWithDeadline(t, c, sc); !sent || response.GetImmediateResponse() == nil {
+			t.Error("no deny fallback was sent")
+		}
+	}()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handle waited for a processor that ignores its context")
+	}
+	if sc.RequestHeaders == nil {
+		t.Error("the request headers of a message that fell back were not kept")
+	}
+
+	// Of what finished in time only kept state and the audited rules stay;
+	// what the processors do after the deadline doesn't reach the stream
+	close(slow.release)
+	<-slow.done
+	if sc.State("fast") != nil || sc.State("slow") != nil {
+		t.Error("state of a message that fell back was kept")
+	}
+	if sc.State("fast:kept") != "done" {
+		t.Error("state stored with KeepState before the deadline was dropped")
+	}
+	if got := sc.Audit.record.Rules; len(got) != 1 || got[0] != "fast" {
+		t.Errorf("audited rules %v, want [fast]", got)
+	}
+}
+
+func TestDeadlineKeepsProcessorsInTime(t *testing.T) {
+	slow := newSlowProcessor("slow")
+	close(slow.release)
+	c := NewChain(&fastProcessor{name: "fast"}, slow)
+	d, err := NewMessageDeadline(&MessageTimeoutConfig{Deadline: 5 * time.Second}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetMessageDeadline(d)
+	sc := NewStreamContext(context.Background())
+	sc.Audit = &AuditEntry{fired: map[string]bool{}}
+
+	response, sent := handleWithDeadline(t, c, sc)
+	if sent {
+		t.Fatal("fallback sent for processors that finished in time")
+	}
+	if got := len(response.GetRequestHeaders().GetResponse().GetHeaderMutation().GetSetHeaders()); got != 2 {
+		t.Errorf("response sets %d headers, want 2", got)
+	}
+	if sc.State("slow") != "done" {
+		t.Error("state stored in time was dropped")
+	}
+	if got := sc.Audit.record.Rules; len(got) != 2 || got[0] != "fast" || got[1] != "slow" {
+		t.Errorf("audited rules %v, want [fast slow]", got)
+	}
+}
+
+func TestDeadlineFallbackFlushesHeldBackBody(t *testing.T) {
+	replace, err := NewStreamReplaceProcessor("stream", StreamBodyConfig{
+		Request: []ReplaceRule{{Find: "secret", Replace: "[x]"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newChain := func(processors ...Processor) *Chain {
+		c := NewChain(processors...)
+		policy := &FailurePolicyConfig{Default: FailOpen}
+		if err := c.SetFailurePolicy(policy, nil); err != nil {
+			t.Fatal(err)
+		}
+		d, err := NewMessageDeadline(&MessageTimeoutConfig{Deadline: 20 * time.Millisecond, Fallback: FallbackContinue}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetMessageDeadline(d)
+		return c
+	}
+	newStream := func() *StreamContext {
+		sc := NewStreamContext(context.Background())
+		sc.RequestHeaders = testHeaders("content-type", "text/plain")
+		return sc
+	}
+	handle := func(c *Chain, sc *StreamContext, req *extprocv3.ProcessingRequest) (*extprocv3.ProcessingResponse, bool) {
+		t.Helper()
+		response, sent, err := c.Handle(sc, req, func(*extprocv3.ProcessingResponse) error { return nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response, sent
+	}
+
+	c := newChain(replace, &slowBodyProcessor{chunk: 1})
+	sc := newStream()
+	sc.Phase = PhaseRequestBody
+	chunks := []struct {
+		data, want string
+		fallback   bool
+	}{
+		{"a sec", "a ", false},
+		// What was held back goes out in front of the chunk that falls
+		// back, which passes unchanged
+		{"ret a sec", "secret a sec", true},
+		// What was held back on the fork went out with the chunk above
+		{"ret", "ret", false},
+	}
+	for i, chunk := range chunks {
+		body := &extprocv3.HttpBody{Body: []byte(chunk.data), EndOfStream: i == len(chunks)-1}
+		response, sent := handle(c, sc, &extprocv3.ProcessingRequest{
+			Request: &extprocv3.ProcessingRequest_RequestBody{RequestBody: body},
+		})
+		if sent != chunk.fallback {
+			t.Fatalf("chunk %d: fallback sent = %v, want %v", i, sent, chunk.fallback)
+		}
+		got := chunk.data
+		if mutation := response.GetRequestBody().GetResponse().GetBodyMutation(); mutation != nil {
+			got = string(mutation.GetBody())
+		}
+		if got != chunk.want {
+			t.Errorf("chunk %d = %q, want %q", i, got, chunk.want)
+		}
+	}
+
+	// Trailers can't carry held-back bytes, so continue denies
+	c = newChain(&slowBodyProcessor{chunk: -1}, replace)
+	sc = newStream()
+	sc.Phase = PhaseRequestBody
+	handle(c, sc, &extprocv3.ProcessingRequest{
+		Request: &extprocv3.ProcessingRequest_RequestBody{RequestBody: &extprocv3.HttpBody{Body: []byte("a sec")}},
+	})
+	sc.Phase = PhaseRequestTrailers
+	response, sent := handle(c, sc, &extprocv3.ProcessingRequest{
+		Request: &extprocv3.ProcessingRequest_RequestTrailers{RequestTrailers: &extprocv3.HttpTrailers{}},
+	})
+	if !sent || response.GetImmediateResponse() == nil {
+		t.Errorf("trailers answered with %v, want a deny fallback", describeResponse(response))
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/grpc/codes"
+)
+
+// DenyConfig controls how rejected requests are answered.
+// Templates get the request (.Method, .Path, .Host, .Header "name") plus
+// .Status, .StatusText, .Reason, .Message and .RequestID.
+//
+//	deny:
+//	  json: '{"error": {{ json .Message }}, "request_id": {{ json .RequestID }}}'
+//	  html: '<h1>{{ .Status }} {{ .StatusText }}</h1><p>{{ .Message }}</p>'
+type DenyConfig struct {
+	// JSON is the template for JSON bodies (the default)
+	JSON string `yaml:"json" json:"json"`
+	// HTML is the template for clients that accept text/html; if empty,
+	// they get JSON too
+	HTML string `yaml:"html" json:"html"`
+}
+
+// defaultDenyJSON is used when no JSON template is configured
+const defaultDenyJSON = `{"error":{"status":{{ .Status }},"reason":{{ json .Reason }},"message":{{ json .Message }},"request_id":{{ json .RequestID }}}}`
+
+// Denial describes a request that should be rejected. Any processor can
+// build one and return its Result to stop the chain and answer the client
+// directly, without the request ever reaching the backend.
+type Denial struct {
+	// Status is the HTTP status code, e.g. http.StatusUnauthorized
+	Status int
+	// Reason is a short machine-readable code such as "jwt_expired". It is
+	// passed to Envoy as the response code details, so it shows up in
+	// access logs as %RESPONSE_CODE_DETAILS%.
+	Reason string
+	// Message is the human-readable explanation shown in the body
+	Message string
+	// Headers are added to the response (e.g. www-authenticate, retry-after)
+	Headers map[string]string
+	// GrpcStatus overrides the gRPC status sent to gRPC callers. If nil,
+	// it is derived from Status.
+	GrpcStatus *codes.Code
+}
+
+// DenyRenderer renders Denials into ImmediateResponses using the
+// configured templates
+type DenyRenderer struct {
+	json *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// templateFuncs are available in deny templates
+var templateFuncs = map[string]interface{}{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// NewDenyRenderer compiles the deny templates. A nil config uses the defaults.
+func NewDenyRenderer(cfg *DenyConfig) (*DenyRenderer, error) {
+	if cfg == nil {
+		cfg = &DenyConfig{}
+	}
+	jsonSource := cfg.JSON
+	if jsonSource == "" {
+		jsonSource = defaultDenyJSON
+	}
+
+	r := &DenyRenderer{}
+	var err error
+	r.json, err = texttemplate.New("json").Funcs(templateFuncs).Parse(jsonSource)
+	if err != nil {
+		return nil, fmt.Errorf("json template: %w", err)
+	}
+	if cfg.HTML != "" {
+		r.html, err = htmltemplate.New("html").Funcs(templateFuncs).Parse(cfg.HTML)
+		if err != nil {
+			return nil, fmt.Errorf("html template: %w", err)
+		}
+	}
+	return r, nil
+}
+
+// denyTemplateData is what deny templates can refer to
+type denyTemplateData struct {
+	*TemplateData
+
+	Status     int
+	StatusText string
+	Reason     string
+	Message    string
+	RequestID  string
+}
+
+// Result turns the denial into a processor Result that carries an
+// ImmediateResponse and counts the rejection. A nil renderer uses the
+// default templates.
+func (d *Denial) Result(sc *StreamContext, r *DenyRenderer) *Result {
+	if r == nil {
+		r = defaultDenyRenderer
+	}
+	metrics.Rejections.Inc(d.reason(), strconv.Itoa(d.Status))
+	return &Result{ImmediateResponse: r.Render(sc, d)}
+}
+
+// Render builds the ImmediateResponse for a denial
+func (r *DenyRenderer) Render(sc *StreamContext, d *Denial) *extprocv3.ImmediateResponse {
+	data := &denyTemplateData{
+		TemplateData: NewTemplateData(sc.RequestHeaders),
+		Status:       d.Status,
+		StatusText:   http.StatusText(d.Status),
+		Reason:       d.Reason,
+		Message:      d.Message,
+	}
+	data.RequestID = sc.RequestID
+	if data.RequestID == "" {
+		data.RequestID = data.Header("x-request-id")
+	}
+	if data.Message == "" {
+		data.Message = data.StatusText
+	}
+
+	// Sorted so the same denial always produces the same response
+	headers := &extprocv3.HeaderMutation{}
+	names := make([]string, 0, len(d.Headers))
+	for k := range d.Headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		headers.SetHeaders = append(headers.SetHeaders, setHeader(strings.ToLower(k), d.Headers[k]))
+	}
+
+	response := &extprocv3.ImmediateResponse{
+		Status:  &typev3.HttpStatus{Code: typev3.StatusCode(d.Status)},
+		Headers: headers,
+		Details: d.details(),
+	}
+
+	if isGrpcRequest(sc.RequestHeaders) {
+		// gRPC clients read the status and message from the grpc-status /
+		// grpc-message trailers, so the body is just the plain message
+		code := grpcCodeForHTTP(d.Status)
+		if d.GrpcStatus != nil {
+			code = *d.GrpcStatus
+		}
+		response.GrpcStatus = &extprocv3.GrpcStatus{Status: uint32(code)}
+		response.Body = data.Message
+		return response
+	}
+
+	body, contentType, err := r.render(data, sc.RequestHeaders)
+	if err != nil {
+		sc.Logger().Errorw("Error rendering deny template, sending plain message", "error", err)
+		body, contentType = data.Message, "text/plain; charset=utf-8"
+	}
+	response.Body = body
+	headers.SetHeaders = append(headers.SetHeaders, setHeader("content-type", contentType))
+	return response
+}
+
+// render picks the HTML template for browsers that ask for it, JSON otherwise
+func (r *DenyRenderer) render(data *denyTemplateData, headers *extprocv3.HttpHeaders) (body, contentType string, err error) {
+	var buf bytes.Buffer
+	accept, _ := getHeader(headers, "accept")
+	if r.html != nil && strings.Contains(accept, "text/html") {
+		if err := r.html.Execute(&buf, data); err != nil {
+			return "", "", err
+		}
+		return buf.String(), "text/html; charset=utf-8", nil
+	}
+	if err := r.json.Execute(&buf, data); err != nil {
+		return "", "", err
+	}
+	return buf.String(), "application/json", nil
+}
+
+// details is the %RESPONSE_CODE_DETAILS% value; Envoy does not allow spaces in it
+func (d *Denial) details() string {
+	return "ext_proc_" + strings.ReplaceAll(d.reason(), " ", "_")
+}
+
+// reason is the Reason, or "denied" if none was given
+func (d *Denial) reason() string {
+	if d.Reason == "" {
+		return "denied"
+	}
+	return d.Reason
+}
+
+// defaultDenyRenderer is used by processors that were not given a renderer
+var defaultDenyRenderer = func() *DenyRenderer {
+	r, err := NewDenyRenderer(nil)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}()
+
+// isGrpcRequest reports whether the request is a gRPC call
+func isGrpcRequest(headers *extprocv3.HttpHeaders) bool {
+	contentType, _ := getHeader(headers, "content-type")
+	return strings.HasPrefix(contentType, "application/grpc")
+}
+
+// grpcCodeForHTTP maps an HTTP status to the closest gRPC status code,
+// following https://github.com/grpc/grpc/blob/master/doc/http-grpc-status-mapping.md
+func grpcCodeForHTTP(status int) codes.Code {
+	switch status {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.Unimplemented
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return codes.Unavailable
+	default:
+		if status >= 500 {
+			return codes.Internal
+		}
+		return codes.Unknown
+	}
+}
+
+// DenyRuleConfig rejects every request that matches the rule
+//
+//	rules:
+//	  - name: block-admin
+//	    match: { path: { prefix: /admin } }
+//	    deny:
+//	      status: 403
+//	      reason: admin_blocked
+//	      message: The admin API is not available from outside
+type DenyRuleConfig struct {
+	Status  int               `yaml:"status" json:"status"`
+	Reason  string            `yaml:"reason" json:"reason"`
+	Message string            `yaml:"message" json:"message"`
+	Headers map[string]string `yaml:"headers" json:"headers"`
+}
+
+func (c *DenyRuleConfig) validate() error {
+	if c.Status < 200 || c.Status > 599 {
+		return fmt.Errorf("status %d is not a valid HTTP status", c.Status)
+	}
+	return nil
+}
+
+// DenyProcessor rejects requests with a fixed Denial
+type DenyProcessor struct {
+	BaseProcessor
+
+	name     string
+	denial   *Denial
+	renderer *DenyRenderer
+}
+
+// NewDenyProcessor creates a processor that rejects every request it sees
+func NewDenyProcessor(name string, cfg *DenyRuleConfig, renderer *DenyRenderer) (*DenyProcessor, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &DenyProcessor{
+		name: name,
+		denial: &Denial{
+			Status:  cfg.Status,
+			Reason:  cfg.Reason,
+			Message: cfg.Message,
+			Headers: cfg.Headers,
+		},
+		renderer: renderer,
+	}, nil
+}
+
+func (p *DenyProcessor) Name() string { return p.name }
+
+func (p *DenyProcessor) checksAccess() {}
+
+// RequestHeaders rejects the request before it reaches the backend
+func (p *DenyProcessor) RequestHeaders(sc *StreamContext, headers *extprocv3.HttpHeaders) (*Result, error) {
+	sc.Logger().Infow("Denying request", "processor", p.name, "decision", "deny", "reason", p.denial.Reason, "status", p.denial.Status)
+	return p.denial.Result(sc, p.renderer), nil
+}
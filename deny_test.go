@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"google.golang.org/grpc/codes"
+)
+
+// denyFor renders d for a request with the given headers
+func denyFor(t *testing.T, r *DenyRenderer, d *Denial, headers ...string) *extprocv3.ImmediateResponse {
+	t.Helper()
+	sc := NewStreamContext(context.Background())
+	sc.RequestHeaders = testHeaders(headers...)
+	return r.Render(sc, d)
+}
+
+func TestDenyDefaultJSON(t *testing.T) {
+	r, err := NewDenyRenderer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Denial{
+		Status:  429,
+		Reason:  "rate limited",
+		Message: `slow down, "friend" </script>`,
+		Headers: map[string]string{"Retry-After": "3", "x-b": "b"},
+	}
+	response := denyFor(t, r, d, ":path", "/orders", "x-request-id", "req-1", "accept", "text/html")
+
+	var body struct {
+		Error struct {
+			Status    int    `json:"status"`
+			Reason    string `json:"reason"`
+			Message   string `json:"message"`
+			RequestID string `json:"request_id"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(response.GetBody()), &body); err != nil {
+		t.Fatalf("body %q is not JSON: %v", response.GetBody(), err)
+	}
+	if body.Error.Status != 429 || body.Error.Reason != d.Reason || body.Error.Message != d.Message || body.Error.RequestID != "req-1" {
+		t.Errorf("body %+v does not describe the denial", body.Error)
+	}
+	if response.GetStatus().GetCode() != 429 || response.GetDetails() != "ext_proc_rate_limited" {
+		t.Errorf("status %d, details %q", response.GetStatus().GetCode(), response.GetDetails())
+	}
+	// Without an HTML template browsers get JSON too; headers come sorted
+	// and in lower case, with the content type last
+	var names []string
+	for _, h := range response.GetHeaders().GetSetHeaders() {
+		names = append(names, h.GetHeader().GetKey()+"="+h.GetHeader().GetValue())
+	}
+	if got := strings.Join(names, " "); got != "retry-after=3 x-b=b content-type=application/json" {
+		t.Errorf("headers %s", got)
+	}
+
+	// Reason and message have defaults
+	response = denyFor(t, r, &Denial{Status: 403})
+	if !strings.Contains(response.GetBody(), `"message":"Forbidden"`) || response.GetDetails() != "ext_proc_denied" {
+		t.Errorf("body %s, details %q", response.GetBody(), response.GetDetails())
+	}
+}
+
+func TestDenyTemplates(t *testing.T) {
+	r, err := NewDenyRenderer(&DenyConfig{
+		JSON: `{"error": {{ json .Message }}, "path": {{ json .Path }}, "tenant": {{ json (.Header "x-tenant") }}}`,
+		HTML: `<h1>{{ .Status }} {{ .StatusText }}</h1><p>{{ .Message }}</p><p>{{ .Header "x-tenant" }}</p>`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Denial{Status: 403, Message: "no <b>access</b>"}
+	tenant := `"><script>alert(1)</script>`
+
+	// Values from the request are escaped for the format they go into
+	response := denyFor(t, r, d, ":path", `/a"b`, "x-tenant", tenant, "accept", "text/html,application/xhtml+xml")
+	html := response.GetBody()
+	if strings.Contains(html, "<script>") || strings.Contains(html, "<b>") {
+		t.Errorf("HTML body %q is not escaped", html)
+	}
+	if !strings.Contains(html, "<h1>403 Forbidden</h1>") || !strings.Contains(html, "&lt;b&gt;access&lt;/b&gt;") {
+		t.Errorf("HTML body %q", html)
+	}
+	if set, _ := headerChanges(response.GetHeaders()); set["content-type"] != "text/html; charset=utf-8" {
+		t.Errorf("HTML sent as %q", set["content-type"])
+	}
+
+	response = denyFor(t, r, d, ":path", `/a"b`, "x-tenant", tenant, "accept", "application/json")
+	var body map[string]string
+	if err := json.Unmarshal([]byte(response.GetBody()), &body); err != nil {
+		t.Fatalf("body %q is not JSON: %v", response.GetBody(), err)
+	}
+	if body["error"] != d.Message || body["path"] != `/a"b` || body["tenant"] != tenant {
+		t.Errorf("JSON body %v", body)
+	}
+
+	// gRPC callers get the status in grpc-status and the message as is
+	response = denyFor(t, r, d, "content-type", "application/grpc")
+	if codes.Code(response.GetGrpcStatus().GetStatus()) != codes.PermissionDenied || response.GetBody() != d.Message {
+		t.Errorf("gRPC denial %v %q", response.GetGrpcStatus(), response.GetBody())
+	}
+	code := codes.FailedPrecondition
+	response = denyFor(t, r, &Denial{Status: 400, GrpcStatus: &code}, "content-type", "application/grpc+proto")
+	if codes.Code(response.GetGrpcStatus().GetStatus()) != code {
+		t.Errorf("gRPC status %v, want the override", response.GetGrpcStatus())
+	}
+
+	// A template that fails at render time falls back to the plain message
+	broken, err := NewDenyRenderer(&DenyConfig{JSON: `{{ .Header }}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response = denyFor(t, broken, d)
+	if set, _ := headerChanges(response.GetHeaders()); response.GetBody() != d.Message || set["content-type"] != "text/plain; charset=utf-8" {
+		t.Errorf("broken template answered %q as %q", response.GetBody(), set["content-type"])
+	}
+
+	for _, cfg := range []DenyConfig{{JSON: "{{ .Message"}, {HTML: "{{ nope }}"}} {
+		if _, err := NewDenyRenderer(&cfg); err == nil {
+			t.Errorf("%+v: no error", cfg)
+		}
+	}
+}
+
+func TestDenyProcessor(t *testing.T) {
+	if _, err := NewDenyProcessor("bad", &DenyRuleConfig{Status: 99}, nil); err == nil {
+		t.Error("status 99 accepted")
+	}
+	p, err := NewDenyProcessor("block-admin", &DenyRuleConfig{
+		Status:  403,
+		Reason:  "admin_blocked",
+		Message: "not from outside",
+		Headers: map[string]string{"x-blocked-by": "gateway"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := NewStreamContext(context.Background())
+	sc.RequestHeaders = testHeaders(":path", "/admin")
+	result, err := p.RequestHeaders(sc, sc.RequestHeaders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	immediate := result.ImmediateResponse
+	set, _ := headerChanges(immediate.GetHeaders())
+	if immediate.GetStatus().GetCode() != 403 || immediate.GetDetails() != "ext_proc_admin_blocked" || set["x-blocked-by"] != "gateway" {
+		t.Errorf("denied with %d %q, headers %v", immediate.GetStatus().GetCode(), immediate.GetDetails(), set)
+	}
+}
@@ -5,7 +5,10 @@ go 1.24
 require (
 	github.com/envoyproxy/go-control-plane v0.11.1
 	github.com/solo-io/go-utils v0.24.4
+	go.uber.org/zap v1.10.0
 	google.golang.org/grpc v1.59.0
+	google.golang.org/protobuf v1.31.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -15,10 +18,8 @@ require (
 	github.com/rotisserie/eris v0.1.1 // indirect
 	go.uber.org/atomic v1.4.0 // indirect
 	go.uber.org/multierr v1.1.0 // indirect
-	go.uber.org/zap v1.10.0 // indirect
 	golang.org/x/net v0.17.0 // indirect
 	golang.org/x/sys v0.13.0 // indirect
 	golang.org/x/text v0.13.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20231106174013-bbf56f31fb17 // indirect
-	google.golang.org/protobuf v1.31.0 // indirect
 )
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// GRPCTuning are the gRPC server limits. Envoy keeps a few HTTP/2
+// connections open for a long time and runs one Process stream per HTTP
+// request on them, so these decide how many requests can be in flight, how
+// big a buffered body can be and when idle or old connections are closed.
+type GRPCTuning struct {
+	// MaxConcurrentStreams caps the streams (requests in flight) per
+	// connection; 0 is unlimited
+	MaxConcurrentStreams uint
+	// MaxRecvMsgSize and MaxSendMsgSize limit one ext_proc message. A
+	// buffered body arrives as a single message, so MaxRecvMsgSize must be
+	// above the largest body Envoy buffers.
+	MaxRecvMsgSize byteSize
+	MaxSendMsgSize byteSize
+	// ConnectionTimeout limits the connection setup, TLS handshake included
+	ConnectionTimeout time.Duration
+
+	// KeepaliveTime is how long a quiet connection waits before the server
+	// pings it, and KeepaliveTimeout how long it waits for the ack
+	KeepaliveTime    time.Duration
+	KeepaliveTimeout time.Duration
+	// KeepaliveMinTime is the shortest ping interval clients may use;
+	// clients that ping more often are disconnected. PermitWithoutStream
+	// allows pings on connections with no open streams.
+	KeepaliveMinTime             time.Duration
+	KeepalivePermitWithoutStream bool
+
+	// MaxConnectionIdle closes connections without streams after this
+	// long; MaxConnectionAge closes any connection after this long, giving
+	// open streams MaxConnectionAgeGrace to finish. 0 is never.
+	MaxConnectionIdle     time.Duration
+	MaxConnectionAge      time.Duration
+	MaxConnectionAgeGrace time.Duration
+}
+
+// addFlags registers the tuning flags with their defaults
+func (t *GRPCTuning) addFlags(fs *flag.FlagSet) {
+	t.MaxRecvMsgSize = 16 << 20
+	t.MaxSendMsgSize = 16 << 20
+	fs.UintVar(&t.MaxConcurrentStreams, "grpc-max-concurrent-streams", 0, "most streams (requests in flight) per Envoy connection; 0 is unlimited")
+	fs.Var(&t.MaxRecvMsgSize, "grpc-max-recv-msg-size", "largest message accepted from Envoy, as a `size` like 16MiB; must fit the largest buffered body")
+	fs.Var(&t.MaxSendMsgSize, "grpc-max-send-msg-size", "largest message sent to Envoy, as a `size` like 16MiB")
+	fs.DurationVar(&t.ConnectionTimeout, "grpc-connection-timeout", 120*time.Second, "time allowed for a new connection's setup and TLS handshake")
+	fs.DurationVar(&t.KeepaliveTime, "grpc-keepalive-time", 2*time.Hour, "ping a connection after it has been quiet this long")
+	fs.DurationVar(&t.KeepaliveTimeout, "grpc-keepalive-timeout", 20*time.Second, "close the connection if a ping isn't answered within this")
+	fs.DurationVar(&t.KeepaliveMinTime, "grpc-keepalive-min-time", 10*time.Second, "shortest ping interval allowed from Envoy; faster clients are disconnected")
+	fs.BoolVar(&t.KeepalivePermitWithoutStream, "grpc-keepalive-permit-without-stream", true, "allow Envoy to ping connections that have no open streams")
+	fs.DurationVar(&t.MaxConnectionIdle, "grpc-max-connection-idle", 0, "close connections that have had no streams for this long (0 is never)")
+	fs.DurationVar(&t.MaxConnectionAge, "grpc-max-connection-age", 0, "close connections after this long, so Envoy reconnects and rebalances (0 is never)")
+	fs.DurationVar(&t.MaxConnectionAgeGrace, "grpc-max-connection-age-grace", 0, "time open streams get to finish once -grpc-max-connection-age is reached (0 is no limit)")
+}
+
+func (t *GRPCTuning) validate() error {
+	if uint64(t.MaxConcurrentStreams) > math.MaxUint32 {
+		return fmt.Errorf("-grpc-max-concurrent-streams must be at most %d", uint32(math.MaxUint32))
+	}
+	for _, size := range []struct {
+		flag  string
+		value byteSize
+	}{
+		{"-grpc-max-recv-msg-size", t.MaxRecvMsgSize},
+		{"-grpc-max-send-msg-size", t.MaxSendMsgSize},
+	} {
+		if size.value < 1024 || size.value > math.MaxInt32 {
+			return fmt.Errorf("%s must be between 1KiB and 2GiB, got %s", size.flag, size.value)
+		}
+	}
+	durations := []struct {
+		flag  string
+		value time.Duration
+	}{
+		{"-grpc-connection-timeout", t.ConnectionTimeout},
+		{"-grpc-keepalive-time", t.KeepaliveTime},
+		{"-grpc-keepalive-timeout", t.KeepaliveTimeout},
+		{"-grpc-keepalive-min-time", t.KeepaliveMinTime},
+		{"-grpc-max-connection-idle", t.MaxConnectionIdle},
+		{"-grpc-max-connection-age", t.MaxConnectionAge},
+		{"-grpc-max-connection-age-grace", t.MaxConnectionAgeGrace},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			return fmt.Errorf("%s must not be negative", d.flag)
+		}
+	}
+	if t.ConnectionTimeout == 0 {
+		return fmt.Errorf("-grpc-connection-timeout must be positive")
+	}
+	// gRPC quietly raises a shorter keepalive time to 1s, and takes 0 as
+	// its own default for these rather than "off"
+	if t.KeepaliveTime < time.Second {
+		return fmt.Errorf("-grpc-keepalive-time must be at least 1s")
+	}
+	if t.KeepaliveTimeout == 0 {
+		return fmt.Errorf("-grpc-keepalive-timeout must be positive")
+	}
+	if t.KeepaliveMinTime == 0 {
+		return fmt.Errorf("-grpc-keepalive-min-time must be positive")
+	}
+	if t.MaxConnectionAgeGrace > 0 && t.MaxConnectionAge == 0 {
+		return fmt.Errorf("-grpc-max-connection-age-grace needs -grpc-max-connection-age")
+	}
+	return nil
+}
+
+// ServerOptions turns the tuning into grpc.NewServer options
+func (t *GRPCTuning) ServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.MaxConcurrentStreams(uint32(t.MaxConcurrentStreams)),
+		grpc.MaxRecvMsgSize(int(t.MaxRecvMsgSize)),
+		grpc.MaxSendMsgSize(int(t.MaxSendMsgSize)),
+		grpc.ConnectionTimeout(t.ConnectionTimeout),
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:                  t.KeepaliveTime,
+			Timeout:               t.KeepaliveTimeout,
+			MaxConnectionIdle:     t.MaxConnectionIdle,
+			MaxConnectionAge:      t.MaxConnectionAge,
+			MaxConnectionAgeGrace: t.MaxConnectionAgeGrace,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             t.KeepaliveMinTime,
+			PermitWithoutStream: t.KeepalivePermitWithoutStream,
+		}),
+	}
+}
+
+// LogFields are the effective values, for the startup log
+func (t *GRPCTuning) LogFields() []interface{} {
+	return []interface{}{
+		"max_concurrent_streams", t.MaxConcurrentStreams,
+		"max_recv_msg_size", t.MaxRecvMsgSize.String(),
+		"max_send_msg_size", t.MaxSendMsgSize.String(),
+		"connection_timeout", t.ConnectionTimeout,
+		"keepalive_time", t.KeepaliveTime,
+		"keepalive_timeout", t.KeepaliveTimeout,
+		"keepalive_min_time", t.KeepaliveMinTime,
+		"keepalive_permit_without_stream", t.KeepalivePermitWithoutStream,
+		"max_connection_idle", t.MaxConnectionIdle,
+		"max_connection_age", t.MaxConnectionAge,
+		"max_connection_age_grace", t.MaxConnectionAgeGrace,
+	}
+}
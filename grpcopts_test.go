@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestByteSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want byteSize
+		str  string
+	}{
+		{"1024", 1024, "1KiB"},
+		{"1000", 1000, "1000"},
+		{"16MiB", 16 << 20, "16MiB"},
+		{"16 MiB", 16 << 20, "16MiB"},
+		{"4MB", 4e6, "4000000"},
+		{"1GiB", 1 << 30, "1GiB"},
+		{"1536KiB", 1536 << 10, "1536KiB"},
+		{"512B", 512, "512"},
+	}
+	for _, tt := range tests {
+		var b byteSize
+		if err := b.Set(tt.in); err != nil || b != tt.want || b.String() != tt.str {
+			t.Errorf("Set(%q) = %d %q, %v; want %d %q", tt.in, b, b.String(), err, tt.want, tt.str)
+		}
+	}
+	for _, in := range []string{"", "MiB", "-1", "1.5MiB", "16mib", "9223372036854775807GiB"} {
+		var b byteSize
+		if err := b.Set(in); err == nil {
+			t.Errorf("Set(%q) = %d, want an error", in, b)
+		}
+	}
+}
+
+func TestGRPCTuning(t *testing.T) {
+	o, err := ParseOptions(nil, envFrom(nil), io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.GRPC.MaxRecvMsgSize != 16<<20 || o.GRPC.KeepaliveTime != 2*time.Hour || !o.GRPC.KeepalivePermitWithoutStream {
+		t.Errorf("defaults %+v", o.GRPC)
+	}
+
+	o, err = ParseOptions([]string{"-grpc-max-recv-msg-size", "64MiB", "-grpc-max-connection-age", "30m"},
+		envFrom(map[string]string{"EXTPROC_GRPC_MAX_CONNECTION_AGE_GRACE": "1m", "EXTPROC_GRPC_MAX_CONNECTION_AGE": "1h"}), io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.GRPC.MaxRecvMsgSize != 64<<20 || o.GRPC.MaxConnectionAge != 30*time.Minute || o.GRPC.MaxConnectionAgeGrace != time.Minute {
+		t.Errorf("tuning %+v", o.GRPC)
+	}
+	if n := len(o.GRPC.ServerOptions()); n != 6 {
+		t.Errorf("%d server options, want 6", n)
+	}
+}
+
+func TestGRPCTuningValidate(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-grpc-max-concurrent-streams", "4294967296"}, "-grpc-max-concurrent-streams must be at most 4294967295"},
+		{[]string{"-grpc-max-recv-msg-size", "1000"}, "-grpc-max-recv-msg-size must be between 1KiB and 2GiB"},
+		{[]string{"-grpc-max-send-msg-size", "2GiB"}, "-grpc-max-send-msg-size must be between 1KiB and 2GiB"},
+		{[]string{"-grpc-max-recv-msg-size", "lots"}, "invalid size"},
+		{[]string{"-grpc-connection-timeout", "0"}, "-grpc-connection-timeout must be positive"},
+		{[]string{"-grpc-keepalive-time", "500ms"}, "-grpc-keepalive-time must be at least 1s"},
+		{[]string{"-grpc-keepalive-timeout", "0"}, "-grpc-keepalive-timeout must be positive"},
+		{[]string{"-grpc-keepalive-min-time", "0"}, "-grpc-keepalive-min-time must be positive"},
+		{[]string{"-grpc-max-connection-idle", "-1s"}, "-grpc-max-connection-idle must not be negative"},
+		{[]string{"-grpc-max-connection-age-grace", "10s"}, "-grpc-max-connection-age-grace needs -grpc-max-connection-age"},
+	}
+	for _, tt := range tests {
+		_, err := ParseOptions(tt.args, envFrom(nil), io.Discard)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: error %v, want %q", tt.args, err, tt.want)
+		}
+	}
+
+	// The edges of the allowed ranges
+	for _, args := range [][]string{
+		{"-grpc-max-concurrent-streams", "4294967295"},
+		{"-grpc-max-recv-msg-size", "1KiB", "-grpc-max-send-msg-size", "2147483647"},
+		{"-grpc-keepalive-time", "1s"},
+	} {
+		if _, err := ParseOptions(args, envFrom(nil), io.Discard); err != nil {
+			t.Errorf("%v: %v", args, err)
+		}
+	}
+}
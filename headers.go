@@ -0,0 +1,77 @@
+package main
+
+import (
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// HeaderMutationProcessor applies the header rules from the config file.
+// The mutations are built once when the processor is created, so each
+// request only has to hand the prepared mutation back to Envoy.
+type HeaderMutationProcessor struct {
+	BaseProcessor
+
+	name     string
+	request  *extprocv3.HeaderMutation
+	response *extprocv3.HeaderMutation
+}
+
+// NewHeaderMutationProcessor builds the processor for a set of configured header rules
+func NewHeaderMutationProcessor(name string, cfg HeadersConfig) (*HeaderMutationProcessor, error) {
+	request, err := buildHeaderMutation(cfg.Request)
+	if err != nil {
+		return nil, err
+	}
+	response, err := buildHeaderMutation(cfg.Response)
+	if err != nil {
+		return nil, err
+	}
+	return &HeaderMutationProcessor{name: name, request: request, response: response}, nil
+}
+
+func (p *HeaderMutationProcessor) Name() string { return p.name }
+
+// RequestHeaders applies the configured request header rules
+func (p *HeaderMutationProcessor) RequestHeaders(sc *StreamContext, headers *extprocv3.HttpHeaders) (*Result, error) {
+	if p.request == nil {
+		return nil, nil
+	}
+	sc.Logger().Debugw("Applying request header rules", "processor", p.name, "rules", len(p.request.SetHeaders)+len(p.request.RemoveHeaders))
+	return &Result{HeaderMutation: p.request}, nil
+}
+
+// ResponseHeaders applies the configured response header rules
+func (p *HeaderMutationProcessor) ResponseHeaders(sc *StreamContext, headers *extprocv3.HttpHeaders) (*Result, error) {
+	if p.response == nil {
+		return nil, nil
+	}
+	sc.Logger().Debugw("Applying response header rules", "processor", p.name, "rules", len(p.response.SetHeaders)+len(p.response.RemoveHeaders))
+	return &Result{HeaderMutation: p.response}, nil
+}
+
+// buildHeaderMutation turns a list of header rules into one HeaderMutation.
+// It returns nil if there are no rules.
+func buildHeaderMutation(rules []HeaderRule) (*extprocv3.HeaderMutation, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	mutation := &extprocv3.HeaderMutation{}
+	for _, rule := range rules {
+		action, remove, err := rule.appendAction()
+		if err != nil {
+			return nil, err
+		}
+		if remove {
+			mutation.RemoveHeaders = append(mutation.RemoveHeaders, rule.Name)
+			continue
+		}
+		mutation.SetHeaders = append(mutation.SetHeaders, &corev3.HeaderValueOption{
+			Header: &corev3.HeaderValue{
+				Key:   rule.Name,
+				Value: rule.Value,
+			},
+			AppendAction: action,
+		})
+	}
+	return mutation, nil
+}
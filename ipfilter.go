@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// ClientIPConfig says how the real client address is worked out.
+//
+//	clientIP:
+//	  trustedHops: 1
+//	  header: x-client-ip
+type ClientIPConfig struct {
+	// TrustedHops is the number of proxies in front of Envoy (load
+	// balancers, CDNs) that add themselves to x-forwarded-for. The client
+	// is the entry just before them, counting from the right; entries
+	// further left were sent by the client and can't be trusted.
+	// With 0 the client is the rightmost entry, the address Envoy saw.
+	TrustedHops int `yaml:"trustedHops" json:"trustedHops"`
+
+	// Header is the request header the resolved address is forwarded in
+	// (default x-client-ip). Whatever the client sent in it is replaced.
+	Header string `yaml:"header" json:"header"`
+}
+
+func (c *ClientIPConfig) validate() error {
+	if c.TrustedHops < 0 {
+		return fmt.Errorf("trustedHops must not be negative")
+	}
+	return nil
+}
+
+// ClientIPProcessor resolves the client address once per request so IP
+// filters and rate limits all use the same trusted value
+type ClientIPProcessor struct {
+	BaseProcessor
+
+	trustedHops int
+	header      string
+}
+
+// NewClientIPProcessor creates the client address resolver
+func NewClientIPProcessor(cfg *ClientIPConfig) (*ClientIPProcessor, error) {
+	if cfg == nil {
+		cfg = &ClientIPConfig{}
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	p := &ClientIPProcessor{trustedHops: cfg.TrustedHops, header: strings.ToLower(cfg.Header)}
+	if p.header == "" {
+		p.header = "x-client-ip"
+	}
+	return p, nil
+}
+
+func (p *ClientIPProcessor) Name() string { return "client-ip" }
+
+// clientAddrKey is where the resolved address is kept in the stream state
+const clientAddrKey = "client-ip:addr"
+
+// RequestHeaders resolves the client address and forwards it
+func (p *ClientIPProcessor) RequestHeaders(sc *StreamContext, headers *extprocv3.HttpHeaders) (*Result, error) {
+	addr, ok := p.resolve(headers)
+	mutation := &extprocv3.HeaderMutation{}
+	if !ok {
+		sc.Logger().Infow("Could not determine the client address", "processor", p.Name())
+		mutation.RemoveHeaders = append(mutation.RemoveHeaders, p.header)
+		return &Result{HeaderMutation: mutation}, nil
+	}
+	sc.SetState(clientAddrKey, addr)
+	mutation.SetHeaders = append(mutation.SetHeaders, setHeader(p.header, addr.String()))
+	return &Result{HeaderMutation: mutation}, nil
+}
+
+// resolve picks the client entry out of x-forwarded-for, falling back to
+// x-envoy-external-address
+func (p *ClientIPProcessor) resolve(headers *extprocv3.HttpHeaders) (netip.Addr, bool) {
+	if xff, ok := getHeader(headers, "x-forwarded-for"); ok {
+		var hops []string
+		for _, hop := range strings.Split(xff, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+		if len(hops) > 0 {
+			// With fewer entries than trusted hops, the request came in
+			// through fewer proxies; the leftmost entry is the client
+			i := len(hops) - 1 - p.trustedHops
+			if i < 0 {
+				i = 0
+			}
+			return parseClientAddr(hops[i])
+		}
+	}
+	if external, ok := getHeader(headers, "x-envoy-external-address"); ok {
+		return parseClientAddr(external)
+	}
+	return netip.Addr{}, false
+}
+
+// parseClientAddr parses an address that may carry a port ("1.2.3.4:80",
+// "[2001:db8::1]:443") and normalizes it (IPv4-mapped IPv6 becomes IPv4,
+// IPv6 is lower-case and compressed)
+func parseClientAddr(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	// Zones (fe80::1%eth0) mean nothing past the proxy
+	return addr.WithZone("").Unmap(), true
+}
+
+// ClientAddr returns the client address resolved for this stream. It is
+// only set when the client-ip processor ran.
+func ClientAddr(sc *StreamContext) (netip.Addr, bool) {
+	addr, ok := sc.State(clientAddrKey).(netip.Addr)
+	return addr, ok
+}
+
+// clientIP returns the client address for rate limit keys. Without the
+// client-ip processor it is resolved as with trustedHops 0: the rightmost
+// x-forwarded-for entry, which Envoy added, not one the client can pick.
+func clientIP(sc *StreamContext) string {
+	addr, ok := ClientAddr(sc)
+	if !ok {
+		addr, ok = (&ClientIPProcessor{}).resolve(sc.RequestHeaders)
+	}
+	if !ok {
+		return ""
+	}
+	return addr.String()
+}
+
+// IPFilterConfig allows or denies clients by address.
+// Deny is checked first. If Allow is not empty, only clients in it get through.
+//
+//	ipFilter:
+//	  allow: [10.0.0.0/8, "2001:db8::/32"]
+//	  deny: [10.1.2.3]
+type IPFilterConfig struct {
+	Allow []string `yaml:"allow" json:"allow"`
+	Deny  []string `yaml:"deny" json:"deny"`
+}
+
+func (c *IPFilterConfig) validate() error {
+	if len(c.Allow) == 0 && len(c.Deny) == 0 {
+		return fmt.Errorf("allow or deny must list at least one address")
+	}
+	if _, err := parseCIDRList(c.Allow); err != nil {
+		return fmt.Errorf("allow%w", err)
+	}
+	if _, err := parseCIDRList(c.Deny); err != nil {
+		return fmt.Errorf("deny%w", err)
+	}
+	return nil
+}
+
+// IPFilterProcessor rejects clients by address with a 403.
+// It needs the client-ip processor to run first.
+type IPFilterProcessor struct {
+	BaseProcessor
+
+	name     string
+	allow    *cidrTrie
+	deny     *cidrTrie
+	renderer *DenyRenderer
+}
+
+// NewIPFilterProcessor compiles the address lists
+func NewIPFilterProcessor(name string, cfg *IPFilterConfig, renderer *DenyRenderer) (*IPFilterProcessor, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	allow, _ := parseCIDRList(cfg.Allow)
+	deny, _ := parseCIDRList(cfg.Deny)
+	return &IPFilterProcessor{name: name, allow: allow, deny: deny, renderer: renderer}, nil
+}
+
+func (p *IPFilterProcessor) Name() string { return p.name }
+
+func (p *IPFilterProcessor) checksAccess() {}
+
+// RequestHeaders checks the client address against the lists
+func (p *IPFilterProcessor) RequestHeaders(sc *StreamContext, _ *extprocv3.HttpHeaders) (*Result, error) {
+	addr, ok := ClientAddr(sc)
+	switch {
+	case !ok && p.allow.Len() > 0:
+		return p.reject(sc, "unknown address"), nil
+	case !ok:
+		return nil, nil
+	case p.deny.Contains(addr):
+		return p.reject(sc, addr.String()), nil
+	case p.allow.Len() > 0 && !p.allow.Contains(addr):
+		return p.reject(sc, addr.String()), nil
+	}
+	return nil, nil
+}
+
+func (p *IPFilterProcessor) reject(sc *StreamContext, client string) *Result {
+	sc.Logger().Infow("Rejecting client", "processor", p.name, "decision", "deny", "reason", "ip_denied", "client_ip", client)
+	d := &Denial{
+		Status:  http.StatusForbidden,
+		Reason:  "ip_denied",
+		Message: "access from this address is not allowed",
+	}
+	return d.Result(sc, p.renderer)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+)
+
+func TestCIDRTrie(t *testing.T) {
+	trie, err := parseCIDRList([]string{
+		"10.0.0.0/8",
+		"10.1.0.0/16", // inside 10.0.0.0/8
+		"192.168.1.7",
+		"172.16.5.9/12", // host bits are masked off
+		"2001:db8::/32",
+		"::ffff:203.0.113.0/120", // IPv4-mapped, stored as 203.0.113.0/24
+		"fe80::1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.0.0.0", true},
+		{"10.255.255.255", true},
+		{"10.1.2.3", true},
+		{"11.0.0.0", false},
+		{"9.255.255.255", false},
+		{"192.168.1.7", true},
+		{"192.168.1.6", false},
+		{"192.168.1.8", false},
+		{"172.16.0.1", true},
+		{"172.31.255.255", true},
+		{"172.32.0.0", false},
+		{"203.0.113.200", true},
+		{"::ffff:203.0.113.1", true},
+		{"::ffff:10.9.9.9", true},
+		{"203.0.114.1", false},
+		{"2001:db8::1", true},
+		{"2001:db8:ffff::1", true},
+		{"2001:db9::1", false},
+		{"fe80::1", true},
+		{"fe80::2", false},
+		// An IPv4 range doesn't cover the IPv6 addresses with the same bits
+		{"a00::", false},
+	}
+	for _, tt := range tests {
+		if got := trie.Contains(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("Contains(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+	if trie.Contains(netip.Addr{}) {
+		t.Error("the zero address is in the list")
+	}
+
+	all, _ := parseCIDRList([]string{"0.0.0.0/0"})
+	if !all.Contains(netip.MustParseAddr("1.2.3.4")) || all.Contains(netip.MustParseAddr("::1")) {
+		t.Error("0.0.0.0/0 must cover all of IPv4 and nothing else")
+	}
+	var empty *cidrTrie
+	if empty.Contains(netip.MustParseAddr("1.2.3.4")) || empty.Len() != 0 {
+		t.Error("a nil list contains addresses")
+	}
+
+	for _, entry := range []string{"10.0.0.0/33", "10.0.0", "host.example.com", "2001:db8::/129"} {
+		if _, err := parseCIDRList([]string{entry}); err == nil {
+			t.Errorf("%q accepted", entry)
+		}
+	}
+}
+
+func TestClientIPTrustedHops(t *testing.T) {
+	tests := []struct {
+		name        string
+		trustedHops int
+		headers     []string
+		// want is the resolved address, or "" if there is none
+		want string
+	}{
+		{"rightmost without trusted hops", 0, []string{"x-forwarded-for", "1.1.1.1, 2.2.2.2, 3.3.3.3"}, "3.3.3.3"},
+		{"one trusted hop", 1, []string{"x-forwarded-for", "1.1.1.1, 2.2.2.2, 3.3.3.3"}, "2.2.2.2"},
+		{"entries the client sent are skipped", 2, []string{"x-forwarded-for", "6.6.6.6,1.1.1.1, 2.2.2.2, 3.3.3.3"}, "1.1.1.1"},
+		{"fewer entries than trusted hops", 5, []string{"x-forwarded-for", "1.1.1.1, 2.2.2.2"}, "1.1.1.1"},
+		{"empty entries", 1, []string{"x-forwarded-for", "1.1.1.1,, 2.2.2.2 ,"}, "1.1.1.1"},
+		{"ports and brackets", 0, []string{"x-forwarded-for", "[2001:DB8::1]:443"}, "2001:db8::1"},
+		{"IPv4 with port", 1, []string{"x-forwarded-for", "1.1.1.1:80, 2.2.2.2"}, "1.1.1.1"},
+		{"IPv4-mapped", 0, []string{"x-forwarded-for", "::ffff:1.2.3.4"}, "1.2.3.4"},
+		{"zone", 0, []string{"x-forwarded-for", "fe80::1%eth0"}, "fe80::1"},
+		{"external address", 0, []string{"x-envoy-external-address", "4.4.4.4"}, "4.4.4.4"},
+		{"garbage at the client position", 1, []string{"x-forwarded-for", "unknown, 2.2.2.2"}, ""},
+		{"no headers", 0, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewClientIPProcessor(&ClientIPConfig{TrustedHops: tt.trustedHops})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sc := NewStreamContext(context.Background())
+			result, err := p.RequestHeaders(sc, testHeaders(tt.headers...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr, ok := ClientAddr(sc)
+			set, removed := headerChanges(result.HeaderMutation)
+			if tt.want == "" {
+				if ok || len(removed) != 1 || removed[0] != "x-client-ip" {
+					t.Errorf("resolved %v, removed %v: want nothing resolved and the header removed", addr, removed)
+				}
+				return
+			}
+			if !ok || addr.String() != tt.want || set["x-client-ip"] != tt.want {
+				t.Errorf("resolved %v (forwarded %q), want %s", addr, set["x-client-ip"], tt.want)
+			}
+		})
+	}
+
+	if _, err := NewClientIPProcessor(&ClientIPConfig{TrustedHops: -1}); err == nil {
+		t.Error("negative trustedHops accepted")
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         IPFilterConfig
+		client      string
+		wantAllowed bool
+	}{
+		{"allowed", IPFilterConfig{Allow: []string{"10.0.0.0/8"}}, "10.1.2.3", true},
+		{"not in allow", IPFilterConfig{Allow: []string{"10.0.0.0/8"}}, "11.1.2.3", false},
+		{"deny wins", IPFilterConfig{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.1.2.3"}}, "10.1.2.3", false},
+		{"deny only", IPFilterConfig{Deny: []string{"2001:db8::/32"}}, "2001:db8::5", false},
+		{"deny only, other client", IPFilterConfig{Deny: []string{"2001:db8::/32"}}, "2001:db9::5", true},
+		{"unknown client with allow", IPFilterConfig{Allow: []string{"10.0.0.0/8"}}, "", false},
+		{"unknown client with deny only", IPFilterConfig{Deny: []string{"10.0.0.0/8"}}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewIPFilterProcessor("office", &tt.cfg, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sc := NewStreamContext(context.Background())
+			if tt.client != "" {
+				sc.SetState(clientAddrKey, netip.MustParseAddr(tt.client))
+			}
+			result, err := p.RequestHeaders(sc, testHeaders())
+			if err != nil {
+				t.Fatal(err)
+			}
+			denied := result != nil && result.ImmediateResponse != nil
+			if denied == tt.wantAllowed {
+				t.Fatalf("denied = %v, want %v", denied, !tt.wantAllowed)
+			}
+			if denied && (result.ImmediateResponse.GetStatus().GetCode() != 403 || result.ImmediateResponse.GetDetails() != "ext_proc_ip_denied") {
+				t.Errorf("denied with %d %q", result.ImmediateResponse.GetStatus().GetCode(), result.ImmediateResponse.GetDetails())
+			}
+		})
+	}
+
+	for name, cfg := range map[string]IPFilterConfig{
+		"empty":     {},
+		"bad allow": {Allow: []string{"10.0.0.0/8", "nope"}},
+		"bad deny":  {Deny: []string{"300.0.0.1"}},
+	} {
+		if _, err := NewIPFilterProcessor(name, &cfg, nil); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
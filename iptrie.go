@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// cidrTrie is a binary prefix trie of CIDR ranges. A lookup walks at most
+// 32 (IPv4) or 128 (IPv6) nodes however many ranges are in the list.
+type cidrTrie struct {
+	v4, v6 trieNode
+	size   int
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	// terminal marks the end of a prefix: every address below it is in the list
+	terminal bool
+}
+
+// parseCIDRList builds a trie from CIDR ranges and plain addresses
+func parseCIDRList(entries []string) (*cidrTrie, error) {
+	t := &cidrTrie{}
+	for i, entry := range entries {
+		prefix, err := parseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("[%d]: %w", i, err)
+		}
+		t.insert(prefix)
+	}
+	return t, nil
+}
+
+// parseCIDR accepts "10.0.0.0/8", "2001:db8::/32" or a single address.
+// IPv4-mapped IPv6 ranges are stored as IPv4.
+func parseCIDR(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid address %q", s)
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR %q", s)
+	}
+	if addr := prefix.Addr(); addr.Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked(), nil
+}
+
+func (t *cidrTrie) insert(prefix netip.Prefix) {
+	node := t.root(prefix.Addr())
+	bytes := prefix.Addr().AsSlice()
+	for i := 0; i < prefix.Bits(); i++ {
+		if node.terminal {
+			// Already covered by a shorter prefix
+			return
+		}
+		bit := bitAt(bytes, i)
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+		node = node.children[bit]
+	}
+	node.terminal = true
+	// Longer prefixes below this one are now redundant
+	node.children = [2]*trieNode{}
+	t.size++
+}
+
+// Contains reports whether addr is inside any range of the list
+func (t *cidrTrie) Contains(addr netip.Addr) bool {
+	if t == nil || !addr.IsValid() {
+		return false
+	}
+	addr = addr.Unmap()
+	node := t.root(addr)
+	bytes := addr.AsSlice()
+	for i := 0; ; i++ {
+		if node.terminal {
+			return true
+		}
+		if i == addr.BitLen() {
+			return false
+		}
+		node = node.children[bitAt(bytes, i)]
+		if node == nil {
+			return false
+		}
+	}
+}
+
+// Len returns the number of ranges added to the list
+func (t *cidrTrie) Len() int {
+	if t == nil {
+		return 0
+	}
+	return t.size
+}
+
+func (t *cidrTrie) root(addr netip.Addr) *trieNode {
+	if addr.Is4() {
+		return &t.v4
+	}
+	return &t.v6
+}
+
+func bitAt(bytes []byte, i int) int {
+	return int(bytes[i/8]>>(7-uint(i%8))) & 1
+}
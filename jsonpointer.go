@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonObject is a decoded JSON object that keeps its keys in the order they
+// were sent, so a rewritten body only differs where an op changed it.
+// Documents are made of *jsonObject, []interface{}, string, json.Number,
+// bool and nil.
+type jsonObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newJSONObject() *jsonObject {
+	return &jsonObject{values: map[string]interface{}{}}
+}
+
+func (o *jsonObject) get(key string) (interface{}, bool) {
+	v, ok := o.values[key]
+	return v, ok
+}
+
+// set replaces the value of an existing key in place, or adds the key at the end
+func (o *jsonObject) set(key string, value interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *jsonObject) remove(key string) bool {
+	if _, ok := o.values[key]; !ok {
+		return false
+	}
+	delete(o.values, key)
+	for i, k := range o.keys {
+		if k == key {
+			o.keys = append(o.keys[:i], o.keys[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// decodeJSON reads one value from dec, which must use UseNumber so numbers
+// keep the exact text they were sent with
+func decodeJSON(dec *json.Decoder) (interface{}, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case json.Delim('{'):
+		obj := newJSONObject()
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			// The last of duplicate keys wins, as with encoding/json
+			obj.set(key.(string), value)
+		}
+		_, err := dec.Token()
+		return obj, err
+	case json.Delim('['):
+		arr := []interface{}{}
+		for dec.More() {
+			value, err := decodeJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, value)
+		}
+		_, err := dec.Token()
+		return arr, err
+	default:
+		return token, nil
+	}
+}
+
+// encodeJSON writes a document without escaping <, > and &, which
+// encoding/json does by default and which would change strings the op
+// didn't touch
+func encodeJSON(buf *bytes.Buffer, v interface{}) error {
+	switch n := v.(type) {
+	case *jsonObject:
+		buf.WriteByte('{')
+		for i, key := range n.keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encodeJSON(buf, key); err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			if err := encodeJSON(buf, n.values[key]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, item := range n {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encodeJSON(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	default:
+		enc := json.NewEncoder(buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		// Encode ends every value with a newline
+		buf.Truncate(buf.Len() - 1)
+	}
+	return nil
+}
+
+// jsonValue converts a value from the config file (decoded YAML or JSON)
+// to the document form. Objects get their keys sorted, as the config
+// decoders don't keep the order. Objects with keys that aren't strings
+// (YAML allows them) can't be JSON and are an error.
+func jsonValue(v interface{}) (interface{}, error) {
+	switch n := v.(type) {
+	case map[string]interface{}:
+		obj := newJSONObject()
+		for key := range n {
+			obj.keys = append(obj.keys, key)
+		}
+		sort.Strings(obj.keys)
+		for _, key := range obj.keys {
+			value, err := jsonValue(n[key])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			obj.values[key] = value
+		}
+		return obj, nil
+	case map[interface{}]interface{}:
+		for key := range n {
+			if _, ok := key.(string); !ok {
+				return nil, fmt.Errorf("object key %v is not a string", key)
+			}
+		}
+		converted := make(map[string]interface{}, len(n))
+		for key, value := range n {
+			converted[key.(string)] = value
+		}
+		return jsonValue(converted)
+	case []interface{}:
+		arr := make([]interface{}, len(n))
+		for i, item := range n {
+			value, err := jsonValue(item)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			arr[i] = value
+		}
+		return arr, nil
+	default:
+		return v, nil
+	}
+}
+
+// jsonPointer is a parsed RFC 6901 JSON pointer, e.g. "/tenant/id" or "/items/0"
+type jsonPointer []string
+
+// parseJSONPointer splits a pointer into its unescaped reference tokens.
+// The empty string points at the whole document.
+func parseJSONPointer(s string) (jsonPointer, error) {
+	if s == "" {
+		return jsonPointer{}, nil
+	}
+	if !strings.HasPrefix(s, "/") {
+		return nil, fmt.Errorf("JSON pointer %q must start with /", s)
+	}
+	tokens := strings.Split(s[1:], "/")
+	for i, t := range tokens {
+		// ~1 has to be replaced before ~0 so "~01" becomes "~1", not "/"
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func (p jsonPointer) String() string {
+	var b strings.Builder
+	for _, t := range p {
+		b.WriteString("/")
+		b.WriteString(strings.ReplaceAll(strings.ReplaceAll(t, "~", "~0"), "/", "~1"))
+	}
+	return b.String()
+}
+
+// get returns the value the pointer refers to
+func (p jsonPointer) get(doc interface{}) (interface{}, bool) {
+	current := doc
+	for _, token := range p {
+		switch node := current.(type) {
+		case *jsonObject:
+			v, ok := node.get(token)
+			if !ok {
+				return nil, false
+			}
+			current = v
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			current = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// set stores value at the pointer and returns the (possibly new) document.
+// Missing objects along the way are created. For arrays, "-" appends.
+// On error the document is returned unchanged.
+func (p jsonPointer) set(doc interface{}, value interface{}) (interface{}, error) {
+	if len(p) == 0 {
+		return value, nil
+	}
+	return setIn(doc, p, value)
+}
+
+func setIn(node interface{}, path jsonPointer, value interface{}) (interface{}, error) {
+	token := path[0]
+	last := len(path) == 1
+
+	switch n := node.(type) {
+	case nil:
+		// Create the missing object and keep going
+		created, err := setIn(newJSONObject(), path, value)
+		if err != nil {
+			return nil, err
+		}
+		return created, nil
+
+	case *jsonObject:
+		if last {
+			n.set(token, value)
+			return n, nil
+		}
+		existing, _ := n.get(token)
+		child, err := setIn(existing, path[1:], value)
+		if err != nil {
+			return n, err
+		}
+		n.set(token, child)
+		return n, nil
+
+	case []interface{}:
+		if token == "-" {
+			if !last {
+				return n, fmt.Errorf("\"-\" can only be the last token of a pointer")
+			}
+			return append(n, value), nil
+		}
+		i, err := strconv.Atoi(token)
+		if err != nil || i < 0 || i >= len(n) {
+			return n, fmt.Errorf("array index %q out of range", token)
+		}
+		if last {
+			n[i] = value
+			return n, nil
+		}
+		child, err := setIn(n[i], path[1:], value)
+		if err != nil {
+			return n, err
+		}
+		n[i] = child
+		return n, nil
+
+	default:
+		return node, fmt.Errorf("cannot descend into %T at %q", node, token)
+	}
+}
+
+// remove deletes the value at the pointer and returns the (possibly new)
+// document. ok is false if there was nothing to remove.
+func (p jsonPointer) remove(doc interface{}) (interface{}, bool) {
+	if len(p) == 0 {
+		return nil, true
+	}
+	parent, ok := p[:len(p)-1].get(doc)
+	if !ok {
+		return doc, false
+	}
+	token := p[len(p)-1]
+
+	switch n := parent.(type) {
+	case *jsonObject:
+		return doc, n.remove(token)
+	case []interface{}:
+		i, err := strconv.Atoi(token)
+		if err != nil || i < 0 || i >= len(n) {
+			return doc, false
+		}
+		// Removing from a slice gives a new slice header, so write it back
+		shorter := append(n[:i:i], n[i+1:]...)
+		if len(p) == 1 {
+			return shorter, true
+		}
+		doc, err = p[:len(p)-1].set(doc, shorter)
+		return doc, err == nil
+	default:
+		return doc, false
+	}
+}
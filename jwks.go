@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// jwk is one key from a JWKS document (RFC 7517)
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// EC and OKP
+	X string `json:"x"`
+	Y string `json:"y"`
+}
+
+// verificationKey is a parsed public key from the JWKS
+type verificationKey struct {
+	kid string
+	alg string // the JWS algorithm this key is for
+	key crypto.PublicKey
+}
+
+// keySet is a parsed JWKS
+type keySet struct {
+	keys []*verificationKey
+}
+
+// parseJWKS parses a JWKS document. Keys with unsupported types are
+// skipped, but a JWKS without a single usable key is an error.
+func parseJWKS(data []byte) (*keySet, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parsing JWKS: %w", err)
+	}
+
+	set := &keySet{}
+	for i, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.parse()
+		if err != nil {
+			return nil, fmt.Errorf("JWKS key %d (kid %q): %w", i, k.Kid, err)
+		}
+		if key != nil {
+			set.keys = append(set.keys, key)
+		}
+	}
+	if len(set.keys) == 0 {
+		return nil, fmt.Errorf("JWKS has no usable signing keys")
+	}
+	return set, nil
+}
+
+// parse converts a JWK to a public key. It returns nil for key types we
+// don't support, so one odd key doesn't break the whole set.
+func (k jwk) parse() (*verificationKey, error) {
+	switch k.Kty {
+	case "RSA":
+		if k.Alg != "" && k.Alg != "RS256" {
+			return nil, nil
+		}
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("modulus: %w", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("exponent: %w", err)
+		}
+		if n.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA key is too small (%d bits)", n.BitLen())
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &verificationKey{kid: k.Kid, alg: "RS256", key: &rsa.PublicKey{N: n, E: int(e.Int64())}}, nil
+
+	case "EC":
+		if k.Crv != "P-256" || (k.Alg != "" && k.Alg != "ES256") {
+			return nil, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != 32 {
+			return nil, fmt.Errorf("invalid EC x coordinate")
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil || len(y) != 32 {
+			return nil, fmt.Errorf("invalid EC y coordinate")
+		}
+		// crypto/ecdh checks that the point is actually on the curve
+		point := append(append([]byte{4}, x...), y...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return nil, fmt.Errorf("invalid EC key: %w", err)
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		return &verificationKey{kid: k.Kid, alg: "ES256", key: pub}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" || (k.Alg != "" && k.Alg != "EdDSA") {
+			return nil, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return &verificationKey{kid: k.Kid, alg: "EdDSA", key: ed25519.PublicKey(x)}, nil
+
+	default:
+		return nil, nil
+	}
+}
+
+// candidates returns the keys that may have signed a token with this kid and alg
+func (s *keySet) candidates(kid, alg string) []*verificationKey {
+	var keys []*verificationKey
+	for _, k := range s.keys {
+		if k.alg != alg {
+			continue
+		}
+		if kid != "" && k.kid != "" && k.kid != kid {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// JWTConfig validates bearer tokens locally against a JWKS file.
+//
+//	jwt:
+//	  jwksFile: /etc/extproc/jwks.json
+//	  issuers: [https://login.example.com/]
+//	  audiences: [orders-api]
+//	  clockSkew: 30s
+//	  forwardClaims:
+//	    sub: x-user-id
+//	    email: x-user-email
+type JWTConfig struct {
+	// JWKSFile is the key set used to check signatures. It is reloaded
+	// when the file changes (checked every JWKSRefresh, default 30s).
+	JWKSFile    string        `yaml:"jwksFile" json:"jwksFile"`
+	JWKSRefresh time.Duration `yaml:"jwksRefresh" json:"jwksRefresh"`
+
+	// Issuers and Audiences, if set, must contain the token's iss / one of its aud
+	Issuers   []string `yaml:"issuers" json:"issuers"`
+	Audiences []string `yaml:"audiences" json:"audiences"`
+
+	// ClockSkew is how much exp and nbf may be off by (default 30s)
+	ClockSkew time.Duration `yaml:"clockSkew" json:"clockSkew"`
+
+	// Header holds the token (default authorization, with a "Bearer " prefix)
+	Header string `yaml:"header" json:"header"`
+
+	// Optional lets requests without a token through. Requests with a bad
+	// token are always rejected.
+	Optional bool `yaml:"optional" json:"optional"`
+
+	// ForwardClaims maps claim names to request headers. The headers are
+	// always removed from the incoming request first, so clients can't
+	// set them themselves.
+	ForwardClaims map[string]string `yaml:"forwardClaims" json:"forwardClaims"`
+
+	// Match limits validation to matching requests (default: all)
+	Match *MatchConfig `yaml:"match" json:"match"`
+}
+
+// supportedJWTAlgs are the signature algorithms we accept
+var supportedJWTAlgs = map[string]bool{"RS256": true, "ES256": true, "EdDSA": true}
+
+func (c *JWTConfig) validate() error {
+	if c.JWKSFile == "" {
+		return fmt.Errorf("jwksFile is required")
+	}
+	if c.ClockSkew < 0 || c.JWKSRefresh < 0 {
+		return fmt.Errorf("durations must not be negative")
+	}
+	if _, err := CompileMatcher(c.Match); err != nil {
+		return fmt.Errorf("match.%w", err)
+	}
+	return nil
+}
+
+// jwtError is a token problem that is reported to the client
+type jwtError struct {
+	reason  string // e.g. jwt_expired, used for %RESPONSE_CODE_DETAILS%
+	message string
+}
+
+func (e *jwtError) Error() string { return e.message }
+
+func newJWTError(reason, format string, args ...interface{}) *jwtError {
+	return &jwtError{reason: reason, message: fmt.Sprintf(format, args...)}
+}
+
+// JWTProcessor validates bearer tokens and forwards selected claims
+type JWTProcessor struct {
+	BaseProcessor
+
+	cfg      *JWTConfig
+	keys     *watchedFile[*keySet]
+	header   string
+	claims   []string // sorted claim names, for stable header order
+	skew     time.Duration
+	renderer *DenyRenderer
+}
+
+// NewJWTProcessor loads the JWKS and prepares the processor
+func NewJWTProcessor(cfg *JWTConfig, renderer *DenyRenderer) (*JWTProcessor, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	refresh := cfg.JWKSRefresh
+	if refresh == 0 {
+		refresh = 30 * time.Second
+	}
+	keys, err := newWatchedFile(cfg.JWKSFile, refresh, parseJWKS)
+	if err != nil {
+		return nil, fmt.Errorf("loading JWKS: %w", err)
+	}
+
+	p := &JWTProcessor{
+		cfg:      cfg,
+		keys:     keys,
+		header:   strings.ToLower(cfg.Header),
+		skew:     cfg.ClockSkew,
+		renderer: renderer,
+	}
+	if p.header == "" {
+		p.header = "authorization"
+	}
+	if p.skew == 0 {
+		p.skew = 30 * time.Second
+	}
+	for claim := range cfg.ForwardClaims {
+		p.claims = append(p.claims, claim)
+	}
+	sort.Strings(p.claims)
+	return p, nil
+}
+
+func (p *JWTProcessor) Name() string { return "jwt" }
+
+func (p *JWTProcessor) checksAccess() {}
+
+// RequestHeaders validates the token and forwards its claims
+func (p *JWTProcessor) RequestHeaders(sc *StreamContext, headers *extprocv3.HttpHeaders) (*Result, error) {
+	// Never trust claim headers sent by the client
+	mutation := &extprocv3.HeaderMutation{}
+	for _, claim := range p.claims {
+		mutation.RemoveHeaders = append(mutation.RemoveHeaders, p.cfg.ForwardClaims[claim])
+	}
+
+	token, found := p.extractToken(headers)
+	if !found {
+		if p.cfg.Optional {
+			return &Result{HeaderMutation: mutation}, nil
+		}
+		return p.deny(sc, newJWTError("jwt_missing", "a bearer token is required")), nil
+	}
+
+	claims, err := p.verify(token)
+	if err != nil {
+		var jerr *jwtError
+		if !errors.As(err, &jerr) {
+			jerr = newJWTError("jwt_invalid", "invalid token")
+		}
+		return p.deny(sc, jerr), nil
+	}
+
+	for _, claim := range p.claims {
+		value, ok := claimString(claims[claim])
+		if !ok {
+			continue
+		}
+		mutation.SetHeaders = append(mutation.SetHeaders, &corev3.HeaderValueOption{
+			Header:       &corev3.HeaderValue{Key: p.cfg.ForwardClaims[claim], Value: value},
+			AppendAction: corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+		})
+	}
+	sub, _ := claimString(claims["sub"])
+	sc.Logger().Debugw("Token valid", "processor", p.Name(), "subject", sub)
+
+	// Other processors (e.g. rate limiting) can key on the verified claims
+	sc.SetState(jwtClaimsKey, claims)
+	return &Result{HeaderMutation: mutation}, nil
+}
+
+// jwtClaimsKey is where the verified claims are kept in the stream state
+const jwtClaimsKey = "jwt:claims"
+
+// JWTClaims returns the claims verified for this stream, or nil
+func JWTClaims(sc *StreamContext) map[string]interface{} {
+	claims, _ := sc.State(jwtClaimsKey).(map[string]interface{})
+	return claims
+}
+
+func (p *JWTProcessor) deny(sc *StreamContext, err *jwtError) *Result {
+	sc.Logger().Infow("Rejecting request", "processor", p.Name(), "decision", "deny", "reason", err.reason, "error", err.message)
+	challenge := fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, err.message)
+	if err.reason == "jwt_missing" {
+		challenge = "Bearer"
+	}
+	return (&Denial{
+		Status:  http.StatusUnauthorized,
+		Reason:  err.reason,
+		Message: err.message,
+		Headers: map[string]string{"www-authenticate": challenge},
+	}).Result(sc, p.renderer)
+}
+
+// extractToken reads the token from the configured header
+func (p *JWTProcessor) extractToken(headers *extprocv3.HttpHeaders) (string, bool) {
+	value, ok := getHeader(headers, p.header)
+	if !ok {
+		return "", false
+	}
+	if p.header == "authorization" {
+		scheme, token, found := strings.Cut(strings.TrimSpace(value), " ")
+		if !found || !strings.EqualFold(scheme, "bearer") {
+			return "", false
+		}
+		value = token
+	}
+	value = strings.TrimSpace(value)
+	return value, value != ""
+}
+
+// verify checks the token signature and claims and returns the claims
+func (p *JWTProcessor) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, newJWTError("jwt_malformed", "token is not a JWS compact serialization")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, newJWTError("jwt_malformed", "invalid token header")
+	}
+	if !supportedJWTAlgs[header.Alg] {
+		return nil, newJWTError("jwt_bad_alg", "unsupported token algorithm %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, newJWTError("jwt_malformed", "invalid token signature encoding")
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range p.keys.Get().candidates(header.Kid, header.Alg) {
+		if verifySignature(key, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, newJWTError("jwt_bad_signature", "token signature is not valid")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, newJWTError("jwt_malformed", "invalid token claims")
+	}
+	if err := p.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// checkClaims enforces exp, nbf, iss and aud
+func (p *JWTProcessor) checkClaims(claims map[string]interface{}) error {
+	now := time.Now()
+	skew := p.skew
+
+	exp, ok := numericDate(claims["exp"])
+	if !ok {
+		return newJWTError("jwt_no_exp", "token has no valid exp claim")
+	}
+	if now.After(exp.Add(skew)) {
+		return newJWTError("jwt_expired", "token expired at %s", exp.UTC().Format(time.RFC3339))
+	}
+	if _, present := claims["nbf"]; present {
+		nbf, ok := numericDate(claims["nbf"])
+		if !ok {
+			return newJWTError("jwt_malformed", "token has an invalid nbf claim")
+		}
+		if now.Add(skew).Before(nbf) {
+			return newJWTError("jwt_not_yet_valid", "token is not valid before %s", nbf.UTC().Format(time.RFC3339))
+		}
+	}
+
+	if len(p.cfg.Issuers) > 0 {
+		iss, _ := claims["iss"].(string)
+		if !containsString(p.cfg.Issuers, iss) {
+			return newJWTError("jwt_bad_issuer", "token issuer %q is not accepted", iss)
+		}
+	}
+
+	if len(p.cfg.Audiences) > 0 {
+		var auds []string
+		switch aud := claims["aud"].(type) {
+		case string:
+			auds = []string{aud}
+		case []interface{}:
+			for _, a := range aud {
+				if s, ok := a.(string); ok {
+					auds = append(auds, s)
+				}
+			}
+		}
+		accepted := false
+		for _, a := range auds {
+			if containsString(p.cfg.Audiences, a) {
+				accepted = true
+				break
+			}
+		}
+		if !accepted {
+			return newJWTError("jwt_bad_audience", "token audience is not accepted")
+		}
+	}
+	return nil
+}
+
+// verifySignature checks one signature with one key
+func verifySignature(key *verificationKey, signed, signature []byte) bool {
+	switch pub := key.key.(type) {
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		// JWS uses the raw r||s encoding, not ASN.1
+		if len(signature) != 64 {
+			return false
+		}
+		digest := sha256.Sum256(signed)
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(pub, digest[:], r, s)
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, signed, signature)
+	default:
+		return false
+	}
+}
+
+// decodeJWTPart base64url-decodes and unmarshals one part of a token
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// numericDate converts a JWT NumericDate claim to a time
+func numericDate(v interface{}) (time.Time, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return time.Time{}, false
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*1e9)), true
+}
+
+// claimString renders a claim as a header value. Arrays become
+// comma-separated lists; objects are sent as JSON.
+func claimString(v interface{}) (string, bool) {
+	switch c := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		return c, true
+	case json.Number:
+		return c.String(), true
+	case bool:
+		return fmt.Sprint(c), true
+	case []interface{}:
+		var parts []string
+		for _, item := range c {
+			if s, ok := claimString(item); ok {
+				parts = append(parts, s)
+			}
+		}
+		return strings.Join(parts, ","), true
+	default:
+		b, err := json.Marshal(c)
+		if err != nil {
+			return "", false
+		}
+		return string(b), true
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testSigner signs tokens with a key generated at test time
+type testSigner struct {
+	kid string
+	alg string
+	key crypto.Signer
+}
+
+func newTestSigners(t *testing.T) map[string]*testSigner {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]*testSigner{
+		"RS256": {kid: "rsa", alg: "RS256", key: rsaKey},
+		"ES256": {kid: "ec", alg: "ES256", key: ecKey},
+		"EdDSA": {kid: "ed", alg: "EdDSA", key: edKey},
+	}
+}
+
+// jwk returns the public key in JWKS form
+func (s *testSigner) jwk() map[string]string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch pub := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": s.kid, "n": b64(pub.N.Bytes()), "e": b64(big.NewInt(int64(pub.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kty": "EC", "kid": s.kid, "crv": "P-256", "x": b64(pub.X.FillBytes(make([]byte, 32))), "y": b64(pub.Y.FillBytes(make([]byte, 32)))}
+	default:
+		return map[string]string{"kty": "OKP", "kid": s.kid, "crv": "Ed25519", "x": b64(pub.(ed25519.PublicKey))}
+	}
+}
+
+// sign returns a compact JWS of claims with the given header
+func (s *testSigner) sign(t *testing.T, header map[string]string, claims map[string]interface{}) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	var err error
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, sig *big.Int
+		r, sig, err = ecdsa.Sign(rand.Reader, key, digest[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), sig.FillBytes(make([]byte, 32))...)
+		}
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// token signs claims with the signer's own alg and kid
+func (s *testSigner) token(t *testing.T, claims map[string]interface{}) string {
+	return s.sign(t, map[string]string{"alg": s.alg, "kid": s.kid, "typ": "JWT"}, claims)
+}
+
+func writeTestJWKS(t *testing.T, path string, signers ...*testSigner) {
+	t.Helper()
+	var doc struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	for _, s := range signers {
+		doc.Keys = append(doc.Keys, s.jwk())
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, path, data)
+}
+
+func newTestJWTProcessor(t *testing.T, signers ...*testSigner) *JWTProcessor {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeTestJWKS(t, path, signers...)
+	p, err := NewJWTProcessor(&JWTConfig{
+		JWKSFile:    path,
+		JWKSRefresh: time.Hour,
+		Issuers:     []string{"https://login.example.com/"},
+		Audiences:   []string{"orders-api"},
+		ClockSkew:   30 * time.Second,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// testClaims are valid claims for newTestJWTProcessor, with overrides
+func testClaims(overrides map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{
+		"iss": "https://login.example.com/",
+		"aud": []string{"other-api", "orders-api"},
+		"sub": "user-1",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range overrides {
+		if v == nil {
+			delete(claims, k)
+			continue
+		}
+		claims[k] = v
+	}
+	return claims
+}
+
+// jwtReason returns the rejection reason of err, or "" if there is none
+func jwtReason(t *testing.T, err error) string {
+	t.Helper()
+	if err == nil {
+		return ""
+	}
+	jerr, ok := err.(*jwtError)
+	if !ok {
+		t.Fatalf("error %v is not a jwtError", err)
+	}
+	return jerr.reason
+}
+
+func TestJWTSignatures(t *testing.T) {
+	signers := newTestSigners(t)
+	p := newTestJWTProcessor(t, signers["RS256"], signers["ES256"], signers["EdDSA"])
+	for alg, s := range signers {
+		t.Run(alg, func(t *testing.T) {
+			claims, err := p.verify(s.token(t, testClaims(nil)))
+			if err != nil {
+				t.Fatalf("valid %s token rejected: %v", alg, err)
+			}
+			if claims["sub"] != "user-1" {
+				t.Errorf("sub = %v, want user-1", claims["sub"])
+			}
+		})
+	}
+}
+
+func TestJWTRejected(t *testing.T) {
+	signers := newTestSigners(t)
+	rs, es := signers["RS256"], signers["ES256"]
+	p := newTestJWTProcessor(t, rs, es)
+	now := time.Now()
+
+	// A token signed by another key under a kid the JWKS has
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	impostor := &testSigner{kid: es.kid, alg: "ES256", key: otherKey}
+
+	valid := rs.token(t, testClaims(nil))
+	tampered := valid[:len(valid)-4] + "AAAA"
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin"}`)) + "."
+
+	tests := []struct {
+		name  string
+		token string
+		want  string // rejection reason, or "" if the token is valid
+	}{
+		{"valid", valid, ""},
+		{"bad signature", tampered, "jwt_bad_signature"},
+		{"signed by another key", impostor.token(t, testClaims(nil)), "jwt_bad_signature"},
+		// An RSA key must not verify a token that claims to be ES256
+		{"alg does not match the key", rs.sign(t, map[string]string{"alg": "ES256", "kid": rs.kid}, testClaims(nil)), "jwt_bad_signature"},
+		{"alg none", unsigned, "jwt_bad_alg"},
+		{"HS256", rs.sign(t, map[string]string{"alg": "HS256", "kid": rs.kid}, testClaims(nil)), "jwt_bad_alg"},
+		{"unknown kid", rs.sign(t, map[string]string{"alg": "RS256", "kid": "retired"}, testClaims(nil)), "jwt_bad_signature"},
+		{"not a JWS", "abc.def", "jwt_malformed"},
+		{"no exp", rs.token(t, testClaims(map[string]interface{}{"exp": nil})), "jwt_no_exp"},
+		{"expired within the skew", rs.token(t, testClaims(map[string]interface{}{"exp": now.Add(-10 * time.Second).Unix()})), ""},
+		{"expired", rs.token(t, testClaims(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()})), "jwt_expired"},
+		{"not yet valid within the skew", rs.token(t, testClaims(map[string]interface{}{"nbf": now.Add(10 * time.Second).Unix()})), ""},
+		{"not yet valid", rs.token(t, testClaims(map[string]interface{}{"nbf": now.Add(time.Minute).Unix()})), "jwt_not_yet_valid"},
+		{"wrong issuer", rs.token(t, testClaims(map[string]interface{}{"iss": "https://evil.example.com/"})), "jwt_bad_issuer"},
+		{"no issuer", rs.token(t, testClaims(map[string]interface{}{"iss": nil})), "jwt_bad_issuer"},
+		{"wrong audience", rs.token(t, testClaims(map[string]interface{}{"aud": "billing-api"})), "jwt_bad_audience"},
+		{"single audience", rs.token(t, testClaims(map[string]interface{}{"aud": "orders-api"})), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := p.verify(tt.token)
+			if got := jwtReason(t, err); got != tt.want {
+				t.Errorf("rejected with %q (%v), want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestJWTRequestHeaders(t *testing.T) {
+	signers := newTestSigners(t)
+	p := newTestJWTProcessor(t, signers["EdDSA"])
+	p.cfg.ForwardClaims = map[string]string{"sub": "x-user-id"}
+	p.claims = []string{"sub"}
+
+	sc := NewStreamContext(context.Background())
+	token := signers["EdDSA"].token(t, testClaims(nil))
+	result, err := p.RequestHeaders(sc, testHeaders("authorization", "Bearer "+token, "x-user-id", "spoofed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ImmediateResponse != nil {
+		t.Fatalf("valid token denied with %d", result.ImmediateResponse.GetStatus().GetCode())
+	}
+	set := result.HeaderMutation.GetSetHeaders()
+	if len(set) != 1 || set[0].GetHeader().GetKey() != "x-user-id" || set[0].GetHeader().GetValue() != "user-1" {
+		t.Errorf("set headers %v, want x-user-id: user-1", set)
+	}
+	if removed := result.HeaderMutation.GetRemoveHeaders(); len(removed) != 1 || removed[0] != "x-user-id" {
+		t.Errorf("removed headers %v, want the client's x-user-id", removed)
+	}
+	if JWTClaims(sc)["sub"] != "user-1" {
+		t.Error("verified claims not kept for the stream")
+	}
+
+	for name, headers := range map[string][]string{
+		"missing":    nil,
+		"not bearer": {"authorization", "Basic dXNlcjpwYXNz"},
+		"invalid":    {"authorization", "Bearer " + token + "x"},
+	} {
+		result, err := p.RequestHeaders(NewStreamContext(context.Background()), testHeaders(headers...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := result.ImmediateResponse.GetStatus().GetCode(); got != 401 {
+			t.Errorf("%s token: status %d, want 401", name, got)
+		}
+	}
+}
+
+func TestJWTKeySetReload(t *testing.T) {
+	signers := newTestSigners(t)
+	old, next := signers["ES256"], signers["EdDSA"]
+	p := newTestJWTProcessor(t, old)
+	oldToken, nextToken := old.token(t, testClaims(nil)), next.token(t, testClaims(nil))
+
+	writeTestJWKS(t, p.cfg.JWKSFile, next)
+	// Until the refresh interval has passed the file isn't looked at
+	if _, err := p.verify(oldToken); err != nil {
+		t.Errorf("token of the old key rejected before the refresh: %v", err)
+	}
+
+	p.keys.lastCheck.Store(0)
+	if _, err := p.verify(nextToken); err != nil {
+		t.Errorf("token of the new key rejected after the swap: %v", err)
+	}
+	if _, err := p.verify(oldToken); jwtReason(t, err) != "jwt_bad_signature" {
+		t.Errorf("token of the removed key: %v, want jwt_bad_signature", err)
+	}
+
+	// A broken file keeps the last good key set
+	writeTestFile(t, p.cfg.JWKSFile, []byte(`{"keys": []}`))
+	p.keys.lastCheck.Store(0)
+	if _, err := p.verify(nextToken); err != nil {
+		t.Errorf("a broken JWKS replaced the working one: %v", err)
+	}
+}
@@ -1,15 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
 	"io"
-	"log"
-	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	// Import the Envoy external processor gRPC definitions
-	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/solo-io/go-utils/contextutils"
 
 	// Health check imports - these provide ready-to-use health check implementations
 
@@ -21,13 +32,58 @@ import (
 // ExtProcServer implements the ExternalProcessor interface that Gloo expects
 type ExtProcServer struct {
 	extprocv3.UnimplementedExternalProcessorServer
+
+	// chain is the ordered list of processors run for every message.
+	// It is swapped atomically when the config is reloaded.
+	chain atomic.Pointer[Chain]
+
+	// streams counts the streams running on each chain, the active one
+	// and those a reload replaced, so what they use isn't released
+	// under them (see releaseUnused)
+	streamsMu sync.Mutex
+	streams   map[*Chain]int
+
+	// swapMu is held while a new chain is built and swapped in, and while
+	// unused resources are released, so those of a chain being built
+	// aren't released before it is in use
+	swapMu sync.Mutex
+}
+
+// NewExtProcServer creates a server that runs the given processor chain
+func NewExtProcServer(chain *Chain) *ExtProcServer {
+	s := &ExtProcServer{streams: map[*Chain]int{}}
+	s.chain.Store(chain)
+	return s
 }
 
 // Process is the main function that Gloo calls for every HTTP request
 // It receives a bidirectional stream where Gloo sends request data
 // and we send back instructions on what to modify
-func (s *ExtProcServer) Process(stream extprocv3.ExternalProcessor_ProcessServer) error {
-	log.Println("New HTTP request received from Gloo")
+func (s *ExtProcServer) Process(stream extprocv3.ExternalProcessor_ProcessServer) (err error) {
+	streamStart := time.Now()
+	metrics.ActiveStreams.Inc()
+	defer metrics.ActiveStreams.Dec()
+
+	// State shared by every message on this stream (one stream = one HTTP request).
+	// Its logger gets the request fields once the request headers arrive.
+	sc := NewStreamContext(contextutils.WithLogger(stream.Context(), "extproc"))
+
+	// Take a snapshot of the chain so a config reload in the middle of
+	// this request cannot mix old and new rules
+	chain := s.acquireChain()
+	defer s.releaseChain(chain)
+
+	// The stream's span and audit record are written when it ends. Envoy
+	// cancelling the stream is how it normally says it is done, so that
+	// isn't a failure.
+	defer func() {
+		streamErr := err
+		if status.Code(streamErr) == codes.Canceled {
+			streamErr = nil
+		}
+		sc.Span.End(streamErr)
+		sc.Audit.End(sc, streamErr)
+	}()
 
 	// Keep listening for messages from Gloo on this stream
 	for {
@@ -35,115 +91,268 @@ func (s *ExtProcServer) Process(stream extprocv3.ExternalProcessor_ProcessServer
 		req, err := stream.Recv()
 		if err == io.EOF {
 			// Stream ended normally
-			log.Println("Stream ended")
+			sc.Logger().Debugw("Stream ended", "duration", time.Since(streamStart))
 			return nil
 		}
 		if err != nil {
-			// Something went wrong
-			log.Printf("Error receiving from Gloo: %v", err)
+			metrics.StreamErrors.Inc("recv", status.Code(err).String())
+			// Envoy cancels the stream once it has what it needs, so a
+			// cancellation is not worth more than a debug line
+			if status.Code(err) == codes.Canceled {
+				sc.Logger().Debugw("Stream closed by Gloo", "duration", time.Since(streamStart))
+			} else {
+				sc.Logger().Errorw("Error receiving from Gloo", "error", err)
+			}
 			return err
 		}
+		start := time.Now()
 
-		// Check if this message contains request headers
-		// We only care about headers, ignore body/trailers/etc.
-		if requestHeaders, ok := req.Request.(*extprocv3.ProcessingRequest_RequestHeaders); ok {
-			log.Println("Processing request headers")
-
-			// Add our header and send response back to Gloo
-			response := s.addProcessedByHeader(requestHeaders.RequestHeaders)
-			err := stream.Send(response)
-			if err != nil {
-				log.Printf("Error sending response to Gloo: %v", err)
-				return err
-			}
+		// Work out which phase this message is for (headers, body, trailers...)
+		phase, err := phaseOf(req)
+		if err != nil {
+			sc.Logger().Errorw("Rejecting message from Gloo", "error", err)
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		sc.Phase = phase
+		metrics.Messages.Inc(string(phase))
 
-			log.Println("Header added and response sent to Gloo")
+		// The request ID is settled first and attached to the stream's
+		// logger, so every line after this carries it
+		if headers := req.GetRequestHeaders(); headers != nil && sc.RequestID == "" {
+			chain.Identify(sc, headers)
+			sc.Context = contextutils.WithLoggerValues(sc.Context, requestLogFields(sc, headers)...)
+			sc.Span = chain.StartSpan(sc, headers, streamStart)
+			sc.Audit = chain.StartAudit(sc, headers, streamStart)
+			sc.Logger().Infow("New HTTP request received from Gloo")
 		}
-		// For any other message types (body, trailers, response headers, etc.)
-		// we just ignore them - Gloo will process them normally
+		sc.Logger().Debugw("Processing message")
+
+		// Run every enabled processor and build the reply for this phase.
+		// With a deadline configured the reply may already have been sent:
+		// the fallback, when the processors took too long.
+		response, sent, err := chain.Handle(sc, req, stream.Send)
+		if err != nil {
+			sc.Logger().Errorw("Error processing message", "error", err)
+			return err
+		}
+		sc.Span.Record(response)
+		sc.Audit.Record(response)
+		fields := append(describeResponse(response), "latency", time.Since(start))
+
+		// In async mode Envoy does not wait for us and must not get a reply
+		if req.AsyncMode {
+			sc.Logger().Infow("Async message processed, no response sent", fields...)
+			continue
+		}
+
+		// Send the response back to Gloo
+		if !sent {
+			err = stream.Send(response)
+		}
+		if err != nil {
+			metrics.StreamErrors.Inc("send", status.Code(err).String())
+			sc.Logger().Errorw("Error sending response to Gloo", "error", err)
+			return err
+		}
+		metrics.Responses.Inc(responseType(response))
+		metrics.MessageDuration.Observe(time.Since(start), string(phase))
+
+		sc.Logger().Infow("Message processed and response sent to Gloo", fields...)
 	}
 }
 
-// addProcessedByHeader takes the incoming headers and returns instructions
-// to add our custom "x-processed-by" header
-func (s *ExtProcServer) addProcessedByHeader(headers *extprocv3.HttpHeaders) *extprocv3.ProcessingResponse {
-	log.Println("Creating header mutation to add x-processed-by header")
-
-	headerMutation := &extprocv3.HeaderMutation{
-		SetHeaders: []*corev3.HeaderValueOption{
-			{
-				Header: &corev3.HeaderValue{
-					Key:   "x-processed-by",
-					Value: "ext-proc-go-server",
-				},
-				AppendAction: corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
-			},
-		},
-	}
-
-	return &extprocv3.ProcessingResponse{
-		Response: &extprocv3.ProcessingResponse_RequestHeaders{
-			RequestHeaders: &extprocv3.HeadersResponse{
-				Response: &extprocv3.CommonResponse{
-					HeaderMutation: headerMutation,
-				},
-			},
-		},
+// requestLogFields are the fields every log line of a request carries
+func requestLogFields(sc *StreamContext, headers *extprocv3.HttpHeaders) []interface{} {
+	method, _ := getHeader(headers, ":method")
+	path, _ := getHeader(headers, ":path")
+	authority, _ := getHeader(headers, ":authority")
+	fields := []interface{}{
+		"request_id", sc.RequestID,
+		"method", method,
+		"path", path,
+		"authority", authority,
 	}
+	if sc.Trace != nil {
+		fields = append(fields, "trace_id", sc.Trace.TraceIDString())
+	}
+	return fields
 }
 
 func main() {
-	log.Println("Starting EAG ExtProc service...")
+	opts, err := ParseOptions(os.Args[1:], os.Getenv, os.Stderr)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid options: %v\n", err)
+		os.Exit(2)
+	}
+
+	// Helper for filling in the API key store; never logs the key itself
+	if opts.HashAPIKey != "" {
+		hash, err := HashAPIKey(opts.HashAPIKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to hash API key: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(hash)
+		return
+	}
+
+	// Helper for checking an audit log for tampering
+	if opts.VerifyAudit != "" {
+		os.Exit(verifyAuditLog(opts.VerifyAudit, opts.AuditKeyFile))
+	}
+
+	// Logs are JSON lines; the level can be changed later without a restart
+	contextutils.SetLogLevel(opts.LogLevel)
+	ctx := contextutils.WithLogger(context.Background(), "extproc")
+	logger := contextutils.LoggerFrom(ctx)
+	defer logger.Sync()
+
+	logger.Infow("Starting EAG ExtProc service...", "log_level", opts.LogLevel.String(),
+		"grpc_address", opts.GRPCAddress, "admin_address", opts.AdminAddress)
+
+	drainer := NewDrainer(opts.DrainPeriod, opts.ShutdownTimeout, logger)
+
+	// Load the header rules and other settings before we accept any traffic
+	cfg := DefaultConfig()
+	if opts.ConfigPath != "" {
+		loaded, err := LoadConfig(opts.ConfigPath)
+		if err != nil {
+			logger.Fatalw("Failed to load config", "error", err)
+		}
+		cfg = loaded
+		logger.Infow("Loaded config", "path", opts.ConfigPath)
+	} else {
+		logger.Infow("No config file given, using built-in config")
+	}
 
 	// Start HTTP health check server in a separate goroutine
 	// This provides a simple HTTP endpoint that Kubernetes can use for health checks
+	httpServer := &http.Server{Addr: opts.AdminAddress}
 	go func() {
-		// Create HTTP server for health checks on port 8080
-		http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("OK"))
-		})
+		// Health checks; 503 once shutdown has started
+		http.HandleFunc("/health", drainer.HealthHandler)
+
+		// GET shows the log level, PUT {"level":"debug"} changes it
+		http.Handle("/logging", contextutils.GetLogHandler())
+
+		// Prometheus scrapes stream and processor activity here
+		http.Handle("/metrics", metrics)
 
 		// Start HTTP server for health checks
-		log.Println("Health check server starting on :8080/health")
-		if err := http.ListenAndServe(":8080", nil); err != nil {
-			log.Printf("Health check server failed: %v", err)
+		logger.Infow("Health check server starting", "address", opts.AdminAddress, "endpoints", []string{"/health", "/logging", "/metrics"})
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Errorw("Health check server failed", "error", err)
 		}
 	}()
 
-	// Create a TCP listener on port 9001 (standard ExtProc port)
-	lis, err := net.Listen("tcp", ":9001")
+	// Listen on TCP (":9001" is the standard ExtProc port) or on a Unix
+	// socket when Envoy runs next to us
+	lis, err := listen(opts.GRPCAddress)
 	if err != nil {
-		log.Fatalf("Failed to create listener on port 9001: %v", err)
+		logger.Fatalw("Failed to create listener", "address", opts.GRPCAddress, "error", err)
 	}
-	log.Println("gRPC server listening on port 9001")
+	logger.Infow("gRPC server listening", "network", lis.Addr().Network(), "address", lis.Addr().String())
 
-	// Create a new gRPC server
-	grpcServer := grpc.NewServer()
-	log.Println("gRPC server created")
+	// Create a new gRPC server. Panics fail the one call instead of the
+	// process, and health checks tell Envoy to fail the host right away
+	// once shutdown has started.
+	serverOpts := append(opts.GRPC.ServerOptions(),
+		grpc.ChainUnaryInterceptor(RecoverUnaryInterceptor(), drainer.HealthCheckInterceptor()),
+		grpc.StreamInterceptor(RecoverStreamInterceptor()))
+	if opts.TLSCertFile != "" {
+		serverTLS, err := NewServerTLS(opts)
+		if err != nil {
+			logger.Fatalw("Failed to load TLS certificate", "error", err)
+		}
+		serverOpts = append(serverOpts, grpc.Creds(serverTLS.Credentials()))
+		logger.Infow("gRPC TLS enabled", "cert", opts.TLSCertFile, "mutual_tls", serverTLS.MutualTLS(),
+			"allowed_spiffe_ids", opts.TLSAllowedSPIFFEIDs, "allowed_sans", opts.TLSAllowedSANs,
+			"not_after", certNotAfter(serverTLS.current()), "reload_interval", opts.TLSReloadInterval)
+	} else if lis.Addr().Network() == "tcp" {
+		logger.Warnw("gRPC TLS is off; header data travels in plaintext (set -tls-cert and -tls-key)")
+	}
+	grpcServer := grpc.NewServer(serverOpts...)
+	logger.Infow("gRPC server created", opts.GRPC.LogFields()...)
 
 	// Register our ExtProc service with the gRPC server
 	// This tells gRPC that our ExtProcServer should handle ExtProc requests
-	extprocv3.RegisterExternalProcessorServer(grpcServer, &ExtProcServer{})
-	log.Println("ExtProc service registered")
+	// The processor chain decides what happens to each request; add new
+	// processors in BuildChain instead of changing Process
+	chain, err := BuildChain(cfg)
+	if err != nil {
+		logger.Fatalw("Failed to build processor chain", "error", err)
+	}
+	extProcServer := NewExtProcServer(chain)
+	extprocv3.RegisterExternalProcessorServer(grpcServer, extProcServer)
+	logger.Infow("ExtProc service registered", "processors", chain.Names())
+
+	// Pick up config changes without restarting the gRPC server
+	if opts.ConfigPath != "" {
+		reloader := NewConfigReloader(opts.ConfigPath, opts.ConfigPollInterval, extProcServer)
+		go reloader.Run(ctx)
+	}
 
-	// Set up gRPC health checking
+	// Set up gRPC health checking. failOnTerm is off because the Drainer
+	// handles SIGTERM and marks it NOT_SERVING itself.
 	healthServer := grpchealth.NewServer()
 	hc := healthchecker.NewGrpc("ext-proc", healthServer, false, healthpb.HealthCheckResponse_SERVING)
 	// Register the health server with gRPC
 	healthpb.RegisterHealthServer(grpcServer, hc.GetServer())
 
-	log.Println("gRPC health service registered and set to SERVING")
+	logger.Infow("gRPC health service registered and set to SERVING")
 
-	log.Println("Service will add header: x-processed-by: eag-extproc")
-	log.Println("Health check endpoints:")
-	log.Println("  - HTTP: http://localhost:8080/health")
-	log.Println("  - gRPC: grpc://localhost:9001 (health service)")
-	log.Println("Ready to receive requests from Gloo Gateway...")
+	logger.Infow("Service configured",
+		"request_header_rules", len(cfg.Headers.Request),
+		"response_header_rules", len(cfg.Headers.Response),
+		"rules", len(cfg.Rules))
+	logger.Infow("Ready to receive requests from Gloo Gateway...",
+		"http_health", "http://"+opts.AdminAddress+"/health",
+		"grpc_address", opts.GRPCAddress)
 
-	// Start the gRPC server and block here
+	// Start the gRPC server
 	// Gloo will connect to this server and send HTTP request data
-	if err := grpcServer.Serve(lis); err != nil {
-		log.Fatalf("Failed to start gRPC server: %v", err)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- grpcServer.Serve(lis)
+	}()
+
+	// Block until the server fails or we are asked to stop
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-serveErr:
+		logger.Fatalw("Failed to start gRPC server", "error", err)
+	case sig := <-sigs:
+		logger.Infow("Received signal, shutting down", "signal", sig.String())
+	}
+	drainer.Shutdown(sigs, grpcServer, httpServer, hc, healthServer)
+}
+
+// verifyAuditLog checks an audit log file's HMAC chain and returns the exit code
+func verifyAuditLog(path, keyFile string) int {
+	if keyFile == "" {
+		fmt.Fprintln(os.Stderr, "-verify-audit needs -audit-key-file")
+		return 2
+	}
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read audit key: %v\n", err)
+		return 1
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open audit log: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+	n, err := VerifyAuditLog(f, bytes.TrimSpace(key))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v (%d records verified before it)\n", path, err, n)
+		return 1
 	}
+	fmt.Printf("%s: %d records verified\n", path, n)
+	return 0
 }
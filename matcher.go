@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// Matcher decides whether a rule applies to a request.
+// It is evaluated against the request headers, including the pseudo-headers
+// Envoy sends (:path, :method, :authority, :scheme).
+type Matcher interface {
+	Match(headers *extprocv3.HttpHeaders) bool
+}
+
+// MatchConfig is the config file form of a matcher.
+// Every field that is set must match (they are ANDed together);
+// an empty MatchConfig matches every request.
+//
+//	match:
+//	  path: { prefix: /admin }
+//	  method: { exact: POST }
+//	  headers:
+//	    - name: x-tenant
+//	      glob: "team-*"
+//	  not:
+//	    host: { exact: internal.example.com }
+type MatchConfig struct {
+	Path    *StringMatch  `yaml:"path" json:"path"`
+	Method  *StringMatch  `yaml:"method" json:"method"`
+	Host    *StringMatch  `yaml:"host" json:"host"`
+	Headers []HeaderMatch `yaml:"headers" json:"headers"`
+
+	Any []MatchConfig `yaml:"any" json:"any"`
+	All []MatchConfig `yaml:"all" json:"all"`
+	Not *MatchConfig  `yaml:"not" json:"not"`
+}
+
+// StringMatch matches one string value. Exactly one of Exact, Prefix, Regex
+// or Glob must be set. Regex and Glob must match the whole value.
+//
+// Glob patterns use "*" for any run of characters except "/", "**" for any
+// run of characters including "/", and "?" for a single character other than "/".
+type StringMatch struct {
+	Exact      string `yaml:"exact" json:"exact"`
+	Prefix     string `yaml:"prefix" json:"prefix"`
+	Regex      string `yaml:"regex" json:"regex"`
+	Glob       string `yaml:"glob" json:"glob"`
+	IgnoreCase bool   `yaml:"ignoreCase" json:"ignoreCase"`
+}
+
+// HeaderMatch matches the value of a named header.
+// With Present set to false it matches requests that do NOT have the header.
+type HeaderMatch struct {
+	Name        string `yaml:"name" json:"name"`
+	Present     *bool  `yaml:"present" json:"present"`
+	StringMatch `yaml:",inline" json:",inline"`
+}
+
+// CompileMatcher turns a MatchConfig into a Matcher.
+// A nil config compiles to a matcher that matches everything.
+func CompileMatcher(cfg *MatchConfig) (Matcher, error) {
+	if cfg == nil {
+		return matchAll{}, nil
+	}
+
+	var matchers allMatcher
+	if cfg.Path != nil {
+		m, err := compileStringMatcher(*cfg.Path)
+		if err != nil {
+			return nil, fmt.Errorf("path: %w", err)
+		}
+		matchers = append(matchers, &pathMatcher{value: m})
+	}
+	if cfg.Method != nil {
+		m, err := compileStringMatcher(*cfg.Method)
+		if err != nil {
+			return nil, fmt.Errorf("method: %w", err)
+		}
+		matchers = append(matchers, &headerMatcher{name: ":method", value: m})
+	}
+	if cfg.Host != nil {
+		m, err := compileStringMatcher(*cfg.Host)
+		if err != nil {
+			return nil, fmt.Errorf("host: %w", err)
+		}
+		matchers = append(matchers, &hostMatcher{value: m})
+	}
+	for i, h := range cfg.Headers {
+		m, err := compileHeaderMatcher(h)
+		if err != nil {
+			return nil, fmt.Errorf("headers[%d]: %w", i, err)
+		}
+		matchers = append(matchers, m)
+	}
+	if len(cfg.All) > 0 {
+		var all allMatcher
+		for i := range cfg.All {
+			m, err := CompileMatcher(&cfg.All[i])
+			if err != nil {
+				return nil, fmt.Errorf("all[%d]: %w", i, err)
+			}
+			all = append(all, m)
+		}
+		matchers = append(matchers, all)
+	}
+	if len(cfg.Any) > 0 {
+		var anyOf anyMatcher
+		for i := range cfg.Any {
+			m, err := CompileMatcher(&cfg.Any[i])
+			if err != nil {
+				return nil, fmt.Errorf("any[%d]: %w", i, err)
+			}
+			anyOf = append(anyOf, m)
+		}
+		matchers = append(matchers, anyOf)
+	}
+	if cfg.Not != nil {
+		m, err := CompileMatcher(cfg.Not)
+		if err != nil {
+			return nil, fmt.Errorf("not: %w", err)
+		}
+		matchers = append(matchers, notMatcher{inner: m})
+	}
+
+	switch len(matchers) {
+	case 0:
+		return matchAll{}, nil
+	case 1:
+		return matchers[0], nil
+	default:
+		return matchers, nil
+	}
+}
+
+// matchAll matches every request
+type matchAll struct{}
+
+func (matchAll) Match(*extprocv3.HttpHeaders) bool { return true }
+
+// allMatcher matches when every inner matcher matches
+type allMatcher []Matcher
+
+func (m allMatcher) Match(headers *extprocv3.HttpHeaders) bool {
+	for _, inner := range m {
+		if !inner.Match(headers) {
+			return false
+		}
+	}
+	return true
+}
+
+// anyMatcher matches when at least one inner matcher matches
+type anyMatcher []Matcher
+
+func (m anyMatcher) Match(headers *extprocv3.HttpHeaders) bool {
+	for _, inner := range m {
+		if inner.Match(headers) {
+			return true
+		}
+	}
+	return false
+}
+
+// notMatcher inverts another matcher
+type notMatcher struct {
+	inner Matcher
+}
+
+func (m notMatcher) Match(headers *extprocv3.HttpHeaders) bool {
+	return !m.inner.Match(headers)
+}
+
+// headerMatcher matches the value of one header (or pseudo-header)
+type headerMatcher struct {
+	name  string
+	value stringMatcher
+}
+
+func (m *headerMatcher) Match(headers *extprocv3.HttpHeaders) bool {
+	value, ok := getHeader(headers, m.name)
+	return ok && m.value(value)
+}
+
+// presenceMatcher checks whether a header is present at all
+type presenceMatcher struct {
+	name    string
+	present bool
+}
+
+func (m *presenceMatcher) Match(headers *extprocv3.HttpHeaders) bool {
+	_, ok := getHeader(headers, m.name)
+	return ok == m.present
+}
+
+// pathMatcher matches :path without the query string
+type pathMatcher struct {
+	value stringMatcher
+}
+
+func (m *pathMatcher) Match(headers *extprocv3.HttpHeaders) bool {
+	path, ok := getHeader(headers, ":path")
+	if !ok {
+		return false
+	}
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	return m.value(path)
+}
+
+// hostMatcher matches :authority (or host) without the port
+type hostMatcher struct {
+	value stringMatcher
+}
+
+func (m *hostMatcher) Match(headers *extprocv3.HttpHeaders) bool {
+	host, ok := getHeader(headers, ":authority")
+	if !ok {
+		host, ok = getHeader(headers, "host")
+	}
+	if !ok {
+		return false
+	}
+	if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.HasSuffix(host, "]") {
+		host = host[:i]
+	}
+	return m.value(host)
+}
+
+func compileHeaderMatcher(h HeaderMatch) (Matcher, error) {
+	if h.Name == "" {
+		return nil, fmt.Errorf("header name is required")
+	}
+	name := strings.ToLower(h.Name)
+	if h.Present != nil {
+		if h.StringMatch != (StringMatch{}) {
+			return nil, fmt.Errorf("header %q: present cannot be combined with a value match", h.Name)
+		}
+		return &presenceMatcher{name: name, present: *h.Present}, nil
+	}
+	if h.StringMatch == (StringMatch{}) {
+		// Just a name: match if the header is there
+		return &presenceMatcher{name: name, present: true}, nil
+	}
+	m, err := compileStringMatcher(h.StringMatch)
+	if err != nil {
+		return nil, fmt.Errorf("header %q: %w", h.Name, err)
+	}
+	return &headerMatcher{name: name, value: m}, nil
+}
+
+// stringMatcher is a compiled StringMatch
+type stringMatcher func(value string) bool
+
+func compileStringMatcher(s StringMatch) (stringMatcher, error) {
+	set := 0
+	for _, v := range []string{s.Exact, s.Prefix, s.Regex, s.Glob} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, fmt.Errorf("exactly one of exact, prefix, regex or glob must be set")
+	}
+
+	switch {
+	case s.Exact != "":
+		if s.IgnoreCase {
+			return func(v string) bool { return strings.EqualFold(v, s.Exact) }, nil
+		}
+		return func(v string) bool { return v == s.Exact }, nil
+
+	case s.Prefix != "":
+		if s.IgnoreCase {
+			prefix := strings.ToLower(s.Prefix)
+			return func(v string) bool { return strings.HasPrefix(strings.ToLower(v), prefix) }, nil
+		}
+		return func(v string) bool { return strings.HasPrefix(v, s.Prefix) }, nil
+
+	case s.Regex != "":
+		// Anchored like the other kinds, so "admin" doesn't match "/not-admin"
+		pattern := "^(?:" + s.Regex + ")$"
+		if s.IgnoreCase {
+			pattern = "(?i)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %w", s.Regex, err)
+		}
+		return re.MatchString, nil
+
+	default:
+		re, err := globToRegexp(s.Glob, s.IgnoreCase)
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %w", s.Glob, err)
+		}
+		return re.MatchString, nil
+	}
+}
+
+// globToRegexp converts a glob pattern to an anchored regular expression
+func globToRegexp(glob string, ignoreCase bool) (*regexp.Regexp, error) {
+	var b strings.Builder
+	if ignoreCase {
+		b.WriteString("(?i)")
+	}
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch glob[i] {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// testHeaders builds request or response headers from name, value pairs
+func testHeaders(pairs ...string) *extprocv3.HttpHeaders {
+	headers := &corev3.HeaderMap{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		headers.Headers = append(headers.Headers, &corev3.HeaderValue{Key: pairs[i], Value: pairs[i+1]})
+	}
+	return &extprocv3.HttpHeaders{Headers: headers}
+}
+
+func TestMatcher(t *testing.T) {
+	present, absent := true, false
+	tests := []struct {
+		name    string
+		cfg     MatchConfig
+		headers []string
+		want    bool
+	}{
+		{"prefix", MatchConfig{Path: &StringMatch{Prefix: "/admin"}}, []string{":path", "/admin/users"}, true},
+		{"prefix ignores the query", MatchConfig{Path: &StringMatch{Prefix: "/admin"}}, []string{":path", "/?next=/admin"}, false},
+		{"prefix is not a substring", MatchConfig{Path: &StringMatch{Prefix: "/admin"}}, []string{":path", "/api/admin"}, false},
+		{"prefix ignoring case", MatchConfig{Path: &StringMatch{Prefix: "/Admin", IgnoreCase: true}}, []string{":path", "/ADMIN/x"}, true},
+
+		{"exact", MatchConfig{Path: &StringMatch{Exact: "/health"}}, []string{":path", "/health?full=1"}, true},
+		{"exact is not a prefix", MatchConfig{Path: &StringMatch{Exact: "/health"}}, []string{":path", "/healthz"}, false},
+		{"exact is case sensitive", MatchConfig{Path: &StringMatch{Exact: "/health"}}, []string{":path", "/Health"}, false},
+
+		{"glob star", MatchConfig{Path: &StringMatch{Glob: "/users/*/orders"}}, []string{":path", "/users/42/orders"}, true},
+		{"glob star stops at a slash", MatchConfig{Path: &StringMatch{Glob: "/users/*/orders"}}, []string{":path", "/users/42/x/orders"}, false},
+		{"glob double star", MatchConfig{Path: &StringMatch{Glob: "/static/**"}}, []string{":path", "/static/css/app.css"}, true},
+		{"glob question mark", MatchConfig{Path: &StringMatch{Glob: "/v?/items"}}, []string{":path", "/v2/items"}, true},
+		{"glob is anchored", MatchConfig{Path: &StringMatch{Glob: "/v?/items"}}, []string{":path", "/v2/items/3"}, false},
+		{"glob quotes regex characters", MatchConfig{Path: &StringMatch{Glob: "/a.b"}}, []string{":path", "/axb"}, false},
+
+		{"regex", MatchConfig{Path: &StringMatch{Regex: "/orders/[0-9]+"}}, []string{":path", "/orders/17"}, true},
+		{"regex must match the start", MatchConfig{Path: &StringMatch{Regex: "/orders/[0-9]+"}}, []string{":path", "/api/orders/17"}, false},
+		{"regex must match the end", MatchConfig{Path: &StringMatch{Regex: "/orders/[0-9]+"}}, []string{":path", "/orders/17/items"}, false},
+		{"regex alternation is anchored as a whole", MatchConfig{Method: &StringMatch{Regex: "PATCH|DELETE"}}, []string{":method", "DELETED"}, false},
+		{"regex ignoring case", MatchConfig{Method: &StringMatch{Regex: "patch|delete", IgnoreCase: true}}, []string{":method", "DELETE"}, true},
+		{"explicitly anchored regex", MatchConfig{Method: &StringMatch{Regex: "^(PATCH|DELETE)$"}}, []string{":method", "PATCH"}, true},
+
+		{"method", MatchConfig{Method: &StringMatch{Exact: "POST"}}, []string{":method", "POST"}, true},
+		{"other method", MatchConfig{Method: &StringMatch{Exact: "POST"}}, []string{":method", "GET"}, false},
+		{"no method", MatchConfig{Method: &StringMatch{Exact: "POST"}}, []string{":path", "/"}, false},
+
+		{"header value", MatchConfig{Headers: []HeaderMatch{{Name: "X-Tenant", StringMatch: StringMatch{Glob: "team-*"}}}}, []string{"x-tenant", "team-a"}, true},
+		{"header value does not match", MatchConfig{Headers: []HeaderMatch{{Name: "x-tenant", StringMatch: StringMatch{Glob: "team-*"}}}}, []string{"x-tenant", "ops"}, false},
+		{"header missing", MatchConfig{Headers: []HeaderMatch{{Name: "x-tenant", StringMatch: StringMatch{Glob: "team-*"}}}}, nil, false},
+		{"header name only", MatchConfig{Headers: []HeaderMatch{{Name: "x-tenant"}}}, []string{"x-tenant", ""}, true},
+		{"header present", MatchConfig{Headers: []HeaderMatch{{Name: "x-tenant", Present: &present}}}, nil, false},
+		{"header absent", MatchConfig{Headers: []HeaderMatch{{Name: "x-tenant", Present: &absent}}}, nil, true},
+
+		{"host ignores the port", MatchConfig{Host: &StringMatch{Glob: "*.example.com"}}, []string{":authority", "api.example.com:8443"}, true},
+		{"host falls back to the host header", MatchConfig{Host: &StringMatch{Exact: "example.com"}}, []string{"host", "example.com"}, true},
+		{"IPv6 host", MatchConfig{Host: &StringMatch{Exact: "[::1]"}}, []string{":authority", "[::1]"}, true},
+
+		{"fields are ANDed", MatchConfig{Path: &StringMatch{Prefix: "/admin"}, Method: &StringMatch{Exact: "POST"}}, []string{":path", "/admin", ":method", "GET"}, false},
+		{"any", MatchConfig{Any: []MatchConfig{{Method: &StringMatch{Exact: "POST"}}, {Method: &StringMatch{Exact: "PUT"}}}}, []string{":method", "PUT"}, true},
+		{"not", MatchConfig{Not: &MatchConfig{Method: &StringMatch{Exact: "GET"}}}, []string{":method", "GET"}, false},
+		{"empty matches everything", MatchConfig{}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := CompileMatcher(&tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.Match(testHeaders(tt.headers...)); got != tt.want {
+				t.Errorf("Match(%v) = %v, want %v", tt.headers, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileMatcherErrors(t *testing.T) {
+	present := true
+	invalid := map[string]MatchConfig{
+		"no kind":           {Path: &StringMatch{}},
+		"two kinds":         {Path: &StringMatch{Exact: "/", Prefix: "/"}},
+		"bad regex":         {Method: &StringMatch{Regex: "("}},
+		"header name":       {Headers: []HeaderMatch{{StringMatch: StringMatch{Exact: "x"}}}},
+		"present and value": {Headers: []HeaderMatch{{Name: "x", Present: &present, StringMatch: StringMatch{Exact: "x"}}}},
+		"nested":            {Any: []MatchConfig{{Not: &MatchConfig{Host: &StringMatch{}}}}},
+	}
+	for name, cfg := range invalid {
+		if _, err := CompileMatcher(&cfg); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics are the service's Prometheus metrics, served in the text format
+// on :8080/metrics. They live for the whole process, across config reloads.
+type Metrics struct {
+	// ActiveStreams is the number of ext_proc streams (HTTP requests) open right now
+	ActiveStreams *gauge
+	// Messages counts messages received from Gloo, by phase
+	Messages *counterVec
+	// Responses counts replies sent to Gloo by type: continue (no
+	// changes), mutation (headers or body changed) or immediate (rejected)
+	Responses *counterVec
+	// MessageDuration is the time spent on one message, from receiving it
+	// to sending the reply, by phase. This is the latency the hop adds.
+	MessageDuration *histogramVec
+	// ProcessorDuration is the time each processor took, by processor and phase
+	ProcessorDuration *histogramVec
+	// Rejections counts immediate responses, by reason and status
+	Rejections *counterVec
+	// StreamErrors counts failed Recv and Send calls, by gRPC code
+	StreamErrors *counterVec
+	// Spans counts trace spans by what happened to them: exported,
+	// failed (the collector could not be reached) or dropped (queue full)
+	Spans *counterVec
+	// AuditRecords counts audit log records, written or failed
+	AuditRecords *counterVec
+	// TLSRejections counts client certificates that were turned away after
+	// chain verification, by reason
+	TLSRejections *counterVec
+	// Panics counts recovered panics, by processor, or "grpc" for panics
+	// outside the processors
+	Panics *counterVec
+	// ProcessorFailures counts processors that panicked or returned an
+	// error, by processor and the policy applied (open or closed)
+	ProcessorFailures *counterVec
+	// MessageDeadlines counts messages that ran long, by phase and what was
+	// done: extended (Envoy asked for more time) or fallback (deadline missed)
+	MessageDeadlines *counterVec
+
+	collectors []collector
+}
+
+// latencyBuckets suit work that usually takes microseconds but can wait on
+// a JWKS fetch or a rate limit store
+var latencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// metrics is the process-wide set of metrics
+var metrics = NewMetrics()
+
+// NewMetrics creates the metric set, all at zero
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		ActiveStreams: newGauge("extproc_active_streams",
+			"Number of ext_proc streams currently open."),
+		Messages: newCounterVec("extproc_messages_received_total",
+			"Messages received from Gloo, by phase.", "phase"),
+		Responses: newCounterVec("extproc_responses_sent_total",
+			"Responses sent to Gloo, by type (continue, mutation, immediate).", "type"),
+		MessageDuration: newHistogramVec("extproc_message_duration_seconds",
+			"Time from receiving a message to sending its response, by phase.", latencyBuckets, "phase"),
+		ProcessorDuration: newHistogramVec("extproc_processor_duration_seconds",
+			"Time spent in each processor, by processor and phase.", latencyBuckets, "processor", "phase"),
+		Rejections: newCounterVec("extproc_rejections_total",
+			"Requests answered with an immediate response, by reason and status.", "reason", "status"),
+		StreamErrors: newCounterVec("extproc_stream_errors_total",
+			"Failed Recv and Send calls on ext_proc streams, by operation and gRPC code.", "operation", "code"),
+		Spans: newCounterVec("extproc_trace_spans_total",
+			"Trace spans by result (exported, failed, dropped).", "result"),
+		AuditRecords: newCounterVec("extproc_audit_records_total",
+			"Audit log records by result (written, failed).", "result"),
+		TLSRejections: newCounterVec("extproc_tls_rejections_total",
+			"TLS clients rejected after certificate verification, by reason (not_allowed).", "reason"),
+		Panics: newCounterVec("extproc_panics_recovered_total",
+			"Recovered panics, by processor (grpc for panics outside the processors).", "source"),
+		ProcessorFailures: newCounterVec("extproc_processor_failures_total",
+			"Processors that panicked or returned an error, by processor and failure policy (open, closed).", "processor", "policy"),
+		MessageDeadlines: newCounterVec("extproc_message_deadline_total",
+			"Messages that ran long, by phase and result (extended, fallback).", "phase", "result"),
+	}
+	m.collectors = []collector{
+		m.ActiveStreams, m.Messages, m.Responses, m.MessageDuration,
+		m.ProcessorDuration, m.Rejections, m.StreamErrors, m.Spans,
+		m.AuditRecords, m.TLSRejections, m.Panics, m.ProcessorFailures,
+		m.MessageDeadlines,
+	}
+	return m
+}
+
+// ServeHTTP writes every metric in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes every metric in the Prometheus text format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	for _, c := range m.collectors {
+		c.write(&b)
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// collector is one metric family
+type collector interface {
+	write(b *strings.Builder)
+}
+
+// gauge is a metric without labels that goes up and down
+type gauge struct {
+	name, help string
+	value      atomic.Int64
+}
+
+func newGauge(name, help string) *gauge {
+	return &gauge{name: name, help: help}
+}
+
+func (g *gauge) Inc() { g.value.Add(1) }
+func (g *gauge) Dec() { g.value.Add(-1) }
+
+// Value returns the current value
+func (g *gauge) Value() int64 { return g.value.Load() }
+
+func (g *gauge) write(b *strings.Builder) {
+	writeHeader(b, g.name, g.help, "gauge")
+	fmt.Fprintf(b, "%s %d\n", g.name, g.value.Load())
+}
+
+// series is the state shared by labelled metrics: one entry per distinct
+// set of label values
+type series[T any] struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]*T
+	keys   map[string][]string
+}
+
+func (s *series[T]) get(values []string, create func() *T) *T {
+	if len(values) != len(s.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", s.name, len(values), len(s.labels)))
+	}
+	key := strings.Join(values, "\xff")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[key]
+	if !ok {
+		v = create()
+		s.values[key] = v
+		s.keys[key] = append([]string(nil), values...)
+	}
+	return v
+}
+
+// each calls fn for every series, sorted by label values so the output is stable
+func (s *series[T]) each(fn func(labels string, v *T)) {
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.values))
+	for k := range s.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	type entry struct {
+		labels []string
+		value  *T
+	}
+	entries := make([]entry, len(keys))
+	for i, k := range keys {
+		entries[i] = entry{s.keys[k], s.values[k]}
+	}
+	s.mu.Unlock()
+
+	for _, e := range entries {
+		fn(formatLabels(s.labels, e.labels), e.value)
+	}
+}
+
+// counterVec is a counter with labels
+type counterVec struct {
+	series[atomic.Uint64]
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{series[atomic.Uint64]{
+		name: name, help: help, labels: labels,
+		values: map[string]*atomic.Uint64{}, keys: map[string][]string{},
+	}}
+}
+
+// Inc adds one to the counter for the given label values
+func (c *counterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds n to the counter for the given label values
+func (c *counterVec) Add(n uint64, values ...string) {
+	c.get(values, func() *atomic.Uint64 { return new(atomic.Uint64) }).Add(n)
+}
+
+// Value returns the count for the given label values
+func (c *counterVec) Value(values ...string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := c.values[strings.Join(values, "\xff")]; ok {
+		return v.Load()
+	}
+	return 0
+}
+
+func (c *counterVec) write(b *strings.Builder) {
+	writeHeader(b, c.name, c.help, "counter")
+	c.each(func(labels string, v *atomic.Uint64) {
+		fmt.Fprintf(b, "%s%s %d\n", c.name, wrapLabels(labels), v.Load())
+	})
+}
+
+// histogramVec is a histogram with labels
+type histogramVec struct {
+	series[histogram]
+	buckets []float64
+}
+
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64 // per bucket, not cumulative; the last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		series: series[histogram]{
+			name: name, help: help, labels: labels,
+			values: map[string]*histogram{}, keys: map[string][]string{},
+		},
+		buckets: buckets,
+	}
+}
+
+// Observe records a duration for the given label values
+func (h *histogramVec) Observe(d time.Duration, values ...string) {
+	hist := h.get(values, func() *histogram {
+		return &histogram{counts: make([]uint64, len(h.buckets)+1)}
+	})
+	v := d.Seconds()
+	i := sort.SearchFloat64s(h.buckets, v)
+	hist.mu.Lock()
+	hist.counts[i]++
+	hist.sum += v
+	hist.count++
+	hist.mu.Unlock()
+}
+
+func (h *histogramVec) write(b *strings.Builder) {
+	writeHeader(b, h.name, h.help, "histogram")
+	h.each(func(labels string, hist *histogram) {
+		hist.mu.Lock()
+		counts := append([]uint64(nil), hist.counts...)
+		sum, count := hist.sum, hist.count
+		hist.mu.Unlock()
+
+		var cumulative uint64
+		for i, c := range counts {
+			cumulative += c
+			le := "+Inf"
+			if i < len(h.buckets) {
+				le = formatFloat(h.buckets[i])
+			}
+			fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, wrapLabels(joinLabels(labels, `le="`+le+`"`)), cumulative)
+		}
+		fmt.Fprintf(b, "%s_sum%s %s\n", h.name, wrapLabels(labels), formatFloat(sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", h.name, wrapLabels(labels), count)
+	})
+}
+
+func writeHeader(b *strings.Builder, name, help, kind string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders name="value" pairs, escaped as the text format requires
+func formatLabels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func wrapLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	m := NewMetrics()
+	m.ActiveStreams.Inc()
+	m.ActiveStreams.Inc()
+	m.ActiveStreams.Dec()
+	m.Messages.Inc("response_headers")
+	m.Messages.Inc("request_headers")
+	m.Messages.Inc("request_headers")
+	m.Rejections.Inc(`odd "reason"\`+"\n", "403")
+	m.MessageDuration.Observe(250*time.Millisecond, "request_headers")
+	m.MessageDuration.Observe(2*time.Second, "request_headers")
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if got := w.Header().Get("Content-Type"); got != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("content type %q", got)
+	}
+	out := w.Body.String()
+
+	// Series come sorted by label values; label values are escaped; the
+	// histogram buckets are cumulative and le is inclusive
+	for _, want := range []string{
+		"# HELP extproc_active_streams Number of ext_proc streams currently open.\n# TYPE extproc_active_streams gauge\nextproc_active_streams 1\n",
+		"# TYPE extproc_messages_received_total counter\n" +
+			`extproc_messages_received_total{phase="request_headers"} 2` + "\n" +
+			`extproc_messages_received_total{phase="response_headers"} 1` + "\n",
+		`extproc_rejections_total{reason="odd \"reason\"\\\n",status="403"} 1` + "\n",
+		"# TYPE extproc_message_duration_seconds histogram\n",
+		`extproc_message_duration_seconds_bucket{phase="request_headers",le="0.1"} 0` + "\n" +
+			`extproc_message_duration_seconds_bucket{phase="request_headers",le="0.25"} 1` + "\n" +
+			`extproc_message_duration_seconds_bucket{phase="request_headers",le="0.5"} 1` + "\n" +
+			`extproc_message_duration_seconds_bucket{phase="request_headers",le="1"} 1` + "\n" +
+			`extproc_message_duration_seconds_bucket{phase="request_headers",le="+Inf"} 2` + "\n" +
+			`extproc_message_duration_seconds_sum{phase="request_headers"} 2.25` + "\n" +
+			`extproc_message_duration_seconds_count{phase="request_headers"} 2` + "\n",
+		// Metrics nothing was recorded for still have their header
+		"# TYPE extproc_stream_errors_total counter\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("exposition lacks\n%s\ngot:\n%s", want, out)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("wrong number of label values did not panic")
+		}
+	}()
+	m.Messages.Inc("request_headers", "extra")
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/solo-io/go-utils/contextutils"
+	"go.uber.org/zap/zapcore"
+)
+
+// Options are the process settings. Each can be given as a flag or as an
+// environment variable; a flag wins over the environment.
+type Options struct {
+	// GRPCAddress is where the ext_proc server listens: host:port, or
+	// unix:/path/to/socket for a Unix domain socket
+	GRPCAddress string
+	// AdminAddress is the host:port of /health, /logging and /metrics
+	AdminAddress string
+
+	ConfigPath         string
+	ConfigPollInterval time.Duration
+
+	DrainPeriod     time.Duration
+	ShutdownTimeout time.Duration
+
+	LogLevel zapcore.Level
+
+	// TLS for the gRPC listener; plaintext when TLSCertFile is empty.
+	// TLSClientCAFile turns on mutual TLS, and the allow-lists narrow it
+	// down to particular callers.
+	TLSCertFile         string
+	TLSKeyFile          string
+	TLSClientCAFile     string
+	TLSAllowedSPIFFEIDs []string
+	TLSAllowedSANs      []string
+	TLSReloadInterval   time.Duration
+
+	// GRPC are the gRPC server limits
+	GRPC GRPCTuning
+
+	// One-shot helpers that run instead of the server
+	HashAPIKey   string
+	VerifyAudit  string
+	AuditKeyFile string
+}
+
+// envFlags maps the flags that can be set from the environment to their
+// variable names
+var envFlags = map[string]string{
+	"grpc-address":           "EXTPROC_GRPC_ADDRESS",
+	"admin-address":          "EXTPROC_ADMIN_ADDRESS",
+	"config":                 "EXTPROC_CONFIG",
+	"config-poll-interval":   "EXTPROC_CONFIG_POLL_INTERVAL",
+	"drain-period":           "EXTPROC_DRAIN_PERIOD",
+	"shutdown-timeout":       "EXTPROC_SHUTDOWN_TIMEOUT",
+	"log-level":              contextutils.LogLevelEnvName,
+	"tls-cert":               "EXTPROC_TLS_CERT",
+	"tls-key":                "EXTPROC_TLS_KEY",
+	"tls-client-ca":          "EXTPROC_TLS_CLIENT_CA",
+	"tls-allowed-spiffe-ids": "EXTPROC_TLS_ALLOWED_SPIFFE_IDS",
+	"tls-allowed-sans":       "EXTPROC_TLS_ALLOWED_SANS",
+	"tls-reload-interval":    "EXTPROC_TLS_RELOAD_INTERVAL",
+
+	"grpc-max-concurrent-streams":          "EXTPROC_GRPC_MAX_CONCURRENT_STREAMS",
+	"grpc-max-recv-msg-size":               "EXTPROC_GRPC_MAX_RECV_MSG_SIZE",
+	"grpc-max-send-msg-size":               "EXTPROC_GRPC_MAX_SEND_MSG_SIZE",
+	"grpc-connection-timeout":              "EXTPROC_GRPC_CONNECTION_TIMEOUT",
+	"grpc-keepalive-time":                  "EXTPROC_GRPC_KEEPALIVE_TIME",
+	"grpc-keepalive-timeout":               "EXTPROC_GRPC_KEEPALIVE_TIMEOUT",
+	"grpc-keepalive-min-time":              "EXTPROC_GRPC_KEEPALIVE_MIN_TIME",
+	"grpc-keepalive-permit-without-stream": "EXTPROC_GRPC_KEEPALIVE_PERMIT_WITHOUT_STREAM",
+	"grpc-max-connection-idle":             "EXTPROC_GRPC_MAX_CONNECTION_IDLE",
+	"grpc-max-connection-age":              "EXTPROC_GRPC_MAX_CONNECTION_AGE",
+	"grpc-max-connection-age-grace":        "EXTPROC_GRPC_MAX_CONNECTION_AGE_GRACE",
+}
+
+// ParseOptions reads the options from the command line and the
+// environment and checks them
+func ParseOptions(args []string, getenv func(string) string, output io.Writer) (*Options, error) {
+	o := &Options{}
+	var logLevel string
+	fs := flag.NewFlagSet("eag-extproc", flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.StringVar(&o.GRPCAddress, "grpc-address", ":9001", "ext_proc gRPC listen address: host:port or unix:/path/to/socket")
+	fs.StringVar(&o.AdminAddress, "admin-address", ":8080", "listen address (host:port) for /health, /logging and /metrics")
+	fs.StringVar(&o.ConfigPath, "config", "", "path to a YAML or JSON config file (default: built-in config)")
+	fs.DurationVar(&o.ConfigPollInterval, "config-poll-interval", 5*time.Second, "how often to check the config file for changes (0 to disable; SIGHUP always reloads)")
+	fs.DurationVar(&o.DrainPeriod, "drain-period", 5*time.Second, "on SIGTERM, how long to report NOT_SERVING while still serving, so traffic moves elsewhere")
+	fs.DurationVar(&o.ShutdownTimeout, "shutdown-timeout", 20*time.Second, "on SIGTERM, how long open streams get to finish after the drain period")
+	fs.StringVar(&logLevel, "log-level", "info", "log level: debug, info, warn or error; can be changed at runtime on /logging")
+	fs.StringVar(&o.TLSCertFile, "tls-cert", "", "PEM certificate (chain) for the gRPC listener; enables TLS")
+	fs.StringVar(&o.TLSKeyFile, "tls-key", "", "PEM private key for -tls-cert")
+	fs.StringVar(&o.TLSClientCAFile, "tls-client-ca", "", "PEM CA bundle; clients must present a certificate signed by it (mutual TLS)")
+	fs.Var((*listFlag)(&o.TLSAllowedSPIFFEIDs), "tls-allowed-spiffe-ids", "comma-separated SPIFFE IDs allowed to call; one * matches any run of characters")
+	fs.Var((*listFlag)(&o.TLSAllowedSANs), "tls-allowed-sans", "comma-separated DNS, URI, IP or email SANs allowed to call; one * matches any run of characters")
+	fs.DurationVar(&o.TLSReloadInterval, "tls-reload-interval", 10*time.Second, "how often to check the TLS files for changes (0 to disable)")
+	o.GRPC.addFlags(fs)
+	fs.StringVar(&o.HashAPIKey, "hash-api-key", "", "print the store hash for an API key and exit")
+	fs.StringVar(&o.VerifyAudit, "verify-audit", "", "check the HMAC chain of an audit log file and exit (key from -audit-key-file)")
+	fs.StringVar(&o.AuditKeyFile, "audit-key-file", "", "file holding the audit log HMAC key, for -verify-audit")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of eag-extproc:\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), "\nEnvironment variables (flags take precedence):\n")
+		fs.VisitAll(func(f *flag.Flag) {
+			if env, ok := envFlags[f.Name]; ok {
+				fmt.Fprintf(fs.Output(), "  %-46s -%s\n", env, f.Name)
+			}
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	// Fill in whatever wasn't given on the command line from the environment
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		env, ok := envFlags[f.Name]
+		if !ok || set[f.Name] || err != nil {
+			return
+		}
+		if v := getenv(env); v != "" {
+			if setErr := fs.Set(f.Name, v); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %v", v, env, setErr)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := o.LogLevel.UnmarshalText([]byte(logLevel)); err != nil {
+		return nil, fmt.Errorf("-log-level: %v", err)
+	}
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *Options) validate() error {
+	network, address, err := parseListenAddress(o.GRPCAddress)
+	if err != nil {
+		return fmt.Errorf("-grpc-address: %w", err)
+	}
+	if err := checkTCPAddress(o.AdminAddress); err != nil {
+		return fmt.Errorf("-admin-address: %w", err)
+	}
+	if network == "tcp" && sameTCPPort(address, o.AdminAddress) {
+		return fmt.Errorf("-grpc-address and -admin-address can't use the same port")
+	}
+	if o.ConfigPath != "" {
+		if _, err := os.Stat(o.ConfigPath); err != nil {
+			return fmt.Errorf("-config: %w", err)
+		}
+	}
+	if o.ConfigPollInterval < 0 {
+		return fmt.Errorf("-config-poll-interval must not be negative")
+	}
+	if o.DrainPeriod < 0 || o.ShutdownTimeout < 0 {
+		return fmt.Errorf("-drain-period and -shutdown-timeout must not be negative")
+	}
+	if err := o.GRPC.validate(); err != nil {
+		return err
+	}
+	return o.validateTLS()
+}
+
+func (o *Options) validateTLS() error {
+	if (o.TLSCertFile == "") != (o.TLSKeyFile == "") {
+		return fmt.Errorf("-tls-cert and -tls-key must be set together")
+	}
+	if o.TLSClientCAFile != "" && o.TLSCertFile == "" {
+		return fmt.Errorf("-tls-client-ca needs -tls-cert and -tls-key")
+	}
+	if (len(o.TLSAllowedSPIFFEIDs) > 0 || len(o.TLSAllowedSANs) > 0) && o.TLSClientCAFile == "" {
+		return fmt.Errorf("-tls-allowed-spiffe-ids and -tls-allowed-sans need -tls-client-ca")
+	}
+	for _, id := range o.TLSAllowedSPIFFEIDs {
+		if !strings.HasPrefix(id, "spiffe://") {
+			return fmt.Errorf("-tls-allowed-spiffe-ids: %q is not a spiffe:// ID", id)
+		}
+	}
+	for _, list := range [][]string{o.TLSAllowedSPIFFEIDs, o.TLSAllowedSANs} {
+		for _, p := range list {
+			if strings.Count(p, "*") > 1 {
+				return fmt.Errorf("allow-list entry %q has more than one *", p)
+			}
+		}
+	}
+	if o.TLSReloadInterval < 0 {
+		return fmt.Errorf("-tls-reload-interval must not be negative")
+	}
+	return nil
+}
+
+// byteSize is a size flag in bytes that also takes KB, MB, GB (powers of
+// 1000) and KiB, MiB, GiB (powers of 1024) suffixes
+type byteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+	{"GB", 1e9}, {"MB", 1e6}, {"KB", 1e3}, {"B", 1},
+}
+
+func (b byteSize) String() string {
+	for _, u := range byteUnits[:3] {
+		if b != 0 && int64(b)%u.size == 0 {
+			return strconv.FormatInt(int64(b)/u.size, 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
+
+func (b *byteSize) Set(s string) error {
+	s = strings.TrimSpace(s)
+	unit := int64(1)
+	for _, u := range byteUnits {
+		if number, ok := strings.CutSuffix(s, u.suffix); ok {
+			s, unit = strings.TrimSpace(number), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/unit {
+		return fmt.Errorf("invalid size")
+	}
+	*b = byteSize(n * unit)
+	return nil
+}
+
+// listFlag is a comma-separated list flag; repeating the flag adds to it
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// parseListenAddress splits a listen address into a network and address
+// for net.Listen: "unix:/run/extproc.sock" is a Unix domain socket, and
+// anything else is host:port
+func parseListenAddress(s string) (network, address string, err error) {
+	if path, ok := strings.CutPrefix(s, "unix:"); ok {
+		// unix:///run/x.sock is accepted too, as gRPC target URIs write it
+		path = strings.TrimPrefix(path, "//")
+		if path == "" {
+			return "", "", fmt.Errorf("unix socket path is empty")
+		}
+		if len(path) > 107 {
+			return "", "", fmt.Errorf("unix socket path %q is longer than 107 bytes", path)
+		}
+		return "unix", path, nil
+	}
+	if err := checkTCPAddress(s); err != nil {
+		return "", "", err
+	}
+	return "tcp", s, nil
+}
+
+// checkTCPAddress checks a host:port listen address
+func checkTCPAddress(s string) error {
+	_, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return fmt.Errorf("%q is not host:port: %v", s, err)
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return fmt.Errorf("%q: invalid port %q", s, port)
+	}
+	return nil
+}
+
+// sameTCPPort reports whether two listen addresses would clash. Port 0
+// picks a free port, so it never clashes.
+func sameTCPPort(a, b string) bool {
+	hostA, portA, _ := net.SplitHostPort(a)
+	hostB, portB, _ := net.SplitHostPort(b)
+	if portA != portB || portA == "0" {
+		return false
+	}
+	return hostA == hostB || hostA == "" || hostB == "" || hostA == "0.0.0.0" || hostB == "0.0.0.0" || hostA == "::" || hostB == "::"
+}
+
+// listen opens the gRPC listener. A stale socket file left by a previous
+// run is removed first; the socket file is removed again when the
+// listener is closed.
+func listen(address string) (net.Listener, error) {
+	network, addr, err := parseListenAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" && !strings.HasPrefix(addr, "@") {
+		if info, err := os.Stat(addr); err == nil {
+			if info.Mode()&os.ModeSocket == 0 {
+				return nil, fmt.Errorf("%s exists and is not a socket", addr)
+			}
+			if conn, err := net.Dial("unix", addr); err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("%s is in use by another process", addr)
+			}
+			if err := os.Remove(addr); err != nil {
+				return nil, fmt.Errorf("removing stale socket: %w", err)
+			}
+		}
+	}
+	return net.Listen(network, addr)
+}
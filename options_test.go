@@ -0,0 +1,162 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func envFrom(vars map[string]string) func(string) string {
+	return func(name string) string { return vars[name] }
+}
+
+func TestParseOptions(t *testing.T) {
+	o, err := ParseOptions(nil, envFrom(nil), io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.GRPCAddress != ":9001" || o.AdminAddress != ":8080" || o.DrainPeriod != 5*time.Second || o.LogLevel != zapcore.InfoLevel {
+		t.Errorf("defaults %+v", o)
+	}
+
+	// The environment fills in what the command line leaves out, and a
+	// flag wins over its variable
+	env := envFrom(map[string]string{
+		"EXTPROC_GRPC_ADDRESS":  "unix:/run/extproc.sock",
+		"EXTPROC_ADMIN_ADDRESS": "127.0.0.1:9090",
+		"EXTPROC_DRAIN_PERIOD":  "1s",
+		"LOG_LEVEL":             "debug",
+	})
+	o, err = ParseOptions([]string{"-admin-address", ":9999", "-drain-period=2s"}, env, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.GRPCAddress != "unix:/run/extproc.sock" || o.LogLevel != zapcore.DebugLevel {
+		t.Errorf("grpc address %q, log level %v: want the environment's", o.GRPCAddress, o.LogLevel)
+	}
+	if o.AdminAddress != ":9999" || o.DrainPeriod != 2*time.Second {
+		t.Errorf("admin address %q, drain period %v: want the flags'", o.AdminAddress, o.DrainPeriod)
+	}
+
+	// A flag given explicitly wins even when it repeats the default
+	o, err = ParseOptions([]string{"-drain-period", "5s"}, env, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.DrainPeriod != 5*time.Second {
+		t.Errorf("drain period %v, want the flag's 5s", o.DrainPeriod)
+	}
+}
+
+func TestParseOptionsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{"bad environment value", nil, map[string]string{"EXTPROC_DRAIN_PERIOD": "soon"}, "EXTPROC_DRAIN_PERIOD"},
+		{"bad environment address", nil, map[string]string{"EXTPROC_GRPC_ADDRESS": "9001"}, "-grpc-address"},
+		{"extra arguments", []string{"serve"}, nil, "unexpected arguments: serve"},
+		{"unknown flag", []string{"-port", "9001"}, nil, "not defined"},
+		{"bad log level", []string{"-log-level", "loud"}, nil, "-log-level"},
+		{"no port", []string{"-admin-address", "localhost"}, nil, "-admin-address"},
+		{"bad port", []string{"-grpc-address", ":99999"}, nil, "invalid port"},
+		{"empty socket path", []string{"-grpc-address", "unix:"}, nil, "path is empty"},
+		{"long socket path", []string{"-grpc-address", "unix:/" + strings.Repeat("s", 107)}, nil, "longer than 107 bytes"},
+		{"same port", []string{"-grpc-address", ":8080"}, nil, "same port"},
+		{"same port on any address", []string{"-grpc-address", "127.0.0.1:9001", "-admin-address", "0.0.0.0:9001"}, nil, "same port"},
+		{"missing config", []string{"-config", "/nonexistent/config.yaml"}, nil, "-config"},
+		{"negative drain period", []string{"-drain-period", "-1s"}, nil, "must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseOptions(tt.args, envFrom(tt.env), io.Discard)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %v, want one mentioning %q", err, tt.want)
+			}
+		})
+	}
+
+	// Different hosts or a free port don't clash, nor does a Unix socket
+	for _, args := range [][]string{
+		{"-grpc-address", "127.0.0.1:8080", "-admin-address", "127.0.0.2:8080"},
+		{"-grpc-address", ":0", "-admin-address", ":0"},
+		{"-grpc-address", "unix:///run/extproc.sock", "-admin-address", ":9001"},
+	} {
+		if _, err := ParseOptions(args, envFrom(nil), io.Discard); err != nil {
+			t.Errorf("%v: %v", args, err)
+		}
+	}
+}
+
+func TestParseListenAddress(t *testing.T) {
+	tests := []struct {
+		address, network, path string
+	}{
+		{"unix:/run/extproc.sock", "unix", "/run/extproc.sock"},
+		{"unix:///run/extproc.sock", "unix", "/run/extproc.sock"},
+		{"unix:relative.sock", "unix", "relative.sock"},
+		{"unix:@extproc", "unix", "@extproc"},
+		{"127.0.0.1:9001", "tcp", "127.0.0.1:9001"},
+		{"[::1]:9001", "tcp", "[::1]:9001"},
+	}
+	for _, tt := range tests {
+		network, path, err := parseListenAddress(tt.address)
+		if err != nil || network != tt.network || path != tt.path {
+			t.Errorf("parseListenAddress(%q) = %q, %q, %v", tt.address, network, path, err)
+		}
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "extproc.sock")
+	lis, err := listen("unix:" + socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A socket someone is listening on is not taken over
+	if _, err := listen("unix:" + socket); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("second listener: %v, want in use", err)
+	}
+
+	// Closing the listener removes the socket file
+	lis.Close()
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Fatalf("socket file left after close: %v", err)
+	}
+
+	// A stale socket from a run that didn't clean up is replaced
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	if _, err := os.Stat(socket); err != nil {
+		t.Fatalf("stale socket missing: %v", err)
+	}
+	lis, err = listen("unix:" + socket)
+	if err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	lis.Close()
+
+	// A file that isn't a socket is left alone
+	writeTestFile(t, socket, []byte("data"))
+	if _, err := listen("unix:" + socket); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Errorf("regular file: %v, want not a socket", err)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// spanData is a finished span, ready to be encoded
+type spanData struct {
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	traceState string
+	name       string
+	kind       int
+	start, end time.Time
+	attrs      []spanAttr
+
+	statusError   bool
+	statusMessage string
+}
+
+// spanAttr is a span attribute; value is a string, int64, bool or float64
+type spanAttr struct {
+	key   string
+	value interface{}
+}
+
+// Span kinds from the OTLP protocol
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+func (d *spanData) attr(key string, value interface{}) {
+	d.attrs = append(d.attrs, spanAttr{key, value})
+}
+
+// fail marks the span as failed
+func (d *spanData) fail(message string) {
+	d.statusError = true
+	d.statusMessage = message
+}
+
+// encodeTraces builds an OTLP ExportTraceServiceRequest. The protobuf is
+// written by hand so the service doesn't need the OpenTelemetry SDK; the
+// field numbers are those of opentelemetry/proto/trace/v1/trace.proto.
+func encodeTraces(serviceName string, spans []*spanData) []byte {
+	var resource []byte
+	resource = appendMessage(resource, 1, encodeKeyValue("service.name", serviceName))
+
+	var scope []byte
+	scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+	scope = protowire.AppendString(scope, "eag-extproc")
+
+	var scopeSpans []byte
+	scopeSpans = appendMessage(scopeSpans, 1, scope)
+	for _, s := range spans {
+		scopeSpans = appendMessage(scopeSpans, 2, encodeSpan(s))
+	}
+
+	var resourceSpans []byte
+	resourceSpans = appendMessage(resourceSpans, 1, resource)
+	resourceSpans = appendMessage(resourceSpans, 2, scopeSpans)
+
+	return appendMessage(nil, 1, resourceSpans)
+}
+
+func encodeSpan(s *spanData) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendBytes(b, s.traceID[:])
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendBytes(b, s.spanID[:])
+	if s.traceState != "" {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, s.traceState)
+	}
+	if s.parentID != [8]byte{} {
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendBytes(b, s.parentID[:])
+	}
+	b = protowire.AppendTag(b, 5, protowire.BytesType)
+	b = protowire.AppendString(b, s.name)
+	b = protowire.AppendTag(b, 6, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(s.kind))
+	b = protowire.AppendTag(b, 7, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, uint64(s.start.UnixNano()))
+	b = protowire.AppendTag(b, 8, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, uint64(s.end.UnixNano()))
+	for _, a := range s.attrs {
+		b = appendMessage(b, 9, encodeKeyValue(a.key, a.value))
+	}
+	if s.statusError {
+		var status []byte
+		status = protowire.AppendTag(status, 2, protowire.BytesType)
+		status = protowire.AppendString(status, s.statusMessage)
+		status = protowire.AppendTag(status, 3, protowire.VarintType)
+		status = protowire.AppendVarint(status, 2) // STATUS_CODE_ERROR
+		b = appendMessage(b, 15, status)
+	}
+	return b
+}
+
+// encodeKeyValue encodes a KeyValue with its AnyValue
+func encodeKeyValue(key string, value interface{}) []byte {
+	var v []byte
+	switch x := value.(type) {
+	case string:
+		v = protowire.AppendTag(v, 1, protowire.BytesType)
+		v = protowire.AppendString(v, x)
+	case bool:
+		v = protowire.AppendTag(v, 2, protowire.VarintType)
+		v = protowire.AppendVarint(v, protowire.EncodeBool(x))
+	case int64:
+		v = protowire.AppendTag(v, 3, protowire.VarintType)
+		v = protowire.AppendVarint(v, uint64(x))
+	case float64:
+		v = protowire.AppendTag(v, 4, protowire.Fixed64Type)
+		v = protowire.AppendFixed64(v, math.Float64bits(x))
+	default:
+		v = protowire.AppendTag(v, 1, protowire.BytesType)
+		v = protowire.AppendString(v, fmt.Sprint(x))
+	}
+
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, key)
+	return appendMessage(b, 2, v)
+}
+
+func appendMessage(b []byte, field protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, field, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+// spanExporter sends an encoded ExportTraceServiceRequest to the collector
+type spanExporter interface {
+	Export(ctx context.Context, request []byte) error
+	Close()
+}
+
+// otlpHTTPExporter posts protobuf bodies to the collector's /v1/traces
+type otlpHTTPExporter struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func newOTLPHTTPExporter(endpoint string, headers map[string]string) *otlpHTTPExporter {
+	if u, err := url.Parse(endpoint); err == nil && (u.Path == "" || u.Path == "/") {
+		u.Path = "/v1/traces"
+		endpoint = u.String()
+	}
+	return &otlpHTTPExporter{url: endpoint, headers: headers, client: &http.Client{}}
+}
+
+func (e *otlpHTTPExporter) Export(ctx context.Context, request []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(request))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (e *otlpHTTPExporter) Close() {
+	e.client.CloseIdleConnections()
+}
+
+// otlpGRPCExporter calls TraceService/Export. The request is already
+// encoded, so it goes over the wire with a pass-through codec.
+type otlpGRPCExporter struct {
+	conn    *grpc.ClientConn
+	headers metadata.MD
+}
+
+func newOTLPGRPCExporter(endpoint string, plaintext bool, headers map[string]string) (*otlpGRPCExporter, error) {
+	creds := insecure.NewCredentials()
+	if !plaintext {
+		creds = credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	}
+	conn, err := grpc.Dial(endpoint,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(rawCodec{})))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", endpoint, err)
+	}
+	return &otlpGRPCExporter{conn: conn, headers: metadata.New(headers)}, nil
+}
+
+func (e *otlpGRPCExporter) Export(ctx context.Context, request []byte) error {
+	ctx = metadata.NewOutgoingContext(ctx, e.headers)
+	var reply []byte
+	return e.conn.Invoke(ctx, "/opentelemetry.proto.collector.trace.v1.TraceService/Export", &request, &reply)
+}
+
+func (e *otlpGRPCExporter) Close() {
+	e.conn.Close()
+}
+
+// rawCodec sends and receives messages that are already encoded
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return nil, fmt.Errorf("rawCodec: unexpected %T", v)
+	}
+	return *b, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("rawCodec: unexpected %T", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+// Name is the content-subtype; collectors only look at the bytes
+func (rawCodec) Name() string { return "proto" }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// Phase names one of the six kinds of message Gloo can send on a stream
+type Phase string
+
+const (
+	PhaseRequestHeaders   Phase = "request_headers"
+	PhaseResponseHeaders  Phase = "response_headers"
+	PhaseRequestBody      Phase = "request_body"
+	PhaseResponseBody     Phase = "response_body"
+	PhaseRequestTrailers  Phase = "request_trailers"
+	PhaseResponseTrailers Phase = "response_trailers"
+)
+
+// phaseOf reports which phase a ProcessingRequest belongs to
+func phaseOf(req *extprocv3.ProcessingRequest) (Phase, error) {
+	switch req.Request.(type) {
+	case *extprocv3.ProcessingRequest_RequestHeaders:
+		return PhaseRequestHeaders, nil
+	case *extprocv3.ProcessingRequest_ResponseHeaders:
+		return PhaseResponseHeaders, nil
+	case *extprocv3.ProcessingRequest_RequestBody:
+		return PhaseRequestBody, nil
+	case *extprocv3.ProcessingRequest_ResponseBody:
+		return PhaseResponseBody, nil
+	case *extprocv3.ProcessingRequest_RequestTrailers:
+		return PhaseRequestTrailers, nil
+	case *extprocv3.ProcessingRequest_ResponseTrailers:
+		return PhaseResponseTrailers, nil
+	default:
+		return "", fmt.Errorf("unsupported ext_proc message type %T", req.Request)
+	}
+}
+
+// handleMessage runs the processor chain for one message from Gloo and
+// builds the matching reply. Every phase gets a reply of its own type,
+// even when no processor changed anything; Envoy waits for that reply
+// before it lets the HTTP request continue. If a processor rejected the
+// request, the reply is an ImmediateResponse instead.
+func handleMessage(chain *Chain, sc *StreamContext, req *extprocv3.ProcessingRequest) (*extprocv3.ProcessingResponse, error) {
+	trackMessage(sc, req)
+	return runMessage(chain, sc, req)
+}
+
+// trackMessage records what a message says about the stream: the headers,
+// for the later phases, and the position in each body
+func trackMessage(sc *StreamContext, req *extprocv3.ProcessingRequest) {
+	switch r := req.Request.(type) {
+	case *extprocv3.ProcessingRequest_RequestHeaders:
+		sc.RequestHeaders = r.RequestHeaders
+		sc.RequestBody.Expected = !r.RequestHeaders.GetEndOfStream()
+	case *extprocv3.ProcessingRequest_ResponseHeaders:
+		sc.ResponseHeaders = r.ResponseHeaders
+		sc.ResponseBody.Expected = !r.ResponseHeaders.GetEndOfStream()
+	case *extprocv3.ProcessingRequest_RequestBody:
+		sc.RequestBody.next(r.RequestBody)
+	case *extprocv3.ProcessingRequest_ResponseBody:
+		sc.ResponseBody.next(r.ResponseBody)
+	}
+}
+
+// runMessage runs the processor chain for a message trackMessage has
+// already recorded, and builds the reply
+func runMessage(chain *Chain, sc *StreamContext, req *extprocv3.ProcessingRequest) (*extprocv3.ProcessingResponse, error) {
+	phase, err := phaseOf(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *Result
+	switch r := req.Request.(type) {
+	case *extprocv3.ProcessingRequest_RequestHeaders:
+		result, err = chain.RequestHeaders(sc, r.RequestHeaders)
+
+	case *extprocv3.ProcessingRequest_ResponseHeaders:
+		result, err = chain.ResponseHeaders(sc, r.ResponseHeaders)
+
+	case *extprocv3.ProcessingRequest_RequestBody:
+		result, err = chain.RequestBody(sc, r.RequestBody)
+
+	case *extprocv3.ProcessingRequest_ResponseBody:
+		result, err = chain.ResponseBody(sc, r.ResponseBody)
+
+	case *extprocv3.ProcessingRequest_RequestTrailers:
+		result, err = chain.RequestTrailers(sc, r.RequestTrailers)
+
+	case *extprocv3.ProcessingRequest_ResponseTrailers:
+		result, err = chain.ResponseTrailers(sc, r.ResponseTrailers)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if result.ImmediateResponse != nil {
+		return &extprocv3.ProcessingResponse{
+			Response: &extprocv3.ProcessingResponse_ImmediateResponse{
+				ImmediateResponse: result.ImmediateResponse,
+			},
+		}, nil
+	}
+	return phaseResponse(phase, result), nil
+}
+
+// Response types counted in the extproc_responses_sent_total metric
+const (
+	ResponseContinue  = "continue"
+	ResponseMutation  = "mutation"
+	ResponseImmediate = "immediate"
+)
+
+// responseType says whether a reply rejects the request, changes it, or
+// lets it continue untouched
+func responseType(response *extprocv3.ProcessingResponse) string {
+	if response.GetImmediateResponse() != nil {
+		return ResponseImmediate
+	}
+	headers, body := responseMutations(response)
+	if len(headers.GetSetHeaders()) > 0 || len(headers.GetRemoveHeaders()) > 0 || body != nil {
+		return ResponseMutation
+	}
+	return ResponseContinue
+}
+
+// describeResponse summarizes a reply for the logs: what was decided and
+// how many changes were made
+func describeResponse(response *extprocv3.ProcessingResponse) []interface{} {
+	if immediate := response.GetImmediateResponse(); immediate != nil {
+		return []interface{}{"decision", "deny", "status", int(immediate.GetStatus().GetCode())}
+	}
+	headers, body := responseMutations(response)
+	return []interface{}{
+		"decision", "continue",
+		"headers_set", len(headers.GetSetHeaders()),
+		"headers_removed", len(headers.GetRemoveHeaders()),
+		"body_mutated", body != nil,
+	}
+}
+
+// responseMutations digs the header and body changes out of a phase reply
+func responseMutations(response *extprocv3.ProcessingResponse) (*extprocv3.HeaderMutation, *extprocv3.BodyMutation) {
+	var common *extprocv3.CommonResponse
+	switch r := response.Response.(type) {
+	case *extprocv3.ProcessingResponse_RequestHeaders:
+		common = r.RequestHeaders.GetResponse()
+	case *extprocv3.ProcessingResponse_ResponseHeaders:
+		common = r.ResponseHeaders.GetResponse()
+	case *extprocv3.ProcessingResponse_RequestBody:
+		common = r.RequestBody.GetResponse()
+	case *extprocv3.ProcessingResponse_ResponseBody:
+		common = r.ResponseBody.GetResponse()
+	case *extprocv3.ProcessingResponse_RequestTrailers:
+		return r.RequestTrailers.GetHeaderMutation(), nil
+	case *extprocv3.ProcessingResponse_ResponseTrailers:
+		return r.ResponseTrailers.GetHeaderMutation(), nil
+	}
+	return common.GetHeaderMutation(), common.GetBodyMutation()
+}
+
+// phaseResponse wraps a merged result in the reply type for its phase
+func phaseResponse(phase Phase, result *Result) *extprocv3.ProcessingResponse {
+	switch phase {
+	case PhaseRequestHeaders:
+		return &extprocv3.ProcessingResponse{
+			Response: &extprocv3.ProcessingResponse_RequestHeaders{
+				RequestHeaders: &extprocv3.HeadersResponse{Response: result.CommonResponse()},
+			},
+		}
+	case PhaseResponseHeaders:
+		return &extprocv3.ProcessingResponse{
+			Response: &extprocv3.ProcessingResponse_ResponseHeaders{
+				ResponseHeaders: &extprocv3.HeadersResponse{Response: result.CommonResponse()},
+			},
+		}
+	case PhaseRequestBody:
+		return &extprocv3.ProcessingResponse{
+			Response: &extprocv3.ProcessingResponse_RequestBody{
+				RequestBody: &extprocv3.BodyResponse{Response: result.CommonResponse()},
+			},
+		}
+	case PhaseResponseBody:
+		return &extprocv3.ProcessingResponse{
+			Response: &extprocv3.ProcessingResponse_ResponseBody{
+				ResponseBody: &extprocv3.BodyResponse{Response: result.CommonResponse()},
+			},
+		}
+	case PhaseRequestTrailers:
+		return &extprocv3.ProcessingResponse{
+			Response: &extprocv3.ProcessingResponse_RequestTrailers{
+				RequestTrailers: &extprocv3.TrailersResponse{HeaderMutation: result.HeaderMutation},
+			},
+		}
+	default:
+		return &extprocv3.ProcessingResponse{
+			Response: &extprocv3.ProcessingResponse_ResponseTrailers{
+				ResponseTrailers: &extprocv3.TrailersResponse{HeaderMutation: result.HeaderMutation},
+			},
+		}
+	}
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"github.com/solo-io/go-utils/contextutils"
+	"go.uber.org/zap"
+)
+
+// Processor is one step in the ExtProc pipeline.
+// Each method is a hook for one phase of the HTTP exchange that Gloo can
+// send us. A hook returns the changes it wants to make as a *Result,
+// or nil if it has nothing to change for this message.
+//
+// Embed BaseProcessor to get no-op implementations of every hook and only
+// override the phases you actually care about.
+type Processor interface {
+	// Name identifies the processor in logs and when enabling/disabling it
+	Name() string
+
+	RequestHeaders(sc *StreamContext, headers *extprocv3.HttpHeaders) (*Result, error)
+	ResponseHeaders(sc *StreamContext, headers *extprocv3.HttpHeaders) (*Result, error)
+	RequestBody(sc *StreamContext, body *extprocv3.HttpBody) (*Result, error)
+	ResponseBody(sc *StreamContext, body *extprocv3.HttpBody) (*Result, error)
+	RequestTrailers(sc *StreamContext, trailers *extprocv3.HttpTrailers) (*Result, error)
+	ResponseTrailers(sc *StreamContext, trailers *extprocv3.HttpTrailers) (*Result, error)
+}
+
+// accessCheck is implemented by the processors that decide whether a
+// request gets in at all. A message deadline never lets request headers
+// past one of them that hasn't answered.
+type accessCheck interface {
+	checksAccess()
+}
+
+// BaseProcessor implements every Processor hook as "no changes".
+// It does not implement Name, so embedding types still have to pick one.
+type BaseProcessor struct{}
+
+func (BaseProcessor) RequestHeaders(*StreamContext, *extprocv3.HttpHeaders) (*Result, error) {
+	return nil, nil
+}
+
+func (BaseProcessor) ResponseHeaders(*StreamContext, *extprocv3.HttpHeaders) (*Result, error) {
+	return nil, nil
+}
+
+func (BaseProcessor) RequestBody(*StreamContext, *extprocv3.HttpBody) (*Result, error) {
+	return nil, nil
+}
+
+func (BaseProcessor) ResponseBody(*StreamContext, *extprocv3.HttpBody) (*Result, error) {
+	return nil, nil
+}
+
+func (BaseProcessor) RequestTrailers(*StreamContext, *extprocv3.HttpTrailers) (*Result, error) {
+	return nil, nil
+}
+
+func (BaseProcessor) ResponseTrailers(*StreamContext, *extprocv3.HttpTrailers) (*Result, error) {
+	return nil, nil
+}
+
+// Result is what a single processor wants to change for one message.
+// The chain merges the results of all processors into one CommonResponse.
+//
+// If ImmediateResponse is set the request is rejected: the chain stops,
+// the changes of earlier processors are dropped, and Envoy answers the
+// client directly. Use Denial to build one.
+type Result struct {
+	HeaderMutation    *extprocv3.HeaderMutation
+	BodyMutation      *extprocv3.BodyMutation
+	ImmediateResponse *extprocv3.ImmediateResponse
+}
+
+// StreamContext carries per-stream state between the messages of one
+// Process stream. Gloo opens one stream per HTTP request, so anything stored
+// here is scoped to a single request/response exchange.
+type StreamContext struct {
+	context.Context
+
+	// RequestID identifies the request in logs, deny bodies and upstream.
+	// It is set as soon as the request headers arrive.
+	RequestID string
+
+	// Trace is this service's span in the request's W3C trace, or nil if
+	// trace context is turned off
+	Trace *TraceContext
+
+	// Phase is the phase of the message being processed
+	Phase Phase
+
+	// Span is the stream's trace span, or nil if tracing is off or the
+	// trace is not sampled
+	Span *Span
+
+	// Audit collects the stream's audit record, or is nil if the audit
+	// log is off
+	Audit *AuditEntry
+
+	// RequestHeaders holds the request headers once they have been received,
+	// so response-phase processors can still look at the original request
+	RequestHeaders *extprocv3.HttpHeaders
+
+	// ResponseHeaders holds the response headers once they have been received
+	ResponseHeaders *extprocv3.HttpHeaders
+
+	// RequestBody and ResponseBody track the position in each body
+	// as chunks arrive
+	RequestBody  BodyStream
+	ResponseBody BodyStream
+
+	// state lets processors keep their own data between messages
+	state map[string]interface{}
+
+	// extended marks the phases Envoy has already been asked to wait
+	// longer for
+	extended map[Phase]bool
+
+	// running is the index in the chain of the processor being run, on a
+	// fork a message deadline is watching
+	running *atomic.Int32
+
+	// kept collects, on such a fork, the values stored with KeepState
+	kept *keptState
+}
+
+// keptState holds the values a fork's processors stored with KeepState.
+// They may still be running when a fallback takes them over.
+type keptState struct {
+	mu    sync.Mutex
+	state map[string]interface{}
+}
+
+// NewStreamContext creates the per-stream state for a new Process stream
+func NewStreamContext(ctx context.Context) *StreamContext {
+	return &StreamContext{
+		Context:      ctx,
+		RequestBody:  BodyStream{Expected: true},
+		ResponseBody: BodyStream{Expected: true},
+	}
+}
+
+// Logger returns the stream's logger. It carries the request ID, method,
+// path and authority once the request headers have arrived, plus the
+// current phase, so all lines of one request can be found together.
+func (sc *StreamContext) Logger() *zap.SugaredLogger {
+	logger := contextutils.LoggerFrom(sc)
+	if sc.Phase != "" {
+		logger = logger.With("phase", sc.Phase)
+	}
+	return logger
+}
+
+// State returns the per-stream value a processor stored under key, or nil
+func (sc *StreamContext) State(key string) interface{} {
+	return sc.state[key]
+}
+
+// SetState stores a per-stream value for a processor. Use the processor
+// name as the key so processors don't overwrite each other's state.
+func (sc *StreamContext) SetState(key string, value interface{}) {
+	if sc.state == nil {
+		sc.state = map[string]interface{}{}
+	}
+	sc.state[key] = value
+}
+
+// KeepState stores a per-stream value like SetState, for facts that hold
+// whatever reply the message gets, such as quota a rate limiter has
+// already taken. Unlike other state, it is kept when a message deadline
+// sends its fallback in place of the processors' reply.
+func (sc *StreamContext) KeepState(key string, value interface{}) {
+	sc.SetState(key, value)
+	if sc.kept != nil {
+		sc.kept.mu.Lock()
+		sc.kept.state[key] = value
+		sc.kept.mu.Unlock()
+	}
+}
+
+// fork copies the stream context for processors that run on a goroutine
+// of their own while a message deadline is watching. If they finish in
+// time, join takes over all of their changes. If they miss the deadline,
+// their reply is replaced by the fallback and keep takes over only what
+// has to outlive it:
+//
+//   - values stored with KeepState, such as rate limit reservations
+//   - the rules audited before the deadline, so the record still shows
+//     which processors acted on the message
+//
+// Everything else they stored is dropped with their reply. Body bytes a
+// processor held back from earlier chunks are in sc, not the fork; the
+// fallback sends them (see bodyHolder).
+func (sc *StreamContext) fork(ctx context.Context) *StreamContext {
+	f := *sc
+	f.Context = ctx
+	f.state = make(map[string]interface{}, len(sc.state))
+	for k, v := range sc.state {
+		f.state[k] = v
+	}
+	f.Audit = sc.Audit.fork()
+	f.running = new(atomic.Int32)
+	f.kept = &keptState{state: map[string]interface{}{}}
+	return &f
+}
+
+// join takes over the changes of a fork whose processors finished in time
+func (sc *StreamContext) join(f *StreamContext) {
+	sc.state = f.state
+	sc.Audit.join(f.Audit)
+}
+
+// keep takes over what has to outlive a fallback from a fork whose
+// processors missed the deadline and may still be running
+func (sc *StreamContext) keep(f *StreamContext) {
+	f.kept.mu.Lock()
+	for k, v := range f.kept.state {
+		sc.SetState(k, v)
+	}
+	f.kept.mu.Unlock()
+	sc.Audit.join(f.Audit)
+}
+
+// chainEntry is one processor plus its on/off switch, the matcher that
+// decides which requests it runs for and what happens when it fails
+type chainEntry struct {
+	processor Processor
+	matcher   Matcher
+	enabled   bool
+	failOpen  bool
+}
+
+// Chain runs an ordered list of processors for each phase and merges
+// their results. Processors run in the order they were added.
+type Chain struct {
+	entries []*chainEntry
+
+	// ids assigns request IDs before any processor runs
+	ids *RequestIDProcessor
+
+	// tracer samples and exports spans, if tracing is configured
+	tracer *Tracer
+
+	// audit receives one record per request, if the audit log is configured
+	audit *AuditLog
+
+	// renderer answers requests whose processor failed closed
+	renderer *DenyRenderer
+
+	// deadline limits the time spent on each message, if configured
+	deadline *MessageDeadline
+}
+
+// NewChain builds a chain with all of the given processors enabled
+func NewChain(processors ...Processor) *Chain {
+	c := &Chain{}
+	for _, p := range processors {
+		c.Add(p)
+	}
+	return c
+}
+
+// Add appends an enabled processor that runs for every request
+func (c *Chain) Add(p Processor) {
+	c.AddWithMatcher(p, matchAll{})
+}
+
+// AddWithMatcher appends an enabled processor that only runs for requests
+// whose headers match m
+func (c *Chain) AddWithMatcher(p Processor, m Matcher) {
+	c.entries = append(c.entries, &chainEntry{processor: p, matcher: m, enabled: true})
+}
+
+// AddRequestID appends the request ID processor and makes it the one
+// Identify uses
+func (c *Chain) AddRequestID(p *RequestIDProcessor) {
+	c.ids = p
+	c.Add(p)
+}
+
+// SetTracer makes the chain record spans with t
+func (c *Chain) SetTracer(t *Tracer) {
+	c.tracer = t
+}
+
+// SetAuditLog makes the chain write an audit record for every request to l
+func (c *Chain) SetAuditLog(l *AuditLog) {
+	c.audit = l
+}
+
+// Identify gives the stream its request ID and trace context, and makes
+// the sampling decision. It is called when the request headers arrive,
+// before the chain runs.
+func (c *Chain) Identify(sc *StreamContext, headers *extprocv3.HttpHeaders) {
+	if c.ids != nil {
+		c.ids.Identify(sc, headers)
+	}
+	if c.tracer != nil && sc.Trace != nil {
+		c.tracer.Sample(sc.Trace)
+	}
+}
+
+// StartSpan starts the stream's span, or returns nil if it isn't traced
+func (c *Chain) StartSpan(sc *StreamContext, headers *extprocv3.HttpHeaders, start time.Time) *Span {
+	if c.tracer == nil {
+		return nil
+	}
+	return c.tracer.StartSpan(sc, headers, start)
+}
+
+// StartAudit starts the stream's audit record, or returns nil if the
+// audit log is off
+func (c *Chain) StartAudit(sc *StreamContext, headers *extprocv3.HttpHeaders, start time.Time) *AuditEntry {
+	if c.audit == nil {
+		return nil
+	}
+	return c.audit.StartAudit(sc, headers, start)
+}
+
+// SetEnabled turns a processor on or off by name.
+// It returns false if no processor with that name is in the chain.
+func (c *Chain) SetEnabled(name string, enabled bool) bool {
+	found := false
+	for _, e := range c.entries {
+		if e.processor.Name() == name {
+			e.enabled = enabled
+			found = true
+		}
+	}
+	return found
+}
+
+// Names returns the names of the enabled processors, in order
+func (c *Chain) Names() []string {
+	var names []string
+	for _, e := range c.entries {
+		if e.enabled {
+			names = append(names, e.processor.Name())
+		}
+	}
+	return names
+}
+
+// run calls hook on every enabled processor whose matcher accepts the
+// request and merges the results. The first immediate response stops the
+// chain. A processor that panics or returns an error is skipped or
+// answered with a 500, depending on its failure policy.
+//
+// Matchers always look at the request headers, even in response phases,
+// so a rule for "/admin" also applies to the responses of "/admin" requests.
+func (c *Chain) run(sc *StreamContext, hook func(p Processor) (*Result, error)) (*Result, error) {
+	merged := &Result{}
+	for i, e := range c.entries {
+		if !e.enabled || !e.matcher.Match(sc.RequestHeaders) {
+			continue
+		}
+		if sc.running != nil {
+			sc.running.Store(int32(i))
+		}
+		start := time.Now()
+		result, err := callProcessor(e.processor, hook)
+		metrics.ProcessorDuration.Observe(time.Since(start), e.processor.Name(), string(sc.Phase))
+		sc.Span.Processor(e.processor.Name(), sc.Phase, start, result, err)
+		if err != nil {
+			result = c.failed(sc, e, err)
+		}
+		sc.Audit.Fired(e.processor.Name(), result)
+		if result != nil && result.ImmediateResponse != nil {
+			return &Result{ImmediateResponse: result.ImmediateResponse}, nil
+		}
+		merged.merge(result)
+	}
+	return merged, nil
+}
+
+// RequestHeaders runs the request headers hook of every enabled processor
+func (c *Chain) RequestHeaders(sc *StreamContext, headers *extprocv3.HttpHeaders) (*Result, error) {
+	return c.run(sc, func(p Processor) (*Result, error) {
+		return p.RequestHeaders(sc, headers)
+	})
+}
+
+// ResponseHeaders runs the response headers hook of every enabled processor
+func (c *Chain) ResponseHeaders(sc *StreamContext, headers *extprocv3.HttpHeaders) (*Result, error) {
+	return c.run(sc, func(p Processor) (*Result, error) {
+		return p.ResponseHeaders(sc, headers)
+	})
+}
+
+// RequestBody runs the request body hook of every enabled processor.
+// If a processor replaces the body, later processors see the new body.
+func (c *Chain) RequestBody(sc *StreamContext, body *extprocv3.HttpBody) (*Result, error) {
+	current := &extprocv3.HttpBody{Body: body.GetBody(), EndOfStream: body.GetEndOfStream()}
+	return c.run(sc, func(p Processor) (*Result, error) {
+		result, err := p.RequestBody(sc, current)
+		if err == nil {
+			applyBodyMutation(current, result)
+		}
+		return result, err
+	})
+}
+
+// ResponseBody runs the response body hook of every enabled processor.
+// If a processor replaces the body, later processors see the new body.
+func (c *Chain) ResponseBody(sc *StreamContext, body *extprocv3.HttpBody) (*Result, error) {
+	current := &extprocv3.HttpBody{Body: body.GetBody(), EndOfStream: body.GetEndOfStream()}
+	return c.run(sc, func(p Processor) (*Result, error) {
+		result, err := p.ResponseBody(sc, current)
+		if err == nil {
+			applyBodyMutation(current, result)
+		}
+		return result, err
+	})
+}
+
+// RequestTrailers runs the request trailers hook of every enabled processor
+func (c *Chain) RequestTrailers(sc *StreamContext, trailers *extprocv3.HttpTrailers) (*Result, error) {
+	return c.run(sc, func(p Processor) (*Result, error) {
+		return p.RequestTrailers(sc, trailers)
+	})
+}
+
+// ResponseTrailers runs the response trailers hook of every enabled processor
+func (c *Chain) ResponseTrailers(sc *StreamContext, trailers *extprocv3.HttpTrailers) (*Result, error) {
+	return c.run(sc, func(p Processor) (*Result, error) {
+		return p.ResponseTrailers(sc, trailers)
+	})
+}
+
+// merge folds another processor's result into this one.
+// Header changes are concatenated so Envoy applies them in chain order.
+// A body mutation replaces the whole body, so the last one wins.
+func (r *Result) merge(other *Result) {
+	if other == nil {
+		return
+	}
+	if other.HeaderMutation != nil {
+		if r.HeaderMutation == nil {
+			r.HeaderMutation = &extprocv3.HeaderMutation{}
+		}
+		r.HeaderMutation.SetHeaders = append(r.HeaderMutation.SetHeaders, other.HeaderMutation.GetSetHeaders()...)
+		r.HeaderMutation.RemoveHeaders = append(r.HeaderMutation.RemoveHeaders, other.HeaderMutation.GetRemoveHeaders()...)
+	}
+	if other.BodyMutation != nil {
+		r.BodyMutation = other.BodyMutation
+	}
+}
+
+// CommonResponse turns the merged result into the CommonResponse Envoy expects
+func (r *Result) CommonResponse() *extprocv3.CommonResponse {
+	if r == nil {
+		return &extprocv3.CommonResponse{}
+	}
+	return &extprocv3.CommonResponse{
+		HeaderMutation: r.HeaderMutation,
+		BodyMutation:   r.BodyMutation,
+	}
+}
+
+// applyBodyMutation updates body in place so the next processor sees the
+// output of the previous one
+func applyBodyMutation(body *extprocv3.HttpBody, result *Result) {
+	if result == nil || result.BodyMutation == nil {
+		return
+	}
+	switch m := result.BodyMutation.Mutation.(type) {
+	case *extprocv3.BodyMutation_Body:
+		body.Body = m.Body
+	case *extprocv3.BodyMutation_ClearBody:
+		if m.ClearBody {
+			body.Body = nil
+		}
+	}
+}
+
+// getHeader returns the value of a header (keys from Envoy are lower-case)
+func getHeader(headers *extprocv3.HttpHeaders, key string) (string, bool) {
+	key = strings.ToLower(key)
+	for _, h := range headers.GetHeaders().GetHeaders() {
+		if h.GetKey() == key {
+			return h.GetValue(), true
+		}
+	}
+	return "", false
+}
+
+// setHeader builds a HeaderValueOption that overwrites (or adds) a header
+func setHeader(key, value string) *corev3.HeaderValueOption {
+	return &corev3.HeaderValueOption{
+		Header: &corev3.HeaderValue{
+			Key:   key,
+			Value: value,
+		},
+		AppendAction: corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+	}
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// RateLimitConfig limits how often requests matching a rule may be made.
+//
+//	rateLimit:
+//	  algorithm: token_bucket
+//	  requests: 100
+//	  per: 1m
+//	  burst: 20
+//	  key: [client_ip, "header:x-tenant-id"]
+type RateLimitConfig struct {
+	// Algorithm is token_bucket (default) or sliding_window
+	Algorithm string `yaml:"algorithm" json:"algorithm"`
+
+	// Requests are allowed per Per, for each key
+	Requests int           `yaml:"requests" json:"requests"`
+	Per      time.Duration `yaml:"per" json:"per"`
+
+	// Burst is the bucket size for token_bucket (default: Requests)
+	Burst int `yaml:"burst" json:"burst"`
+
+	// Key lists what requests are counted by. Each part is one of
+	// client_ip, path, method, api_key, "header:<name>" or "claim:<name>".
+	// With no key all matching requests share one limit.
+	Key []string `yaml:"key" json:"key"`
+
+	// Local keeps the counts in memory even when a rateLimitStore is
+	// configured, e.g. for limits that protect this replica itself
+	Local bool `yaml:"local" json:"local"`
+
+	// HideHeaders stops the X-RateLimit-* headers being added to allowed
+	// responses. Rejected requests always get them.
+	HideHeaders bool `yaml:"hideHeaders" json:"hideHeaders"`
+}
+
+// Rate limit algorithms understood in RateLimitConfig.Algorithm
+const (
+	AlgorithmTokenBucket   = "token_bucket"
+	AlgorithmSlidingWindow = "sliding_window"
+)
+
+func (c *RateLimitConfig) validate() error {
+	switch c.Algorithm {
+	case "", AlgorithmTokenBucket, AlgorithmSlidingWindow:
+	default:
+		return fmt.Errorf("unknown algorithm %q", c.Algorithm)
+	}
+	if c.Requests <= 0 {
+		return fmt.Errorf("requests must be positive")
+	}
+	if c.Per <= 0 {
+		return fmt.Errorf("per must be a positive duration")
+	}
+	if c.Burst < 0 {
+		return fmt.Errorf("burst must not be negative")
+	}
+	if c.Burst > 0 && c.Algorithm == AlgorithmSlidingWindow {
+		return fmt.Errorf("burst only applies to %s", AlgorithmTokenBucket)
+	}
+	if _, err := compileRateLimitKey(c.Key); err != nil {
+		return fmt.Errorf("key: %w", err)
+	}
+	return nil
+}
+
+// RateDecision is the outcome of counting one request
+type RateDecision struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the full quota is available again
+	Reset time.Duration
+	// RetryAfter is how long a rejected client should wait
+	RetryAfter time.Duration
+}
+
+// RateLimiter counts requests per key. Implementations must be safe for
+// concurrent use, since every Process stream calls them.
+type RateLimiter interface {
+	Allow(ctx context.Context, key string) (RateDecision, error)
+}
+
+// rateLimitShards spreads the keys over several locks so concurrent
+// streams rarely wait for each other
+const rateLimitShards = 64
+
+// localLimiterMaxKeys caps the keys one in-memory limiter tracks, since key
+// parts such as headers are chosen by the client. Past it, keys that have
+// gone unused for a while are forgotten to make room.
+const localLimiterMaxKeys = 100000
+
+// localLimiter is an in-memory RateLimiter. Counts are per replica.
+type localLimiter struct {
+	algorithm string
+	limit     int
+	burst     int
+	per       time.Duration
+	shards    [rateLimitShards]limiterShard
+}
+
+type limiterShard struct {
+	mu        sync.Mutex
+	entries   map[string]*limiterEntry
+	lastSweep time.Time
+}
+
+// limiterEntry is the state of one key. Token buckets use tokens and last;
+// sliding windows use start, prev and curr. used is when the key was last
+// counted, for eviction.
+type limiterEntry struct {
+	tokens float64
+	last   time.Time
+
+	start      time.Time
+	prev, curr int
+
+	used time.Time
+}
+
+func newLocalLimiter(cfg *RateLimitConfig) *localLimiter {
+	l := &localLimiter{
+		algorithm: cfg.Algorithm,
+		limit:     cfg.Requests,
+		burst:     cfg.Burst,
+		per:       cfg.Per,
+	}
+	if l.algorithm == "" {
+		l.algorithm = AlgorithmTokenBucket
+	}
+	if l.burst == 0 {
+		l.burst = l.limit
+	}
+	for i := range l.shards {
+		l.shards[i].entries = map[string]*limiterEntry{}
+	}
+	return l
+}
+
+// Allow counts a request for key
+func (l *localLimiter) Allow(_ context.Context, key string) (RateDecision, error) {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	shard := &l.shards[h.Sum32()%rateLimitShards]
+
+	now := time.Now()
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	l.sweep(shard, now)
+	entry := shard.entries[key]
+	if entry == nil {
+		if len(shard.entries) >= localLimiterMaxKeys/rateLimitShards {
+			l.evict(shard)
+		}
+		entry = &limiterEntry{tokens: float64(l.burst), last: now, start: now.Truncate(l.per)}
+		shard.entries[key] = entry
+	}
+	entry.used = now
+	if l.algorithm == AlgorithmSlidingWindow {
+		return l.slidingWindow(entry, now), nil
+	}
+	return l.tokenBucket(entry, now), nil
+}
+
+// tokenBucket refills Requests tokens per Per, up to Burst, and takes one
+func (l *localLimiter) tokenBucket(e *limiterEntry, now time.Time) RateDecision {
+	rate := float64(l.limit) / l.per.Seconds() // tokens per second
+	e.tokens = math.Min(float64(l.burst), e.tokens+now.Sub(e.last).Seconds()*rate)
+	e.last = now
+
+	allowed := e.tokens >= 1
+	if allowed {
+		e.tokens--
+	}
+	return tokenBucketDecision(l.limit, l.burst, l.per, e.tokens, allowed)
+}
+
+// tokenBucketDecision describes a token bucket that has tokens left after
+// the request was (or wasn't) allowed
+func tokenBucketDecision(limit, burst int, per time.Duration, tokens float64, allowed bool) RateDecision {
+	rate := float64(limit) / per.Seconds()
+	d := RateDecision{
+		Allowed:   allowed,
+		Limit:     limit,
+		Remaining: int(tokens),
+		Reset:     secondsToDuration((float64(burst) - tokens) / rate),
+	}
+	if !allowed {
+		d.RetryAfter = secondsToDuration((1 - tokens) / rate)
+	}
+	return d
+}
+
+// slidingWindow counts the request in the current fixed window
+func (l *localLimiter) slidingWindow(e *limiterEntry, now time.Time) RateDecision {
+	start := now.Truncate(l.per)
+	if !start.Equal(e.start) {
+		if start.Sub(e.start) == l.per {
+			e.prev = e.curr
+		} else {
+			e.prev = 0
+		}
+		e.curr = 0
+		e.start = start
+	}
+
+	d := slidingWindowDecision(l.limit, l.per, now.Sub(start), e.prev, e.curr)
+	if d.Allowed {
+		e.curr++
+	}
+	return d
+}
+
+// slidingWindowDecision estimates the count over the last Per from the
+// current and previous fixed windows, weighting the previous one by how
+// much of it still overlaps. curr is the count before this request.
+func slidingWindowDecision(limit int, per, elapsed time.Duration, prev, curr int) RateDecision {
+	weight := 1 - float64(elapsed)/float64(per)
+	estimate := float64(prev)*weight + float64(curr)
+	quota := float64(limit)
+
+	d := RateDecision{Limit: limit, Reset: per - elapsed}
+	if estimate+1 <= quota {
+		curr++
+		estimate++
+		d.Allowed = true
+	} else if curr+1 <= limit && prev > 0 {
+		// Wait until enough of the previous window has slid out
+		need := 1 - (quota-1-float64(curr))/float64(prev)
+		d.RetryAfter = time.Duration(need*float64(per)) - elapsed
+	} else {
+		// The current window alone is full: wait for it to become the
+		// previous window and slide out far enough
+		need := 1 - (quota-1)/float64(curr)
+		d.RetryAfter = per - elapsed + time.Duration(need*float64(per))
+	}
+	d.Remaining = int(math.Max(0, math.Floor(quota-estimate)))
+	if curr > 0 {
+		// Requests in this window count until the next one has passed
+		d.Reset += per
+	}
+	return d
+}
+
+// sweep drops idle keys so the map doesn't grow forever. It runs at most
+// once per Per for each shard.
+func (l *localLimiter) sweep(shard *limiterShard, now time.Time) {
+	if now.Sub(shard.lastSweep) < l.per {
+		return
+	}
+	shard.lastSweep = now
+	refill := time.Duration(float64(l.per) * float64(l.burst) / float64(l.limit))
+	for key, e := range shard.entries {
+		idle := false
+		if l.algorithm == AlgorithmSlidingWindow {
+			idle = now.Sub(e.start) >= 2*l.per
+		} else {
+			idle = now.Sub(e.last) >= refill
+		}
+		if idle {
+			delete(shard.entries, key)
+		}
+	}
+}
+
+// evictSample is how many keys evict compares
+const evictSample = 8
+
+// evict makes room in a full shard by forgetting the key that has gone
+// unused longest among a few picked at random (map order is random), so a
+// flood of new keys costs the same per request however full the shard is
+func (l *localLimiter) evict(shard *limiterShard) {
+	var oldest string
+	var oldestUsed time.Time
+	n := 0
+	for key, e := range shard.entries {
+		if n == 0 || e.used.Before(oldestUsed) {
+			oldest, oldestUsed = key, e.used
+		}
+		if n++; n == evictSample {
+			break
+		}
+	}
+	delete(shard.entries, oldest)
+}
+
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// localLimiters keeps the in-memory limiters across config reloads, so
+// reloading doesn't hand every client a fresh quota. A limiter is reused
+// when the rule name and its limits are unchanged.
+var localLimiters = struct {
+	sync.Mutex
+	byKey map[string]*localLimiter
+}{byKey: map[string]*localLimiter{}}
+
+func sharedLocalLimiter(name string, cfg *RateLimitConfig) *localLimiter {
+	key := fmt.Sprintf("%s|%s|%d|%d|%s", name, cfg.Algorithm, cfg.Requests, cfg.Burst, cfg.Per)
+	localLimiters.Lock()
+	defer localLimiters.Unlock()
+	if l, ok := localLimiters.byKey[key]; ok {
+		return l
+	}
+	l := newLocalLimiter(cfg)
+	localLimiters.byKey[key] = l
+	return l
+}
+
+// releaseLocalLimiters forgets the limiters kept for earlier configs that
+// are not in inUse
+func releaseLocalLimiters(inUse map[*localLimiter]bool) {
+	localLimiters.Lock()
+	defer localLimiters.Unlock()
+	for key, l := range localLimiters.byKey {
+		if !inUse[l] {
+			delete(localLimiters.byKey, key)
+		}
+	}
+}
+
+// rateLimitKey builds the counting key of a request from its parts
+type rateLimitKey []func(sc *StreamContext) string
+
+func compileRateLimitKey(parts []string) (rateLimitKey, error) {
+	var key rateLimitKey
+	for _, part := range parts {
+		kind, arg, _ := strings.Cut(part, ":")
+		switch {
+		case part == "client_ip":
+			key = append(key, clientIP)
+		case part == "path":
+			key = append(key, func(sc *StreamContext) string {
+				path, _ := getHeader(sc.RequestHeaders, ":path")
+				path, _, _ = strings.Cut(path, "?")
+				return path
+			})
+		case part == "method":
+			key = append(key, func(sc *StreamContext) string {
+				method, _ := getHeader(sc.RequestHeaders, ":method")
+				return method
+			})
+		case part == "api_key":
+			key = append(key, func(sc *StreamContext) string {
+				if entry := APIKeyPrincipal(sc); entry != nil {
+					return entry.ID
+				}
+				return ""
+			})
+		case kind == "header" && arg != "":
+			name := strings.ToLower(arg)
+			key = append(key, func(sc *StreamContext) string {
+				value, _ := getHeader(sc.RequestHeaders, name)
+				return value
+			})
+		case kind == "claim" && arg != "":
+			key = append(key, func(sc *StreamContext) string {
+				value, _ := claimString(JWTClaims(sc)[arg])
+				return value
+			})
+		default:
+			return nil, fmt.Errorf("unknown key part %q", part)
+		}
+	}
+	return key, nil
+}
+
+// build returns the key for a request. Parts the request doesn't have are
+// empty, so for example all requests without a JWT share one count.
+//
+// The parts are hashed, length first so that no two different sets of
+// values give the same key, and so a long header doesn't make a long key
+// in memory or in the store.
+func (k rateLimitKey) build(prefix string, sc *StreamContext) string {
+	if len(k) == 0 {
+		return prefix
+	}
+	h := sha256.New()
+	for _, part := range k {
+		value := part(sc)
+		fmt.Fprintf(h, "%d:%s", len(value), value)
+	}
+	return prefix + "|" + hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// RateLimitProcessor rejects requests over the limit with a 429 and adds
+// the remaining quota to the responses of allowed ones
+type RateLimitProcessor struct {
+	BaseProcessor
+
+	name     string
+	cfg      *RateLimitConfig
+	limiter  RateLimiter
+	failOpen bool
+	key      rateLimitKey
+	renderer *DenyRenderer
+}
+
+// NewRateLimitProcessor builds a rate limit processor. Requests are counted
+// in store if it is set (and the limit isn't marked local), otherwise in memory.
+func NewRateLimitProcessor(name string, cfg *RateLimitConfig, store *RedisStore, renderer *DenyRenderer) (*RateLimitProcessor, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	key, err := compileRateLimitKey(cfg.Key)
+	if err != nil {
+		return nil, err
+	}
+	p := &RateLimitProcessor{
+		name:     name,
+		cfg:      cfg,
+		key:      key,
+		renderer: renderer,
+	}
+	if store != nil && !cfg.Local {
+		p.limiter = store.Limiter(cfg)
+		p.failOpen = store.failOpen
+	} else {
+		p.limiter = sharedLocalLimiter(name, cfg)
+	}
+	return p, nil
+}
+
+func (p *RateLimitProcessor) Name() string { return p.name }
+
+func (p *RateLimitProcessor) checksAccess() {}
+
+// RequestHeaders counts the request and rejects it if it is over the limit
+func (p *RateLimitProcessor) RequestHeaders(sc *StreamContext, _ *extprocv3.HttpHeaders) (*Result, error) {
+	decision, err := p.limiter.Allow(sc, p.key.build(p.name, sc))
+	if err != nil {
+		if p.failOpen {
+			sc.Logger().Warnw("Rate limit store failed, letting request through", "processor", p.name, "decision", "fail_open", "error", err)
+			return nil, nil
+		}
+		sc.Logger().Warnw("Rate limit store failed, rejecting request", "processor", p.name, "decision", "deny", "reason", "rate_limit_unavailable", "error", err)
+		d := &Denial{
+			Status:  http.StatusServiceUnavailable,
+			Reason:  "rate_limit_unavailable",
+			Message: "the service is temporarily unavailable",
+		}
+		return d.Result(sc, p.renderer), nil
+	}
+	if !decision.Allowed {
+		sc.Logger().Infow("Rate limit exceeded", "processor", p.name, "decision", "deny", "reason", "rate_limited", "retry_after", decision.RetryAfter.Round(time.Millisecond))
+		headers := rateLimitHeaders(decision)
+		headers["retry-after"] = strconv.Itoa(ceilSeconds(decision.RetryAfter))
+		d := &Denial{
+			Status:  http.StatusTooManyRequests,
+			Reason:  "rate_limited",
+			Message: "too many requests",
+			Headers: headers,
+		}
+		return d.Result(sc, p.renderer), nil
+	}
+	// The request has used up its share of the quota whatever reply goes out
+	sc.KeepState(p.name, decision)
+	return nil, nil
+}
+
+// ResponseHeaders tells the client how much of its quota is left
+func (p *RateLimitProcessor) ResponseHeaders(sc *StreamContext, _ *extprocv3.HttpHeaders) (*Result, error) {
+	decision, ok := sc.State(p.name).(RateDecision)
+	if !ok || p.cfg.HideHeaders {
+		return nil, nil
+	}
+	headers := rateLimitHeaders(decision)
+	mutation := &extprocv3.HeaderMutation{}
+	for _, name := range []string{"x-ratelimit-limit", "x-ratelimit-remaining", "x-ratelimit-reset"} {
+		mutation.SetHeaders = append(mutation.SetHeaders, setHeader(name, headers[name]))
+	}
+	return &Result{HeaderMutation: mutation}, nil
+}
+
+func rateLimitHeaders(d RateDecision) map[string]string {
+	return map[string]string{
+		"x-ratelimit-limit":     strconv.Itoa(d.Limit),
+		"x-ratelimit-remaining": strconv.Itoa(d.Remaining),
+		"x-ratelimit-reset":     strconv.Itoa(ceilSeconds(d.Reset)),
+	}
+}
+
+// ceilSeconds rounds up to whole seconds, with a minimum of 1
+func ceilSeconds(d time.Duration) int {
+	s := int(math.Ceil(d.Seconds()))
+	if s < 1 {
+		return 1
+	}
+	return s
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimitKeyParts(t *testing.T) {
+	key, err := compileRateLimitKey([]string{"header:x-a", "header:x-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	build := func(a, b string) string {
+		sc := NewStreamContext(context.Background())
+		sc.RequestHeaders = testHeaders("x-a", a, "x-b", b)
+		return key.build("rule", sc)
+	}
+
+	if build("a|b", "c") == build("a", "b|c") {
+		t.Error("values that join to the same string share a key")
+	}
+	if build("", "ab") == build("a", "b") {
+		t.Error("moving bytes between parts keeps the key")
+	}
+	if build("a", "b") != build("a", "b") {
+		t.Error("the same values give different keys")
+	}
+	if long := build(string(make([]byte, 8192)), ""); len(long) > 64 {
+		t.Errorf("key for a long header is %d bytes", len(long))
+	}
+}
+
+func TestLocalLimiterCapsKeys(t *testing.T) {
+	l := newLocalLimiter(&RateLimitConfig{Requests: 1, Per: time.Hour})
+	ctx := context.Background()
+
+	if d, _ := l.Allow(ctx, "steady"); !d.Allowed {
+		t.Fatal("first request was rejected")
+	}
+	for i := 0; i < 2*localLimiterMaxKeys; i++ {
+		l.Allow(ctx, "flood-"+strconv.Itoa(i))
+	}
+
+	total := 0
+	for i := range l.shards {
+		total += len(l.shards[i].entries)
+	}
+	if total > localLimiterMaxKeys {
+		t.Errorf("limiter tracks %d keys, want at most %d", total, localLimiterMaxKeys)
+	}
+}
+
+func TestClientIPKeyIgnoresClientXFF(t *testing.T) {
+	tests := []struct {
+		xff, external, want string
+	}{
+		{xff: "6.6.6.6, 198.51.100.7", want: "198.51.100.7"},
+		{xff: "7.7.7.7, 198.51.100.7", want: "198.51.100.7"},
+		{xff: "[2001:db8::1]:443", want: "2001:db8::1"},
+		{external: "198.51.100.9", want: "198.51.100.9"},
+		{want: ""},
+	}
+	for _, tt := range tests {
+		sc := NewStreamContext(context.Background())
+		var pairs []string
+		if tt.xff != "" {
+			pairs = append(pairs, "x-forwarded-for", tt.xff)
+		}
+		if tt.external != "" {
+			pairs = append(pairs, "x-envoy-external-address", tt.external)
+		}
+		sc.RequestHeaders = testHeaders(pairs...)
+		if got := clientIP(sc); got != tt.want {
+			t.Errorf("clientIP(xff %q, external %q) = %q, want %q", tt.xff, tt.external, got, tt.want)
+		}
+	}
+}
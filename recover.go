@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/solo-io/go-utils/contextutils"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// FailurePolicyConfig decides what happens to a request when a processor
+// panics or returns an error. This is separate from Gloo's
+// failureModeAllow, which only covers the service as a whole being down
+// or failing the stream.
+//
+//	failurePolicy:
+//	  default: closed
+//	  processors:
+//	    headers: open
+//	    rule:add-debug-headers: open
+//
+// open skips the processor and carries on with the rest of the chain, as
+// if it had made no changes; closed (the default) answers the request with
+// a 500.
+type FailurePolicyConfig struct {
+	// Default is the policy of processors not listed in Processors
+	Default string `yaml:"default" json:"default"`
+	// Processors sets the policy by processor name (see the "processors"
+	// field of the "ExtProc service registered" log line)
+	Processors map[string]string `yaml:"processors" json:"processors"`
+}
+
+func (c *FailurePolicyConfig) validate() error {
+	check := func(policy string) error {
+		switch policy {
+		case "", FailOpen, FailClosed:
+			return nil
+		}
+		return fmt.Errorf("unknown policy %q (use %s or %s)", policy, FailOpen, FailClosed)
+	}
+	if err := check(c.Default); err != nil {
+		return fmt.Errorf("default: %w", err)
+	}
+	for name, policy := range c.Processors {
+		if err := check(policy); err != nil {
+			return fmt.Errorf("processors.%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// SetFailurePolicy applies the failure policy to the chain's processors.
+// Processors that fail closed are answered with renderer's templates.
+func (c *Chain) SetFailurePolicy(cfg *FailurePolicyConfig, renderer *DenyRenderer) error {
+	c.renderer = renderer
+	if cfg == nil {
+		return nil
+	}
+	for _, e := range c.entries {
+		e.failOpen = cfg.Default == FailOpen
+	}
+	for name, policy := range cfg.Processors {
+		found := false
+		for _, e := range c.entries {
+			if e.processor.Name() == name {
+				e.failOpen = policy == FailOpen
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("processors.%s: no processor with that name", name)
+		}
+	}
+	return nil
+}
+
+// panicError is a recovered panic, returned as the processor's error
+type panicError struct {
+	value interface{}
+	stack []byte
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.value)
+}
+
+// callProcessor runs one processor hook and turns a panic into an error,
+// so one broken processor can't take the whole process down
+func callProcessor(p Processor, hook func(p Processor) (*Result, error)) (result *Result, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			metrics.Panics.Inc(p.Name())
+			result, err = nil, &panicError{value: v, stack: debug.Stack()}
+		}
+	}()
+	return hook(p)
+}
+
+// failed applies the processor's failure policy. It returns the 500 to
+// answer with if the processor fails closed, or nil to carry on without it.
+func (c *Chain) failed(sc *StreamContext, e *chainEntry, err error) *Result {
+	name := e.processor.Name()
+	fields := []interface{}{"processor", name, "error", err}
+	var panicked *panicError
+	if errors.As(err, &panicked) {
+		fields = append(fields, "stack", string(panicked.stack))
+	}
+
+	if e.failOpen {
+		metrics.ProcessorFailures.Inc(name, FailOpen)
+		sc.Logger().Errorw("Processor failed, skipping it", append(fields, "decision", "fail_open")...)
+		return nil
+	}
+	metrics.ProcessorFailures.Inc(name, FailClosed)
+	sc.Logger().Errorw("Processor failed, rejecting request", append(fields, "decision", "deny", "reason", "processor_failed")...)
+	d := &Denial{
+		Status:  http.StatusInternalServerError,
+		Reason:  "processor_failed",
+		Message: "the request could not be processed",
+	}
+	return d.Result(sc, c.renderer)
+}
+
+// RecoverStreamInterceptor catches panics that escape a stream handler
+// outside the processors. The stream fails with Internal, which Envoy
+// handles according to failureModeAllow, and the process keeps running.
+func RecoverStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				err = recovered(ss.Context(), info.FullMethod, v)
+			}
+		}()
+		return handler(srv, ss)
+	}
+}
+
+// RecoverUnaryInterceptor does the same for unary calls such as health checks
+func RecoverUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				err = recovered(ctx, info.FullMethod, v)
+			}
+		}()
+		return handler(ctx, req)
+	}
+}
+
+func recovered(ctx context.Context, method string, v interface{}) error {
+	metrics.Panics.Inc("grpc")
+	contextutils.LoggerFrom(ctx).Errorw("Recovered from panic",
+		"method", method, "panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+	return status.Error(codes.Internal, "internal error")
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func setHeaderResult(key, value string) *Result {
+	return &Result{HeaderMutation: &extprocv3.HeaderMutation{
+		SetHeaders: []*corev3.HeaderValueOption{setHeader(key, value)},
+	}}
+}
+
+// failingProcessor panics or returns an error on request headers, or sets
+// x-<name> when it has neither to do
+type failingProcessor struct {
+	BaseProcessor
+	name  string
+	panic bool
+	err   error
+}
+
+func (p *failingProcessor) Name() string { return p.name }
+
+func (p *failingProcessor) RequestHeaders(*StreamContext, *extprocv3.HttpHeaders) (*Result, error) {
+	if p.panic {
+		var m map[string]int
+		m["boom"]++
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return setHeaderResult("x-"+p.name, "done"), nil
+}
+
+func TestFailurePolicy(t *testing.T) {
+	newChain := func() *Chain {
+		return NewChain(
+			&failingProcessor{name: "before"},
+			&failingProcessor{name: "panics", panic: true},
+			&failingProcessor{name: "errors", err: errors.New("lookup failed")},
+			&failingProcessor{name: "after"},
+		)
+	}
+	tests := []struct {
+		name   string
+		policy *FailurePolicyConfig
+		// denied is the processor whose failure answers with a 500, or ""
+		// if the request goes on
+		denied string
+		set    []string
+	}{
+		{"closed by default", nil, "panics", nil},
+		{"open by default", &FailurePolicyConfig{Default: FailOpen}, "", []string{"x-before", "x-after"}},
+		{"only the panic open", &FailurePolicyConfig{Processors: map[string]string{"panics": FailOpen}}, "errors", nil},
+		{"open except the error", &FailurePolicyConfig{Default: FailOpen, Processors: map[string]string{"errors": FailClosed}}, "errors", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newChain()
+			if err := c.SetFailurePolicy(tt.policy, nil); err != nil {
+				t.Fatal(err)
+			}
+			sc := NewStreamContext(context.Background())
+			sc.Audit = &AuditEntry{fired: map[string]bool{}}
+			result, err := c.RequestHeaders(sc, testHeaders(":path", "/"))
+			if err != nil {
+				t.Fatalf("failure escaped the chain: %v", err)
+			}
+			if tt.denied != "" {
+				immediate := result.ImmediateResponse
+				if immediate.GetStatus().GetCode() != 500 || immediate.GetDetails() != "ext_proc_processor_failed" {
+					t.Fatalf("got %v, want a 500", immediate)
+				}
+				// The chain stops at the failure
+				if rules := sc.Audit.record.Rules; len(rules) != 2 || rules[1] != tt.denied {
+					t.Errorf("audited rules %v, want before and %s", rules, tt.denied)
+				}
+				return
+			}
+			if result.ImmediateResponse != nil {
+				t.Fatalf("denied with %q", result.ImmediateResponse.GetDetails())
+			}
+			set, _ := headerChanges(result.HeaderMutation)
+			if len(set) != len(tt.set) {
+				t.Errorf("set %v, want %v", set, tt.set)
+			}
+			for _, name := range tt.set {
+				if set[name] != "done" {
+					t.Errorf("%s not set (set %v)", name, set)
+				}
+			}
+		})
+	}
+}
+
+func TestFailurePolicyConfig(t *testing.T) {
+	if err := NewChain(&failingProcessor{name: "a"}).SetFailurePolicy(
+		&FailurePolicyConfig{Processors: map[string]string{"b": FailOpen}}, nil); err == nil || !strings.Contains(err.Error(), "processors.b") {
+		t.Errorf("unknown processor: %v", err)
+	}
+	invalid := map[string]*FailurePolicyConfig{
+		"default":   {Default: "maybe"},
+		"processor": {Processors: map[string]string{"a": "Open"}},
+	}
+	for name, cfg := range invalid {
+		if err := cfg.validate(); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+// panicStream is the part of a server stream the recover interceptor uses
+type panicStream struct{ grpc.ServerStream }
+
+func (panicStream) Context() context.Context { return context.Background() }
+
+func TestRecoverInterceptors(t *testing.T) {
+	info := &grpc.StreamServerInfo{FullMethod: "/envoy.service.ext_proc.v3.ExternalProcessor/Process"}
+	err := RecoverStreamInterceptor()(nil, panicStream{}, info, func(interface{}, grpc.ServerStream) error {
+		panic("stream")
+	})
+	if status.Code(err) != codes.Internal || strings.Contains(err.Error(), "stream") {
+		t.Errorf("stream panic returned %v, want a bare Internal", err)
+	}
+	err = RecoverStreamInterceptor()(nil, panicStream{}, info, func(interface{}, grpc.ServerStream) error {
+		return status.Error(codes.Canceled, "gone")
+	})
+	if status.Code(err) != codes.Canceled {
+		t.Errorf("handler error became %v", err)
+	}
+
+	resp, err := RecoverUnaryInterceptor()(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/grpc.health.v1.Health/Check"},
+		func(context.Context, interface{}) (interface{}, error) { panic("unary") })
+	if resp != nil || status.Code(err) != codes.Internal {
+		t.Errorf("unary panic returned %v, %v", resp, err)
+	}
+}
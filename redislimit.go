@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitStoreConfig points the rate limits at a shared store that speaks
+// the Redis protocol (Redis, Valkey, KeyDB, ...), so every replica counts
+// against the same limit.
+//
+//	rateLimitStore:
+//	  address: redis.extproc.svc:6379
+//	  passwordFile: /etc/extproc/redis-password
+//	  failurePolicy: open
+type RateLimitStoreConfig struct {
+	Address      string `yaml:"address" json:"address"`
+	Password     string `yaml:"password" json:"password"`
+	PasswordFile string `yaml:"passwordFile" json:"passwordFile"`
+	DB           int    `yaml:"db" json:"db"`
+
+	// Timeout bounds each round-trip, including dialling (default 100ms)
+	Timeout time.Duration `yaml:"timeout" json:"timeout"`
+	// PoolSize is the number of idle connections kept open (default 32)
+	PoolSize int `yaml:"poolSize" json:"poolSize"`
+	// KeyPrefix is put in front of every key (default "extproc:ratelimit:")
+	KeyPrefix string `yaml:"keyPrefix" json:"keyPrefix"`
+
+	// FailurePolicy decides what happens when the store can't be reached:
+	// open (default) lets requests through, closed rejects them with a 503
+	FailurePolicy string `yaml:"failurePolicy" json:"failurePolicy"`
+
+	// DisableLocalCache asks the store about every request. By default a
+	// key that is over its limit is remembered locally until it may retry,
+	// so rejected clients don't cost a round-trip each.
+	DisableLocalCache bool `yaml:"disableLocalCache" json:"disableLocalCache"`
+}
+
+// Failure policies understood in RateLimitStoreConfig.FailurePolicy
+const (
+	FailOpen   = "open"
+	FailClosed = "closed"
+)
+
+func (c *RateLimitStoreConfig) validate() error {
+	if c.Address == "" {
+		return fmt.Errorf("address is required")
+	}
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		return fmt.Errorf("address: %w", err)
+	}
+	if c.Password != "" && c.PasswordFile != "" {
+		return fmt.Errorf("only one of password and passwordFile can be set")
+	}
+	if c.DB < 0 {
+		return fmt.Errorf("db must not be negative")
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	if c.PoolSize < 0 {
+		return fmt.Errorf("poolSize must not be negative")
+	}
+	switch c.FailurePolicy {
+	case "", FailOpen, FailClosed:
+	default:
+		return fmt.Errorf("unknown failurePolicy %q (use %s or %s)", c.FailurePolicy, FailOpen, FailClosed)
+	}
+	return nil
+}
+
+// RedisStore is a shared rate limit store
+type RedisStore struct {
+	client   *respClient
+	prefix   string
+	failOpen bool
+	cache    *overLimitCache
+}
+
+// redisStores keeps one store (and its connection pool) per config across
+// config reloads, so an unchanged store keeps its connections. Stores no
+// chain in use needs any more are closed by releaseUnused.
+var redisStores = struct {
+	sync.Mutex
+	byConfig map[RateLimitStoreConfig]*RedisStore
+}{byConfig: map[RateLimitStoreConfig]*RedisStore{}}
+
+// NewRedisStore returns the store for cfg, reusing an existing one when
+// the config hasn't changed
+func NewRedisStore(cfg *RateLimitStoreConfig) (*RedisStore, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	redisStores.Lock()
+	defer redisStores.Unlock()
+	if s, ok := redisStores.byConfig[*cfg]; ok {
+		return s, nil
+	}
+
+	password := cfg.Password
+	if cfg.PasswordFile != "" {
+		data, err := os.ReadFile(cfg.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading passwordFile: %w", err)
+		}
+		password = strings.TrimSpace(string(data))
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = 100 * time.Millisecond
+	}
+	poolSize := cfg.PoolSize
+	if poolSize == 0 {
+		poolSize = 32
+	}
+
+	s := &RedisStore{
+		client:   newRespClient(cfg.Address, password, cfg.DB, poolSize, timeout),
+		prefix:   cfg.KeyPrefix,
+		failOpen: cfg.FailurePolicy != FailClosed,
+	}
+	if s.prefix == "" {
+		s.prefix = "extproc:ratelimit:"
+	}
+	if !cfg.DisableLocalCache {
+		s.cache = &overLimitCache{entries: map[string]overLimitEntry{}}
+	}
+	redisStores.byConfig[*cfg] = s
+	return s, nil
+}
+
+// Close closes the store's connections
+func (s *RedisStore) Close() {
+	s.client.Close()
+}
+
+// releaseRedisStores closes the stores kept for earlier configs that are
+// not in inUse
+func releaseRedisStores(inUse map[*RedisStore]bool) {
+	redisStores.Lock()
+	defer redisStores.Unlock()
+	for cfg, s := range redisStores.byConfig {
+		if !inUse[s] {
+			delete(redisStores.byConfig, cfg)
+			s.Close()
+		}
+	}
+}
+
+// Limiter returns a RateLimiter that counts in the store
+func (s *RedisStore) Limiter(cfg *RateLimitConfig) RateLimiter {
+	l := &redisLimiter{
+		store:     s,
+		algorithm: cfg.Algorithm,
+		limit:     cfg.Requests,
+		burst:     cfg.Burst,
+		per:       cfg.Per,
+	}
+	if l.algorithm == "" {
+		l.algorithm = AlgorithmTokenBucket
+	}
+	if l.burst == 0 {
+		l.burst = l.limit
+	}
+	return l
+}
+
+// redisLimiter implements both algorithms on top of the store.
+// Sliding windows use INCR/PEXPIRE on one counter per fixed window; token
+// buckets use a Lua script so the refill and take happen atomically.
+type redisLimiter struct {
+	store     *RedisStore
+	algorithm string
+	limit     int
+	burst     int
+	per       time.Duration
+}
+
+// Allow counts a request for key in the store
+func (l *redisLimiter) Allow(ctx context.Context, key string) (RateDecision, error) {
+	key = l.store.prefix + key
+	if d, ok := l.store.cache.get(key); ok {
+		return d, nil
+	}
+
+	var d RateDecision
+	var err error
+	if l.algorithm == AlgorithmSlidingWindow {
+		d, err = l.slidingWindow(ctx, key)
+	} else {
+		d, err = l.tokenBucket(ctx, key)
+	}
+	if err != nil {
+		return RateDecision{}, err
+	}
+	if !d.Allowed {
+		l.store.cache.add(key, d)
+	}
+	return d, nil
+}
+
+func (l *redisLimiter) slidingWindow(ctx context.Context, key string) (RateDecision, error) {
+	now := time.Now()
+	window := now.UnixNano() / int64(l.per)
+	elapsed := time.Duration(now.UnixNano() - window*int64(l.per))
+	curr := key + ":" + strconv.FormatInt(window, 10)
+	prev := key + ":" + strconv.FormatInt(window-1, 10)
+
+	// A counter must outlive its own window and the next one, where it is
+	// the previous window
+	ttl := strconv.FormatInt((2 * l.per).Milliseconds(), 10)
+	replies, err := l.store.client.Pipeline(ctx, [][]string{
+		{"MULTI"},
+		{"INCR", curr},
+		{"PEXPIRE", curr, ttl},
+		{"GET", prev},
+		{"EXEC"},
+	})
+	if err != nil {
+		return RateDecision{}, err
+	}
+	exec, ok := replies[4].([]interface{})
+	if !ok || len(exec) != 3 {
+		return RateDecision{}, fmt.Errorf("unexpected EXEC reply %v", replies[4])
+	}
+	count, ok := exec[0].(int64)
+	if !ok {
+		return RateDecision{}, fmt.Errorf("unexpected INCR reply %v", exec[0])
+	}
+	var prevCount int64
+	if s, ok := exec[2].(string); ok {
+		prevCount, _ = strconv.ParseInt(s, 10, 64)
+	}
+
+	d := slidingWindowDecision(l.limit, l.per, elapsed, int(prevCount), int(count-1))
+	if !d.Allowed {
+		// Rejected requests shouldn't use up quota. This isn't atomic with
+		// the INCR, so under a burst the count can briefly be too high,
+		// which errs on the side of rejecting.
+		_, _ = l.store.client.Do(ctx, "DECR", curr)
+	}
+	return d, nil
+}
+
+// tokenBucketScript refills and takes from a bucket stored as a hash.
+// It uses the store's clock so replicas with skewed clocks agree.
+// KEYS[1] is the bucket, ARGV[1] the refill rate in tokens per second and
+// ARGV[2] the bucket size. It returns {allowed, tokens left}.
+const tokenBucketScript = `
+if redis.replicate_commands then redis.replicate_commands() end
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens))
+redis.call('HSET', KEYS[1], 'ts', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, tostring(tokens)}
+`
+
+var tokenBucketScriptSHA = func() string {
+	sum := sha1.Sum([]byte(tokenBucketScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+func (l *redisLimiter) tokenBucket(ctx context.Context, key string) (RateDecision, error) {
+	rate := strconv.FormatFloat(float64(l.limit)/l.per.Seconds(), 'g', -1, 64)
+	burst := strconv.Itoa(l.burst)
+
+	// EVALSHA saves sending the script every time; the first call after a
+	// store restart gets NOSCRIPT and falls back to EVAL, which caches it
+	reply, err := l.store.client.Do(ctx, "EVALSHA", tokenBucketScriptSHA, "1", key, rate, burst)
+	if e, ok := err.(respError); ok && strings.HasPrefix(string(e), "NOSCRIPT") {
+		reply, err = l.store.client.Do(ctx, "EVAL", tokenBucketScript, "1", key, rate, burst)
+	}
+	if err != nil {
+		return RateDecision{}, err
+	}
+
+	result, ok := reply.([]interface{})
+	if !ok || len(result) != 2 {
+		return RateDecision{}, fmt.Errorf("unexpected script reply %v", reply)
+	}
+	allowed, _ := result[0].(int64)
+	tokensText, _ := result[1].(string)
+	tokens, err := strconv.ParseFloat(tokensText, 64)
+	if err != nil {
+		return RateDecision{}, fmt.Errorf("unexpected token count %q", tokensText)
+	}
+	return tokenBucketDecision(l.limit, l.burst, l.per, tokens, allowed == 1), nil
+}
+
+// overLimitCache remembers keys that are over their limit until they may
+// retry. A nil cache remembers nothing.
+type overLimitCache struct {
+	mu      sync.Mutex
+	entries map[string]overLimitEntry
+}
+
+type overLimitEntry struct {
+	decision RateDecision
+	until    time.Time
+}
+
+// overLimitCacheSize caps the cache so a flood of distinct keys can't use
+// up memory; past it, decisions are simply not cached
+const overLimitCacheSize = 100000
+
+func (c *overLimitCache) get(key string) (RateDecision, bool) {
+	if c == nil {
+		return RateDecision{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return RateDecision{}, false
+	}
+	left := time.Until(entry.until)
+	if left <= 0 {
+		delete(c.entries, key)
+		return RateDecision{}, false
+	}
+	d := entry.decision
+	d.RetryAfter = left
+	d.Reset -= entry.decision.RetryAfter - left
+	return d, true
+}
+
+func (c *overLimitCache) add(key string, d RateDecision) {
+	if c == nil || d.RetryAfter <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= overLimitCacheSize {
+		now := time.Now()
+		for k, entry := range c.entries {
+			if now.After(entry.until) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= overLimitCacheSize {
+			return
+		}
+	}
+	c.entries[key] = overLimitEntry{decision: d, until: time.Now().Add(d.RetryAfter)}
+}
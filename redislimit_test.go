@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"math"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process stand-in for a Redis-compatible store. It
+// understands only the commands the rate limiter sends, and runs the token
+// bucket script as Go code.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu       sync.Mutex
+	values   map[string]int64
+	buckets  map[string][2]float64 // tokens, ts
+	scripts  map[string]bool
+	commands []string
+}
+
+// simpleString is a RESP simple string reply such as +OK
+type simpleString string
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{
+		ln:       ln,
+		password: password,
+		values:   map[string]int64{},
+		buckets:  map[string][2]float64{},
+		scripts:  map[string]bool{},
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) addr() string { return f.ln.Addr().String() }
+
+// commandNames returns the names of the commands received so far
+func (f *fakeRedis) commandNames() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.commands...)
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := f.password == ""
+	var queued [][]string
+	inMulti := false
+	for {
+		request, err := readReply(r)
+		if err != nil {
+			return
+		}
+		items, _ := request.([]interface{})
+		var args []string
+		for _, item := range items {
+			s, _ := item.(string)
+			args = append(args, s)
+		}
+		if len(args) == 0 {
+			return
+		}
+		name := strings.ToUpper(args[0])
+		f.mu.Lock()
+		f.commands = append(f.commands, name)
+		f.mu.Unlock()
+
+		var reply interface{}
+		switch {
+		case name == "AUTH":
+			authed = args[1] == f.password
+			reply = simpleString("OK")
+			if !authed {
+				reply = respError("WRONGPASS invalid password")
+			}
+		case !authed:
+			reply = respError("NOAUTH Authentication required.")
+		case name == "MULTI":
+			inMulti = true
+			reply = simpleString("OK")
+		case name == "EXEC":
+			var results []interface{}
+			for _, cmd := range queued {
+				results = append(results, f.run(cmd))
+			}
+			queued, inMulti = nil, false
+			reply = results
+		case inMulti:
+			queued = append(queued, args)
+			reply = simpleString("QUEUED")
+		default:
+			reply = f.run(args)
+		}
+		if _, err := conn.Write(appendReply(nil, reply)); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeRedis) run(args []string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "SELECT", "PEXPIRE":
+		return simpleString("OK")
+	case "INCR":
+		f.values[args[1]]++
+		return f.values[args[1]]
+	case "DECR":
+		f.values[args[1]]--
+		return f.values[args[1]]
+	case "GET":
+		v, ok := f.values[args[1]]
+		if !ok {
+			return nil
+		}
+		return strconv.FormatInt(v, 10)
+	case "EVALSHA":
+		if !f.scripts[args[1]] {
+			return respError("NOSCRIPT No matching script. Please use EVAL.")
+		}
+		return f.tokenBucket(args[3], args[4], args[5])
+	case "EVAL":
+		sum := sha1.Sum([]byte(args[1]))
+		f.scripts[hex.EncodeToString(sum[:])] = true
+		return f.tokenBucket(args[3], args[4], args[5])
+	}
+	return respError("ERR unknown command " + args[0])
+}
+
+// tokenBucket does what tokenBucketScript does
+func (f *fakeRedis) tokenBucket(key, rateArg, burstArg string) interface{} {
+	rate, _ := strconv.ParseFloat(rateArg, 64)
+	burst, _ := strconv.ParseFloat(burstArg, 64)
+	now := float64(time.Now().UnixNano()) / 1e9
+	state, ok := f.buckets[key]
+	if !ok {
+		state = [2]float64{burst, now}
+	}
+	tokens := math.Min(burst, state[0]+math.Max(0, now-state[1])*rate)
+	var allowed int64
+	if tokens >= 1 {
+		tokens--
+		allowed = 1
+	}
+	f.buckets[key] = [2]float64{tokens, now}
+	return []interface{}{allowed, strconv.FormatFloat(tokens, 'g', -1, 64)}
+}
+
+// appendReply encodes a reply the way a server sends it
+func appendReply(buf []byte, reply interface{}) []byte {
+	switch v := reply.(type) {
+	case nil:
+		return append(buf, "$-1\r\n"...)
+	case simpleString:
+		return append(append(append(buf, '+'), v...), "\r\n"...)
+	case respError:
+		return append(append(append(buf, '-'), v...), "\r\n"...)
+	case int64:
+		return append(strconv.AppendInt(append(buf, ':'), v, 10), "\r\n"...)
+	case string:
+		buf = append(strconv.AppendInt(append(buf, '$'), int64(len(v)), 10), "\r\n"...)
+		return append(append(buf, v...), "\r\n"...)
+	case []interface{}:
+		buf = append(strconv.AppendInt(append(buf, '*'), int64(len(v)), 10), "\r\n"...)
+		for _, item := range v {
+			buf = appendReply(buf, item)
+		}
+		return buf
+	}
+	panic("unsupported reply type")
+}
+
+func TestReadReply(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    interface{}
+		wantErr bool
+	}{
+		{in: "+OK\r\n", want: "OK"},
+		{in: "+\r\n", want: ""},
+		{in: "-NOSCRIPT No matching script\r\n", want: respError("NOSCRIPT No matching script")},
+		{in: ":42\r\n", want: int64(42)},
+		{in: ":-1\r\n", want: int64(-1)},
+		{in: "$5\r\nhello\r\n", want: "hello"},
+		{in: "$0\r\n\r\n", want: ""},
+		{in: "$6\r\nab\r\ncd\r\n", want: "ab\r\ncd"},
+		{in: "$-1\r\n", want: nil},
+		{in: "*-1\r\n", want: nil},
+		{in: "*0\r\n", want: []interface{}{}},
+		{in: "*3\r\n:1\r\n$-1\r\n*1\r\n+x\r\n", want: []interface{}{int64(1), nil, []interface{}{"x"}}},
+		{in: "OK\r\n", wantErr: true},
+		{in: "+OK\n", wantErr: true},
+		{in: ":abc\r\n", wantErr: true},
+		{in: "$x\r\n", wantErr: true},
+		{in: "$3\r\nhello\r\n", wantErr: true},
+		{in: "$5\r\nhel", wantErr: true},
+		{in: "*2\r\n:1\r\n", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := readReply(bufio.NewReader(strings.NewReader(tt.in)))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("readReply(%q) = %#v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("readReply(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("readReply(%q) = %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestAppendCommand(t *testing.T) {
+	got := string(appendCommand(nil, []string{"SET", "k", ""}))
+	want := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$0\r\n\r\n"
+	if got != want {
+		t.Errorf("appendCommand = %q, want %q", got, want)
+	}
+}
+
+func TestSlidingWindowDecision(t *testing.T) {
+	tests := []struct {
+		name       string
+		elapsed    time.Duration
+		prev, curr int
+		want       RateDecision
+	}{
+		{
+			name:    "half the previous window still counts",
+			elapsed: 30 * time.Second, prev: 10, curr: 0,
+			want: RateDecision{Allowed: true, Limit: 10, Remaining: 4, Reset: 90 * time.Second},
+		},
+		{
+			name:    "empty windows",
+			elapsed: 0, prev: 0, curr: 0,
+			want: RateDecision{Allowed: true, Limit: 10, Remaining: 9, Reset: 2 * time.Minute},
+		},
+		{
+			name:    "previous window has to slide out further",
+			elapsed: 30 * time.Second, prev: 10, curr: 5,
+			want: RateDecision{Limit: 10, Remaining: 0, Reset: 90 * time.Second, RetryAfter: 6 * time.Second},
+		},
+		{
+			name:    "current window full",
+			elapsed: 0, prev: 0, curr: 10,
+			want: RateDecision{Limit: 10, Remaining: 0, Reset: 2 * time.Minute, RetryAfter: 66 * time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := slidingWindowDecision(10, time.Minute, tt.elapsed, tt.prev, tt.curr)
+			got.RetryAfter = got.RetryAfter.Round(time.Millisecond)
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenBucketDecision(t *testing.T) {
+	// 10 requests per 10s is one token a second
+	got := tokenBucketDecision(10, 10, 10*time.Second, 0.5, false)
+	want := RateDecision{Limit: 10, Remaining: 0, Reset: 9500 * time.Millisecond, RetryAfter: 500 * time.Millisecond}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	got = tokenBucketDecision(10, 10, 10*time.Second, 9, true)
+	want = RateDecision{Allowed: true, Limit: 10, Remaining: 9, Reset: time.Second}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+// newTestStore returns a store for cfg that is closed when the test ends
+func newTestStore(t *testing.T, cfg *RateLimitStoreConfig) *RedisStore {
+	store, err := NewRedisStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { releaseRedisStores(nil) })
+	return store
+}
+
+func TestRedisSlidingWindow(t *testing.T) {
+	f := newFakeRedis(t, "")
+	store := newTestStore(t, &RateLimitStoreConfig{Address: f.addr(), Timeout: time.Second})
+	limiter := store.Limiter(&RateLimitConfig{Algorithm: AlgorithmSlidingWindow, Requests: 3, Per: time.Hour})
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if d, err := limiter.Allow(ctx, "k"); err != nil || !d.Allowed {
+			t.Fatalf("request %d: %+v, %v", i, d, err)
+		}
+	}
+	d, err := limiter.Allow(ctx, "k")
+	if err != nil || d.Allowed || d.RetryAfter <= 0 {
+		t.Fatalf("request over the limit: %+v, %v", d, err)
+	}
+
+	// The rejected request was taken back out of the count
+	f.mu.Lock()
+	for key, v := range f.values {
+		if v != 3 {
+			t.Errorf("%s = %d, want 3", key, v)
+		}
+	}
+	f.mu.Unlock()
+
+	// and is now answered from the local cache
+	before := len(f.commandNames())
+	if d, _ := limiter.Allow(ctx, "k"); d.Allowed {
+		t.Error("cached rejection let a request through")
+	}
+	if after := len(f.commandNames()); after != before {
+		t.Errorf("cached rejection sent %d commands to the store", after-before)
+	}
+}
+
+func TestRedisTokenBucket(t *testing.T) {
+	f := newFakeRedis(t, "secret")
+	store := newTestStore(t, &RateLimitStoreConfig{
+		Address: f.addr(), Password: "secret", DB: 2, Timeout: time.Second, DisableLocalCache: true,
+	})
+	limiter := store.Limiter(&RateLimitConfig{Requests: 2, Per: time.Hour})
+	ctx := context.Background()
+
+	for i, want := range []bool{true, true, false, false} {
+		d, err := limiter.Allow(ctx, "k")
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		if d.Allowed != want {
+			t.Errorf("request %d: allowed = %v, want %v", i, d.Allowed, want)
+		}
+	}
+
+	// The script is sent once, after the store said it didn't have it
+	want := []string{"AUTH", "SELECT", "EVALSHA", "EVAL", "EVALSHA", "EVALSHA", "EVALSHA"}
+	if got := f.commandNames(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands = %v, want %v", got, want)
+	}
+}
+
+func TestRedisWrongPassword(t *testing.T) {
+	f := newFakeRedis(t, "secret")
+	store := newTestStore(t, &RateLimitStoreConfig{Address: f.addr(), Password: "wrong", Timeout: time.Second})
+	limiter := store.Limiter(&RateLimitConfig{Requests: 2, Per: time.Hour})
+
+	_, err := limiter.Allow(context.Background(), "k")
+	if err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("Allow error = %v, want WRONGPASS", err)
+	}
+}
+
+func TestRedisFailurePolicy(t *testing.T) {
+	// A listener that is closed straight away gives an address nothing answers on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	tests := []struct {
+		policy     string
+		wantStatus int
+	}{
+		{policy: "", wantStatus: 0},
+		{policy: FailOpen, wantStatus: 0},
+		{policy: FailClosed, wantStatus: 503},
+	}
+	for _, tt := range tests {
+		t.Run("policy "+tt.policy, func(t *testing.T) {
+			store := newTestStore(t, &RateLimitStoreConfig{Address: addr, Timeout: time.Second, FailurePolicy: tt.policy})
+			p, err := NewRateLimitProcessor("limit", &RateLimitConfig{Requests: 1, Per: time.Hour}, store, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The second request finds the store marked down without dialling
+			for i := 0; i < 2; i++ {
+				sc := NewStreamContext(context.Background())
+				result, err := p.RequestHeaders(sc, testHeaders())
+				if err != nil {
+					t.Fatal(err)
+				}
+				status := 0
+				if result != nil {
+					status = int(result.ImmediateResponse.GetStatus().GetCode())
+				}
+				if status != tt.wantStatus {
+					t.Errorf("request %d: status %d, want %d", i, status, tt.wantStatus)
+				}
+			}
+		})
+	}
+}
+
+func TestReleaseRedisStores(t *testing.T) {
+	f := newFakeRedis(t, "")
+	kept := newTestStore(t, &RateLimitStoreConfig{Address: f.addr(), Timeout: time.Second})
+	dropped := newTestStore(t, &RateLimitStoreConfig{Address: f.addr(), Timeout: time.Second, DB: 1})
+
+	releaseRedisStores(map[*RedisStore]bool{kept: true})
+
+	limit := &RateLimitConfig{Requests: 1, Per: time.Hour}
+	if _, err := kept.Limiter(limit).Allow(context.Background(), "k"); err != nil {
+		t.Errorf("kept store: %v", err)
+	}
+	if _, err := dropped.Limiter(limit).Allow(context.Background(), "k"); !errors.Is(err, errStoreClosed) {
+		t.Errorf("released store: error %v, want %v", err, errStoreClosed)
+	}
+	if again := newTestStore(t, &RateLimitStoreConfig{Address: f.addr(), Timeout: time.Second}); again != kept {
+		t.Error("the kept store was replaced")
+	}
+	if again := newTestStore(t, &RateLimitStoreConfig{Address: f.addr(), Timeout: time.Second, DB: 1}); again == dropped {
+		t.Error("the released store was handed out again")
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/solo-io/go-utils/contextutils"
+	"go.uber.org/zap"
+)
+
+// ConfigReloader keeps the server's processor chain in sync with the
+// config file. It reloads when the file content changes (checked by
+// polling, which also works for Kubernetes ConfigMap symlink swaps) and
+// whenever the process receives SIGHUP.
+//
+// A new config is fully validated and built before it is swapped in.
+// If anything is wrong the error is logged and the last good config
+// stays active.
+type ConfigReloader struct {
+	path     string
+	interval time.Duration
+	server   *ExtProcServer
+
+	// lastHash is the hash of the file content that is currently active
+	lastHash [sha256.Size]byte
+
+	logger *zap.SugaredLogger
+}
+
+// NewConfigReloader creates a reloader for the config file at path.
+// An interval of 0 disables polling; SIGHUP still triggers a reload.
+func NewConfigReloader(path string, interval time.Duration, server *ExtProcServer) *ConfigReloader {
+	r := &ConfigReloader{
+		path:     path,
+		interval: interval,
+		server:   server,
+		logger:   contextutils.LoggerFrom(context.Background()),
+	}
+	// Remember what the startup config looked like so the first poll
+	// does not reload an unchanged file
+	if data, err := os.ReadFile(path); err == nil {
+		r.lastHash = sha256.Sum256(data)
+	}
+	return r
+}
+
+// Run watches for changes until ctx is cancelled
+func (r *ConfigReloader) Run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	// A nil channel blocks forever, which switches polling off
+	var tick <-chan time.Time
+	if r.interval > 0 {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	r.logger = contextutils.LoggerFrom(ctx)
+	r.logger.Infow("Watching config file for changes (SIGHUP to reload now)", "path", r.path, "poll_interval", r.interval)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			r.logger.Infow("SIGHUP received, reloading config")
+			r.Reload(true)
+		case <-tick:
+			r.Reload(false)
+		}
+	}
+}
+
+// Reload loads the config file and swaps in a new processor chain.
+// Unless force is set, an unchanged file is skipped.
+func (r *ConfigReloader) Reload(force bool) {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		r.logger.Errorw("Config reload failed, keeping last good config", "path", r.path, "error", err)
+		return
+	}
+	hash := sha256.Sum256(data)
+	if !force && bytes.Equal(hash[:], r.lastHash[:]) {
+		return
+	}
+
+	cfg, err := ParseConfig(data)
+	if err != nil {
+		r.logger.Errorw("Config reload failed, keeping last good config", "path", r.path, "error", err)
+		r.lastHash = hash // don't log the same broken file on every poll
+		return
+	}
+	chain, err := r.server.swapChain(cfg)
+	if err != nil {
+		r.logger.Errorw("Config reload failed, keeping last good config", "path", r.path, "error", err)
+		r.lastHash = hash
+		return
+	}
+	r.lastHash = hash
+	r.logger.Infow("Config reloaded", "path", r.path, "processors", chain.Names())
+}
+
+// swapChain builds the chain for cfg and makes it the one new streams
+// use. Streams that are already open keep the chain they started with.
+func (s *ExtProcServer) swapChain(cfg *Config) (*Chain, error) {
+	s.swapMu.Lock()
+	defer s.swapMu.Unlock()
+	chain, err := BuildChain(cfg)
+	if err == nil {
+		s.chain.Store(chain)
+	}
+	// A failed build may have set up a store no chain uses
+	s.releaseUnused()
+	return chain, err
+}
+
+// acquireChain returns the chain for a new stream, which counts as using
+// it until releaseChain
+func (s *ExtProcServer) acquireChain() *Chain {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+	chain := s.chain.Load()
+	s.streams[chain]++
+	return chain
+}
+
+// releaseChain ends a stream's use of chain. The last stream on a chain a
+// reload replaced releases what only that chain used.
+func (s *ExtProcServer) releaseChain(chain *Chain) {
+	s.streamsMu.Lock()
+	s.streams[chain]--
+	retired := s.streams[chain] == 0 && chain != s.chain.Load()
+	if s.streams[chain] == 0 {
+		delete(s.streams, chain)
+	}
+	s.streamsMu.Unlock()
+	if retired {
+		s.swapMu.Lock()
+		defer s.swapMu.Unlock()
+		s.releaseUnused()
+	}
+}
+
+// releaseUnused closes the rate limit stores and tracers, and drops the
+// in-memory limiters, that were kept for earlier configs but that neither
+// the active chain nor a stream still running on an older one uses.
+// swapMu must be held.
+func (s *ExtProcServer) releaseUnused() {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+	stores := map[*RedisStore]bool{}
+	limiters := map[*localLimiter]bool{}
+	inUse := map[*Tracer]bool{}
+	chains := []*Chain{s.chain.Load()}
+	for chain := range s.streams {
+		chains = append(chains, chain)
+	}
+	for _, chain := range chains {
+		for _, e := range chain.entries {
+			p, ok := e.processor.(*RateLimitProcessor)
+			if !ok {
+				continue
+			}
+			switch l := p.limiter.(type) {
+			case *redisLimiter:
+				stores[l.store] = true
+			case *localLimiter:
+				limiters[l] = true
+			}
+		}
+		if chain.tracer != nil {
+			inUse[chain.tracer] = true
+		}
+	}
+	releaseRedisStores(stores)
+	releaseLocalLimiters(limiters)
+	releaseTracers(inUse)
+}
+
+// watchedFile holds the parsed content of a file that is reloaded when it
+// changes on disk, such as a JWKS or an API key store.
+//
+// The file is checked from the request path, at most once per interval,
+// instead of from a goroutine. That way nothing has to be stopped when a
+// config reload replaces the processor that owns the file.
+type watchedFile[T any] struct {
+	path     string
+	interval time.Duration
+	parse    func([]byte) (T, error)
+
+	mu        sync.Mutex
+	value     atomic.Pointer[T]
+	lastCheck atomic.Int64 // unix nanos of the last check
+	lastHash  [sha256.Size]byte
+}
+
+// newWatchedFile loads the file once and fails if it can't be parsed
+func newWatchedFile[T any](path string, interval time.Duration, parse func([]byte) (T, error)) (*watchedFile[T], error) {
+	w := &watchedFile[T]{path: path, interval: interval, parse: parse}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	value, err := parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	w.value.Store(&value)
+	w.lastHash = sha256.Sum256(data)
+	w.lastCheck.Store(time.Now().UnixNano())
+	return w, nil
+}
+
+// Get returns the current content, reloading it first if the check
+// interval has passed and the file changed. A broken file is logged and
+// the last good content is kept.
+func (w *watchedFile[T]) Get() T {
+	if w.interval > 0 && time.Since(time.Unix(0, w.lastCheck.Load())) >= w.interval {
+		// Only one request does the check; the others use the current value
+		if w.mu.TryLock() {
+			w.reload()
+			w.mu.Unlock()
+		}
+	}
+	return *w.value.Load()
+}
+
+func (w *watchedFile[T]) reload() {
+	w.lastCheck.Store(time.Now().UnixNano())
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		contextutils.LoggerFrom(context.Background()).Errorw("Reloading file failed, keeping last good version", "path", w.path, "error", err)
+		return
+	}
+	hash := sha256.Sum256(data)
+	if hash == w.lastHash {
+		return
+	}
+	w.lastHash = hash
+
+	value, err := w.parse(data)
+	if err != nil {
+		contextutils.LoggerFrom(context.Background()).Errorw("Reloading file failed, keeping last good version", "path", w.path, "error", err)
+		return
+	}
+	w.value.Store(&value)
+	contextutils.LoggerFrom(context.Background()).Infow("Reloaded file", "path", w.path)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestReloadKeepsResourcesOfOpenStreams(t *testing.T) {
+	config := func(requests int) *Config {
+		t.Helper()
+		cfg, err := ParseConfig([]byte(fmt.Sprintf(`
+rules:
+  - name: api
+    rateLimit:
+      requests: %d
+      per: 1m
+`, requests)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+	t.Cleanup(func() { releaseLocalLimiters(nil) })
+	limiter := func(chain *Chain) *localLimiter {
+		for _, e := range chain.entries {
+			if p, ok := e.processor.(*RateLimitProcessor); ok {
+				return p.limiter.(*localLimiter)
+			}
+		}
+		t.Fatal("chain has no rate limit")
+		return nil
+	}
+	kept := func(l *localLimiter) bool {
+		localLimiters.Lock()
+		defer localLimiters.Unlock()
+		for _, k := range localLimiters.byKey {
+			if k == l {
+				return true
+			}
+		}
+		return false
+	}
+
+	first, err := BuildChain(config(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewExtProcServer(first)
+	stream := s.acquireChain()
+	if _, err := s.swapChain(config(20)); err != nil {
+		t.Fatal(err)
+	}
+	if !kept(limiter(first)) {
+		t.Fatal("a limiter was released while a stream still uses it")
+	}
+
+	// A new stream gets the new chain, and ending it releases nothing
+	second := s.acquireChain()
+	if second == first {
+		t.Fatal("a new stream got the replaced chain")
+	}
+	s.releaseChain(second)
+	if !kept(limiter(first)) || !kept(limiter(second)) {
+		t.Fatal("a limiter in use was released")
+	}
+
+	// The last stream on the replaced chain releases what only it used
+	s.releaseChain(stream)
+	if kept(limiter(first)) {
+		t.Error("the replaced chain's limiter was kept after its last stream ended")
+	}
+	if !kept(limiter(second)) {
+		t.Error("the active chain's limiter was released")
+	}
+}
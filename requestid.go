@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// RequestIDConfig controls the request IDs and trace context given to
+// every request.
+//
+//	requestID:
+//	  format: ulid
+//	  header: x-request-id
+type RequestIDConfig struct {
+	// Format of generated IDs: uuid (UUIDv4, default) or ulid
+	Format string `yaml:"format" json:"format"`
+
+	// Header carries the ID (default x-request-id). An ID the client or
+	// Envoy already set is kept.
+	Header string `yaml:"header" json:"header"`
+
+	// DisableTraceContext leaves traceparent and tracestate alone
+	DisableTraceContext bool `yaml:"disableTraceContext" json:"disableTraceContext"`
+}
+
+// Request ID formats understood in RequestIDConfig.Format
+const (
+	RequestIDUUID = "uuid"
+	RequestIDULID = "ulid"
+)
+
+func (c *RequestIDConfig) validate() error {
+	switch c.Format {
+	case "", RequestIDUUID, RequestIDULID:
+	default:
+		return fmt.Errorf("unknown format %q (use %s or %s)", c.Format, RequestIDUUID, RequestIDULID)
+	}
+	return nil
+}
+
+// RequestIDProcessor makes sure every request has a request ID and a valid
+// W3C trace context. The chain calls Identify as soon as the request
+// headers arrive, so every log line of the stream carries the ID; the
+// RequestHeaders hook then forwards what Identify decided.
+type RequestIDProcessor struct {
+	BaseProcessor
+
+	generate func() string
+	header   string
+	trace    bool
+}
+
+// NewRequestIDProcessor creates the request ID processor; cfg may be nil
+func NewRequestIDProcessor(cfg *RequestIDConfig) (*RequestIDProcessor, error) {
+	if cfg == nil {
+		cfg = &RequestIDConfig{}
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	p := &RequestIDProcessor{
+		generate: newUUID,
+		header:   strings.ToLower(cfg.Header),
+		trace:    !cfg.DisableTraceContext,
+	}
+	if cfg.Format == RequestIDULID {
+		p.generate = newULID
+	}
+	if p.header == "" {
+		p.header = "x-request-id"
+	}
+	return p, nil
+}
+
+func (p *RequestIDProcessor) Name() string { return "request-id" }
+
+// requestIDStateKey remembers whether the ID was generated here
+const requestIDStateKey = "request-id:generated"
+
+// Identify sets sc.RequestID and sc.Trace from the request headers
+func (p *RequestIDProcessor) Identify(sc *StreamContext, headers *extprocv3.HttpHeaders) {
+	if id, ok := getHeader(headers, p.header); ok && validRequestID(id) {
+		sc.RequestID = id
+	} else {
+		sc.RequestID = p.generate()
+		sc.SetState(requestIDStateKey, true)
+	}
+
+	if !p.trace {
+		return
+	}
+	parent, _ := getHeader(headers, "traceparent")
+	state, _ := getHeader(headers, "tracestate")
+	sc.Trace = continueTrace(parent, state)
+}
+
+// RequestHeaders forwards the request ID and this hop's trace context
+func (p *RequestIDProcessor) RequestHeaders(sc *StreamContext, _ *extprocv3.HttpHeaders) (*Result, error) {
+	mutation := &extprocv3.HeaderMutation{}
+	if generated, _ := sc.State(requestIDStateKey).(bool); generated {
+		mutation.SetHeaders = append(mutation.SetHeaders, setHeader(p.header, sc.RequestID))
+	}
+	if sc.Trace != nil {
+		mutation.SetHeaders = append(mutation.SetHeaders, setHeader("traceparent", sc.Trace.Traceparent()))
+		if sc.Trace.State != "" {
+			mutation.SetHeaders = append(mutation.SetHeaders, setHeader("tracestate", sc.Trace.State))
+		} else {
+			mutation.RemoveHeaders = append(mutation.RemoveHeaders, "tracestate")
+		}
+	}
+	return &Result{HeaderMutation: mutation}, nil
+}
+
+// validRequestID accepts incoming IDs that are safe to log and forward
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() string {
+	var b [16]byte
+	randomBytes(b[:])
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	h := hex.EncodeToString(b[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+// crockford is the base32 alphabet used by ULIDs
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID returns a ULID: a 48-bit millisecond timestamp followed by 80
+// random bits, in Crockford base32. ULIDs sort by creation time.
+func newULID() string {
+	var b [16]byte
+	ms := uint64(time.Now().UnixMilli())
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(ms)
+		ms >>= 8
+	}
+	randomBytes(b[6:])
+
+	// 128 bits -> 26 characters of 5 bits, the first one only using 3
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+func randomBytes(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand only fails if the OS has no entropy source at all
+		panic(fmt.Sprintf("reading random bytes: %v", err))
+	}
+}
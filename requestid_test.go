@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestIDFormats(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	ulid := regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`)
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		u, l := newUUID(), newULID()
+		if !uuid.MatchString(u) {
+			t.Fatalf("newUUID() = %q", u)
+		}
+		if !ulid.MatchString(l) {
+			t.Fatalf("newULID() = %q", l)
+		}
+		if seen[u] || seen[l] {
+			t.Fatalf("%q or %q generated twice", u, l)
+		}
+		seen[u], seen[l] = true, true
+	}
+
+	// ULIDs sort by the millisecond they were made in
+	first := newULID()
+	time.Sleep(2 * time.Millisecond)
+	if second := newULID(); second[:10] <= first[:10] {
+		t.Errorf("ULID %q is not after %q", second, first)
+	}
+}
+
+func TestValidRequestID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"abc-123", true},
+		{"01J9Z3V7Q8ZJ1C6W5K2R3N4M5P", true},
+		{strings.Repeat("a", 128), true},
+		{"", false},
+		{strings.Repeat("a", 129), false},
+		{"with space", false},
+		{"line\nbreak", false},
+		{"café", false},
+	}
+	for _, tt := range tests {
+		if got := validRequestID(tt.id); got != tt.want {
+			t.Errorf("validRequestID(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestRequestIDProcessor(t *testing.T) {
+	if _, err := NewRequestIDProcessor(&RequestIDConfig{Format: "snowflake"}); err == nil {
+		t.Error("unknown format accepted")
+	}
+	p, err := NewRequestIDProcessor(&RequestIDConfig{Format: RequestIDULID, Header: "X-Correlation-ID"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A valid incoming ID is kept and not set again
+	sc := NewStreamContext(context.Background())
+	headers := testHeaders("x-correlation-id", "from-client",
+		"traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	p.Identify(sc, headers)
+	result, err := p.RequestHeaders(sc, headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, removed := headerChanges(result.HeaderMutation)
+	if sc.RequestID != "from-client" || set["x-correlation-id"] != "" {
+		t.Errorf("request ID %q, set %q: want the client's kept", sc.RequestID, set["x-correlation-id"])
+	}
+	if set["traceparent"] != sc.Trace.Traceparent() || !containsString(removed, "tracestate") {
+		t.Errorf("set %v, removed %v: want our traceparent and no tracestate", set, removed)
+	}
+
+	// An invalid one is replaced by a generated ID
+	sc = NewStreamContext(context.Background())
+	headers = testHeaders("x-correlation-id", "bad id")
+	p.Identify(sc, headers)
+	result, _ = p.RequestHeaders(sc, headers)
+	set, _ = headerChanges(result.HeaderMutation)
+	if len(sc.RequestID) != 26 || set["x-correlation-id"] != sc.RequestID {
+		t.Errorf("request ID %q, forwarded %q: want a new ULID", sc.RequestID, set["x-correlation-id"])
+	}
+
+	// With the trace context disabled the trace headers are left alone
+	p, _ = NewRequestIDProcessor(&RequestIDConfig{DisableTraceContext: true})
+	sc = NewStreamContext(context.Background())
+	p.Identify(sc, testHeaders())
+	result, _ = p.RequestHeaders(sc, testHeaders())
+	set, removed = headerChanges(result.HeaderMutation)
+	if sc.Trace != nil || set["traceparent"] != "" || len(removed) != 0 {
+		t.Errorf("trace %v, set %v, removed %v: want no trace context", sc.Trace, set, removed)
+	}
+	if len(set["x-request-id"]) != 36 {
+		t.Errorf("x-request-id %q, want a UUID", set["x-request-id"])
+	}
+}
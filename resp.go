@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// respClient is a minimal client for the Redis protocol (RESP2). It only
+// supports what the shared rate limiter needs: plain commands, pipelines
+// and scripts. Connections are pooled and re-dialled after any error.
+type respClient struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+
+	pool chan *respConn
+
+	// After a failed dial, further dials are skipped until downUntil so an
+	// unreachable store doesn't add a dial timeout to every request
+	mu        sync.Mutex
+	downUntil time.Time
+	closed    bool
+}
+
+// respError is an error reply from the server, such as NOSCRIPT
+type respError string
+
+func (e respError) Error() string { return string(e) }
+
+// errStoreDown is returned while dials are being skipped
+var errStoreDown = errors.New("store unreachable, not retrying yet")
+
+// errStoreClosed is returned once the client has been closed
+var errStoreClosed = errors.New("store client closed")
+
+type respConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newRespClient(addr, password string, db, poolSize int, timeout time.Duration) *respClient {
+	return &respClient{
+		addr:     addr,
+		password: password,
+		db:       db,
+		timeout:  timeout,
+		pool:     make(chan *respConn, poolSize),
+	}
+}
+
+// Do runs one command and returns its reply
+func (c *respClient) Do(ctx context.Context, args ...string) (interface{}, error) {
+	replies, err := c.Pipeline(ctx, [][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := replies[0].(respError); ok {
+		return nil, e
+	}
+	return replies[0], nil
+}
+
+// Pipeline sends several commands in one round-trip. Error replies are
+// returned as respError values in the result, not as err.
+func (c *respClient) Pipeline(ctx context.Context, cmds [][]string) ([]interface{}, error) {
+	conn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := c.roundTrip(ctx, conn, cmds)
+	if err != nil {
+		// The connection may have half a reply left in it; don't reuse it
+		conn.Close()
+		return nil, err
+	}
+	c.put(conn)
+	return replies, nil
+}
+
+func (c *respClient) roundTrip(ctx context.Context, conn *respConn, cmds [][]string) ([]interface{}, error) {
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	var buf []byte
+	for _, args := range cmds {
+		buf = appendCommand(buf, args)
+	}
+	if _, err := conn.Write(buf); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(cmds))
+	for i := range cmds {
+		reply, err := readReply(conn.r)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// get takes a pooled connection or dials a new one
+func (c *respClient) get(ctx context.Context) (*respConn, error) {
+	select {
+	case conn := <-c.pool:
+		return conn, nil
+	default:
+	}
+
+	c.mu.Lock()
+	down, closed := time.Now().Before(c.downUntil), c.closed
+	c.mu.Unlock()
+	if closed {
+		return nil, errStoreClosed
+	}
+	if down {
+		return nil, errStoreDown
+	}
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		c.mu.Lock()
+		c.downUntil = time.Now().Add(time.Second)
+		c.mu.Unlock()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *respClient) dial(ctx context.Context) (*respConn, error) {
+	dialer := net.Dialer{Timeout: c.timeout}
+	nc, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := &respConn{Conn: nc, r: bufio.NewReader(nc)}
+
+	var setup [][]string
+	if c.password != "" {
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	if len(setup) > 0 {
+		replies, err := c.roundTrip(ctx, conn, setup)
+		if err == nil {
+			for _, reply := range replies {
+				if e, ok := reply.(respError); ok {
+					err = e
+				}
+			}
+		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("connecting to %s: %w", c.addr, err)
+		}
+	}
+	return conn, nil
+}
+
+// put returns a healthy connection to the pool, or closes it if the pool
+// is full or the client closed
+func (c *respClient) put(conn *respConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		conn.Close()
+		return
+	}
+	select {
+	case c.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// Close closes the pooled connections. Commands still running finish, and
+// later ones fail with errStoreClosed.
+func (c *respClient) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for {
+		select {
+		case conn := <-c.pool:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// appendCommand encodes a command as a RESP array of bulk strings
+func appendCommand(buf []byte, args []string) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+// readReply reads one reply: string, int64, nil, respError or []interface{}
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return respError(body), nil
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("malformed bulk length %q", body)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		if data[n] != '\r' || data[n+1] != '\n' {
+			return nil, fmt.Errorf("bulk string longer than its length %d", n)
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("malformed array length %q", body)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unknown reply type %q", kind)
+	}
+}
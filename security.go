@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// SecurityConfig adds a standard set of security headers to every response
+// and strips headers that leak details about the upstream.
+// It needs responseHeaderMode: SEND in the Gloo Settings.
+//
+// Profile picks the defaults (strict, default or relaxed); any header set
+// here overrides the profile, and the value "off" leaves that header out.
+// "{nonce}" in the CSP is replaced with a fresh random nonce per request,
+// which is also passed to the backend in NonceHeader so it can tag its
+// inline scripts.
+//
+//	security:
+//	  profile: strict
+//	  csp: "default-src 'self'; script-src 'self' 'nonce-{nonce}'"
+//	  stripHeaders: [server, x-powered-by]
+type SecurityConfig struct {
+	Profile string `yaml:"profile" json:"profile"`
+
+	HSTS               string `yaml:"hsts" json:"hsts"`
+	ContentTypeOptions string `yaml:"contentTypeOptions" json:"contentTypeOptions"`
+	FrameOptions       string `yaml:"frameOptions" json:"frameOptions"`
+	ReferrerPolicy     string `yaml:"referrerPolicy" json:"referrerPolicy"`
+	PermissionsPolicy  string `yaml:"permissionsPolicy" json:"permissionsPolicy"`
+	CSP                string `yaml:"csp" json:"csp"`
+
+	// CSPReportOnly sends the CSP as Content-Security-Policy-Report-Only
+	CSPReportOnly bool `yaml:"cspReportOnly" json:"cspReportOnly"`
+
+	// NonceHeader is the request header that carries the CSP nonce to the
+	// backend (default x-csp-nonce)
+	NonceHeader string `yaml:"nonceHeader" json:"nonceHeader"`
+
+	// KeepUpstream leaves security headers the backend already set alone
+	// instead of overwriting them
+	KeepUpstream bool `yaml:"keepUpstream" json:"keepUpstream"`
+
+	// StripHeaders are removed from every response. If not set, the
+	// profile's list is used.
+	StripHeaders []string `yaml:"stripHeaders" json:"stripHeaders"`
+}
+
+// securityOff disables a header that the profile would otherwise send
+const securityOff = "off"
+
+// nonceMarker is replaced with the per-request nonce in the CSP
+const nonceMarker = "{nonce}"
+
+// securityProfiles are the built-in policy profiles
+var securityProfiles = map[string]SecurityConfig{
+	"strict": {
+		HSTS:               "max-age=63072000; includeSubDomains; preload",
+		ContentTypeOptions: "nosniff",
+		FrameOptions:       "DENY",
+		ReferrerPolicy:     "no-referrer",
+		PermissionsPolicy:  "accelerometer=(), camera=(), geolocation=(), gyroscope=(), microphone=(), payment=(), usb=()",
+		CSP:                "default-src 'self'; script-src 'self' 'nonce-{nonce}'; object-src 'none'; base-uri 'none'; frame-ancestors 'none'",
+		StripHeaders:       []string{"server", "x-powered-by", "x-aspnet-version", "x-aspnetmvc-version", "x-envoy-upstream-service-time"},
+	},
+	"default": {
+		HSTS:               "max-age=31536000; includeSubDomains",
+		ContentTypeOptions: "nosniff",
+		FrameOptions:       "SAMEORIGIN",
+		ReferrerPolicy:     "strict-origin-when-cross-origin",
+		PermissionsPolicy:  "camera=(), geolocation=(), microphone=()",
+		StripHeaders:       []string{"server", "x-powered-by", "x-aspnet-version", "x-aspnetmvc-version"},
+	},
+	"relaxed": {
+		HSTS:               "max-age=31536000",
+		ContentTypeOptions: "nosniff",
+		FrameOptions:       "SAMEORIGIN",
+		ReferrerPolicy:     "strict-origin-when-cross-origin",
+		StripHeaders:       []string{"x-powered-by"},
+	},
+}
+
+func (c *SecurityConfig) validate() error {
+	if _, ok := securityProfiles[c.profileName()]; !ok {
+		return fmt.Errorf("unknown profile %q (want strict, default or relaxed)", c.Profile)
+	}
+	return nil
+}
+
+func (c *SecurityConfig) profileName() string {
+	if c.Profile == "" {
+		return "default"
+	}
+	return strings.ToLower(c.Profile)
+}
+
+// securityHeader is one header the processor sets on responses
+type securityHeader struct {
+	name  string
+	value string
+}
+
+// SecurityHeadersProcessor adds security headers to responses
+type SecurityHeadersProcessor struct {
+	BaseProcessor
+
+	headers     []securityHeader
+	strip       []string
+	cspHeader   string
+	csp         string
+	nonceHeader string
+	action      corev3.HeaderValueOption_HeaderAppendAction
+}
+
+// NewSecurityHeadersProcessor resolves the profile and overrides into the
+// final list of headers
+func NewSecurityHeadersProcessor(cfg *SecurityConfig) (*SecurityHeadersProcessor, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	profile := securityProfiles[cfg.profileName()]
+
+	// pick returns the configured value, else the profile's; "" means leave it out
+	pick := func(configured, fromProfile string) string {
+		switch configured {
+		case "":
+			return fromProfile
+		case securityOff:
+			return ""
+		default:
+			return configured
+		}
+	}
+
+	p := &SecurityHeadersProcessor{
+		cspHeader:   "content-security-policy",
+		csp:         pick(cfg.CSP, profile.CSP),
+		nonceHeader: cfg.NonceHeader,
+		strip:       profile.StripHeaders,
+		action:      corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+	}
+	if cfg.CSPReportOnly {
+		p.cspHeader = "content-security-policy-report-only"
+	}
+	if p.nonceHeader == "" {
+		p.nonceHeader = "x-csp-nonce"
+	}
+	if cfg.StripHeaders != nil {
+		p.strip = cfg.StripHeaders
+	}
+	if cfg.KeepUpstream {
+		p.action = corev3.HeaderValueOption_ADD_IF_ABSENT
+	}
+
+	for _, h := range []securityHeader{
+		{"strict-transport-security", pick(cfg.HSTS, profile.HSTS)},
+		{"x-content-type-options", pick(cfg.ContentTypeOptions, profile.ContentTypeOptions)},
+		{"x-frame-options", pick(cfg.FrameOptions, profile.FrameOptions)},
+		{"referrer-policy", pick(cfg.ReferrerPolicy, profile.ReferrerPolicy)},
+		{"permissions-policy", pick(cfg.PermissionsPolicy, profile.PermissionsPolicy)},
+	} {
+		if h.value != "" {
+			p.headers = append(p.headers, h)
+		}
+	}
+	return p, nil
+}
+
+func (p *SecurityHeadersProcessor) Name() string { return "security-headers" }
+
+// usesNonce reports whether the CSP needs a per-request nonce
+func (p *SecurityHeadersProcessor) usesNonce() bool {
+	return strings.Contains(p.csp, nonceMarker)
+}
+
+// nonce returns this stream's CSP nonce, creating it on first use
+func (p *SecurityHeadersProcessor) nonce(sc *StreamContext) (string, error) {
+	if n, ok := sc.State(p.Name()).(string); ok {
+		return n, nil
+	}
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("generating CSP nonce: %w", err)
+	}
+	n := base64.StdEncoding.EncodeToString(raw)
+	sc.SetState(p.Name(), n)
+	return n, nil
+}
+
+// RequestHeaders hands the CSP nonce to the backend so it can use it in the page
+func (p *SecurityHeadersProcessor) RequestHeaders(sc *StreamContext, headers *extprocv3.HttpHeaders) (*Result, error) {
+	if !p.usesNonce() {
+		return nil, nil
+	}
+	n, err := p.nonce(sc)
+	if err != nil {
+		return nil, err
+	}
+	return &Result{
+		HeaderMutation: &extprocv3.HeaderMutation{
+			SetHeaders: []*corev3.HeaderValueOption{setHeader(p.nonceHeader, n)},
+		},
+	}, nil
+}
+
+// ResponseHeaders adds the security headers and strips the leaky ones
+func (p *SecurityHeadersProcessor) ResponseHeaders(sc *StreamContext, headers *extprocv3.HttpHeaders) (*Result, error) {
+	mutation := &extprocv3.HeaderMutation{RemoveHeaders: p.strip}
+	for _, h := range p.headers {
+		mutation.SetHeaders = append(mutation.SetHeaders, p.option(h.name, h.value))
+	}
+
+	if p.csp != "" {
+		csp := p.csp
+		if p.usesNonce() {
+			n, err := p.nonce(sc)
+			if err != nil {
+				return nil, err
+			}
+			csp = strings.ReplaceAll(csp, nonceMarker, n)
+		}
+		mutation.SetHeaders = append(mutation.SetHeaders, p.option(p.cspHeader, csp))
+	}
+
+	sc.Logger().Debugw("Adding security headers", "processor", p.Name(), "added", len(mutation.SetHeaders), "stripped", len(mutation.RemoveHeaders))
+	return &Result{HeaderMutation: mutation}, nil
+}
+
+func (p *SecurityHeadersProcessor) option(key, value string) *corev3.HeaderValueOption {
+	return &corev3.HeaderValueOption{
+		Header:       &corev3.HeaderValue{Key: key, Value: value},
+		AppendAction: p.action,
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// headerChanges returns the set headers as name: value and the removed names
+func headerChanges(mutation *extprocv3.HeaderMutation) (set map[string]string, removed []string) {
+	set = map[string]string{}
+	for _, h := range mutation.GetSetHeaders() {
+		set[h.GetHeader().GetKey()] = h.GetHeader().GetValue()
+	}
+	return set, mutation.GetRemoveHeaders()
+}
+
+// securityResponse runs the response hook of a security processor for cfg
+func securityResponse(t *testing.T, cfg SecurityConfig) *extprocv3.HeaderMutation {
+	t.Helper()
+	p, err := NewSecurityHeadersProcessor(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := p.ResponseHeaders(NewStreamContext(context.Background()), testHeaders(":status", "200"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result.HeaderMutation
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	mutation := securityResponse(t, SecurityConfig{})
+	set, removed := headerChanges(mutation)
+	want := map[string]string{
+		"strict-transport-security": "max-age=31536000; includeSubDomains",
+		"x-content-type-options":    "nosniff",
+		"x-frame-options":           "SAMEORIGIN",
+		"referrer-policy":           "strict-origin-when-cross-origin",
+		"permissions-policy":        "camera=(), geolocation=(), microphone=()",
+	}
+	if !reflect.DeepEqual(set, want) {
+		t.Errorf("default profile sets %v, want %v", set, want)
+	}
+	if !reflect.DeepEqual(removed, securityProfiles["default"].StripHeaders) {
+		t.Errorf("default profile strips %v", removed)
+	}
+	for _, h := range mutation.GetSetHeaders() {
+		if h.GetAppendAction() != corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD {
+			t.Errorf("%s is not overwritten", h.GetHeader().GetKey())
+		}
+	}
+
+	// Overrides win over the profile, and "off" leaves a header out
+	set, removed = headerChanges(securityResponse(t, SecurityConfig{
+		Profile:      "Relaxed",
+		FrameOptions: "DENY",
+		HSTS:         securityOff,
+		StripHeaders: []string{"server"},
+	}))
+	if set["x-frame-options"] != "DENY" || set["x-content-type-options"] != "nosniff" {
+		t.Errorf("relaxed profile with overrides sets %v", set)
+	}
+	if _, ok := set["strict-transport-security"]; ok {
+		t.Error("HSTS sent although it is off")
+	}
+	if len(removed) != 1 || removed[0] != "server" {
+		t.Errorf("stripped %v, want only the configured list", removed)
+	}
+
+	// With keepUpstream the backend's own headers stay
+	for _, h := range securityResponse(t, SecurityConfig{KeepUpstream: true}).GetSetHeaders() {
+		if h.GetAppendAction() != corev3.HeaderValueOption_ADD_IF_ABSENT {
+			t.Errorf("%s overwrites the backend's value", h.GetHeader().GetKey())
+		}
+	}
+
+	set, _ = headerChanges(securityResponse(t, SecurityConfig{CSP: "default-src 'self'", CSPReportOnly: true}))
+	if set["content-security-policy-report-only"] != "default-src 'self'" || set["content-security-policy"] != "" {
+		t.Errorf("report-only CSP sent as %v", set)
+	}
+
+	if _, err := NewSecurityHeadersProcessor(&SecurityConfig{Profile: "paranoid"}); err == nil {
+		t.Error("unknown profile accepted")
+	}
+}
+
+func TestSecurityCSPNonce(t *testing.T) {
+	p, err := NewSecurityHeadersProcessor(&SecurityConfig{Profile: "strict", NonceHeader: "x-nonce"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		sc := NewStreamContext(context.Background())
+		request, err := p.RequestHeaders(sc, testHeaders(":path", "/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := p.ResponseHeaders(sc, testHeaders(":status", "200"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		forwarded, _ := headerChanges(request.HeaderMutation)
+		set, _ := headerChanges(response.HeaderMutation)
+
+		nonce := forwarded["x-nonce"]
+		if raw, err := base64.StdEncoding.DecodeString(nonce); err != nil || len(raw) != 16 {
+			t.Fatalf("nonce %q is not 16 random bytes", nonce)
+		}
+		// The backend tags its scripts with the nonce the CSP allows
+		if csp := set["content-security-policy"]; !strings.Contains(csp, "'nonce-"+nonce+"'") || strings.Contains(csp, nonceMarker) {
+			t.Fatalf("CSP %q does not carry the nonce %q", csp, nonce)
+		}
+		if seen[nonce] {
+			t.Fatalf("nonce %q used for two requests", nonce)
+		}
+		seen[nonce] = true
+	}
+
+	// Without a nonce in the CSP the backend gets none
+	p, _ = NewSecurityHeadersProcessor(&SecurityConfig{CSP: "default-src 'self'"})
+	if result, _ := p.RequestHeaders(NewStreamContext(context.Background()), testHeaders(":path", "/")); result != nil {
+		t.Errorf("nonce forwarded for a CSP without one: %v", result.HeaderMutation)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/solo-io/go-utils/healthchecker"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	grpchealth "google.golang.org/grpc/health"
+)
+
+// Drainer takes the service out of rotation on SIGTERM and stops it once
+// the open streams have finished, so rollouts don't cut requests:
+//
+//  1. gRPC health and HTTP /health report NOT_SERVING, and gRPC health
+//     checks tell Envoy to fail the host straight away
+//  2. the drain period gives Envoy and Kubernetes time to stop sending new
+//     streams; open and new streams are still served
+//  3. GracefulStop stops accepting streams and waits for the open ones,
+//     up to the shutdown timeout, after which they are cut
+//  4. queued spans are flushed and the HTTP server is stopped
+type Drainer struct {
+	drainPeriod time.Duration
+	timeout     time.Duration
+	logger      *zap.SugaredLogger
+
+	serving  atomic.Bool
+	ctx      context.Context
+	draining context.CancelFunc
+}
+
+// NewDrainer creates a drainer that reports serving until Shutdown is called
+func NewDrainer(drainPeriod, timeout time.Duration, logger *zap.SugaredLogger) *Drainer {
+	d := &Drainer{drainPeriod: drainPeriod, timeout: timeout, logger: logger}
+	d.ctx, d.draining = context.WithCancel(context.Background())
+	d.serving.Store(true)
+	return d
+}
+
+// Serving reports whether the service should still get new traffic
+func (d *Drainer) Serving() bool {
+	return d.serving.Load()
+}
+
+// HealthCheckInterceptor makes gRPC health checks send
+// x-envoy-immediate-health-check-fail once draining has started
+func (d *Drainer) HealthCheckInterceptor() grpc.UnaryServerInterceptor {
+	return healthchecker.GrpcUnaryServerHealthCheckerInterceptor(d.ctx)
+}
+
+// HealthHandler serves /health: 200 OK while serving, 503 while draining
+func (d *Drainer) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	if !d.Serving() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("NOT_SERVING"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// Shutdown runs the shutdown sequence. Another signal on sigs skips
+// what is left of the drain period.
+func (d *Drainer) Shutdown(sigs <-chan os.Signal, grpcServer *grpc.Server, httpServer *http.Server,
+	hc healthchecker.HealthChecker, health *grpchealth.Server) {
+	start := time.Now()
+
+	// 1. Out of rotation
+	d.serving.Store(false)
+	d.draining()
+	hc.Fail()
+	health.Shutdown()
+	d.logger.Infow("Health set to NOT_SERVING, draining",
+		"drain_period", d.drainPeriod, "open_streams", metrics.ActiveStreams.Value())
+
+	// 2. Keep serving while traffic moves elsewhere
+	select {
+	case <-time.After(d.drainPeriod):
+	case sig := <-sigs:
+		d.logger.Infow("Received another signal, skipping the rest of the drain period", "signal", sig.String())
+	}
+
+	// 3. Let open streams finish, up to the deadline
+	d.logger.Infow("Stopping gRPC server, waiting for open streams",
+		"timeout", d.timeout, "open_streams", metrics.ActiveStreams.Value())
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		d.logger.Infow("All streams finished")
+	case <-time.After(d.timeout):
+		d.logger.Warnw("Shutdown timeout reached, closing the remaining streams",
+			"open_streams", metrics.ActiveStreams.Value())
+		grpcServer.Stop()
+		<-stopped
+	}
+
+	// 4. Send what's left and stop the admin server
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := FlushTracers(ctx); err != nil {
+		d.logger.Warnw("Failed to flush spans", "error", err)
+	}
+	if err := httpServer.Shutdown(ctx); err != nil {
+		d.logger.Warnw("Failed to stop health check server", "error", err)
+	}
+	d.logger.Infow("Shutdown complete", "duration", time.Since(start))
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"github.com/solo-io/go-utils/healthchecker"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func requestHeadersMessage() *extprocv3.ProcessingRequest {
+	return &extprocv3.ProcessingRequest{
+		Request: &extprocv3.ProcessingRequest_RequestHeaders{RequestHeaders: testHeaders(":path", "/")},
+	}
+}
+
+// drainTest is the gRPC and admin servers of main, wired to a Drainer
+// whose Shutdown has started
+type drainTest struct {
+	drainer    *Drainer
+	conn       *grpc.ClientConn
+	sigs       chan os.Signal
+	httpClosed chan error
+	done       chan struct{}
+}
+
+func newDrainTest(t *testing.T, drainPeriod, timeout time.Duration) *drainTest {
+	t.Helper()
+	d := NewDrainer(drainPeriod, timeout, zap.NewNop().Sugar())
+
+	chain, err := BuildChain(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer(grpc.ChainUnaryInterceptor(d.HealthCheckInterceptor()))
+	extprocv3.RegisterExternalProcessorServer(grpcServer, NewExtProcServer(chain))
+	healthServer := grpchealth.NewServer()
+	hc := healthchecker.NewGrpc("ext-proc", healthServer, false, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(grpcServer, hc.GetServer())
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+
+	httpLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := &http.Server{Handler: http.HandlerFunc(d.HealthHandler)}
+	dt := &drainTest{drainer: d, sigs: make(chan os.Signal, 1), httpClosed: make(chan error, 1), done: make(chan struct{})}
+	go func() { dt.httpClosed <- httpServer.Serve(httpLis) }()
+	t.Cleanup(func() { httpServer.Close() })
+
+	dt.conn, err = grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dt.conn.Close() })
+
+	go func() {
+		d.Shutdown(dt.sigs, grpcServer, httpServer, hc, healthServer)
+		close(dt.done)
+	}()
+	return dt
+}
+
+// openStream starts an ext_proc stream and checks it is answered
+func (dt *drainTest) openStream(t *testing.T) extprocv3.ExternalProcessor_ProcessClient {
+	t.Helper()
+	stream, err := extprocv3.NewExternalProcessorClient(dt.conn).Process(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt.exchange(t, stream)
+	return stream
+}
+
+func (dt *drainTest) exchange(t *testing.T, stream extprocv3.ExternalProcessor_ProcessClient) {
+	t.Helper()
+	if err := stream.Send(requestHeadersMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("stream not served: %v", err)
+	}
+}
+
+// closeStream ends a stream the way Envoy does when the request is done
+func closeStream(t *testing.T, stream extprocv3.ExternalProcessor_ProcessClient) {
+	t.Helper()
+	stream.CloseSend()
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("stream ended with %v, want EOF", err)
+	}
+}
+
+func (dt *drainTest) stopped() bool {
+	select {
+	case <-dt.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestDrainerShutdownOrder(t *testing.T) {
+	const drainPeriod = 300 * time.Millisecond
+	d := NewDrainer(drainPeriod, 10*time.Second, zap.NewNop().Sugar())
+	if !d.Serving() {
+		t.Fatal("new drainer is not serving")
+	}
+	rec := httptest.NewRecorder()
+	d.HealthHandler(rec, httptest.NewRequest("GET", "/health", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "OK" {
+		t.Fatalf("/health before shutdown = %d %q", rec.Code, rec.Body.String())
+	}
+
+	start := time.Now()
+	dt := newDrainTest(t, drainPeriod, 10*time.Second)
+	d = dt.drainer
+
+	// 1. Out of rotation straight away
+	for d.Serving() {
+		time.Sleep(time.Millisecond)
+	}
+	rec = httptest.NewRecorder()
+	d.HealthHandler(rec, httptest.NewRequest("GET", "/health", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "NOT_SERVING" {
+		t.Errorf("/health while draining = %d %q", rec.Code, rec.Body.String())
+	}
+	var header metadata.MD
+	resp, err := healthpb.NewHealthClient(dt.conn).Check(context.Background(),
+		&healthpb.HealthCheckRequest{Service: "ext-proc"}, grpc.Header(&header))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetStatus() != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("gRPC health while draining = %v", resp.GetStatus())
+	}
+	if _, ok := header["x-envoy-immediate-health-check-fail"]; !ok {
+		t.Errorf("health check headers %v, want x-envoy-immediate-health-check-fail", header)
+	}
+
+	// 2. Streams are still served during the drain period
+	first := dt.openStream(t)
+	second := dt.openStream(t)
+	if elapsed := time.Since(start); elapsed >= drainPeriod {
+		t.Fatalf("test too slow to check the drain period (%v)", elapsed)
+	}
+
+	// 3. After the drain period the open streams are waited for
+	time.Sleep(drainPeriod + 100*time.Millisecond)
+	if dt.stopped() {
+		t.Fatal("shutdown finished with streams still open")
+	}
+	dt.exchange(t, first)
+	closeStream(t, first)
+	if dt.stopped() {
+		t.Fatal("shutdown finished with a stream still open")
+	}
+	closeStream(t, second)
+
+	// 4. Then the admin server stops
+	select {
+	case <-dt.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not finish once the streams had ended")
+	}
+	if err := <-dt.httpClosed; !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("admin server ended with %v", err)
+	}
+}
+
+func TestDrainerShutdownTimeout(t *testing.T) {
+	dt := newDrainTest(t, time.Hour, 100*time.Millisecond)
+	for dt.drainer.Serving() {
+		time.Sleep(time.Millisecond)
+	}
+	stream := dt.openStream(t)
+
+	// A second signal skips the drain period; the stream that doesn't end
+	// is cut at the timeout
+	dt.sigs <- syscall.SIGTERM
+	select {
+	case <-dt.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not finish at the timeout")
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.Unavailable {
+		t.Errorf("open stream ended with %v, want Unavailable", err)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	extprocfilterv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// StreamBodyConfig lists find/replace changes that are applied to the body
+// chunk by chunk, so bodies of any size can be rewritten without buffering.
+//
+// Mode must match the requestBodyMode / responseBodyMode set in the Gloo
+// Settings (STREAMED by default). The server cannot see the mode on the wire,
+// and it decides how chunk boundaries and Content-Length are handled:
+//
+//   - STREAMED: a match split across two chunks is still found, because the
+//     last few bytes of a chunk are held back until the next chunk arrives.
+//     Trailers can't carry body bytes, so bodies that may end with trailers
+//     (gRPC, or a Trailer header) hold nothing back and such matches are missed.
+//     If trailers nobody announced end a body while bytes are held back, the
+//     trailers message fails under the processor's failure policy.
+//   - BUFFERED: the single chunk is the whole body; Content-Length is updated
+//   - BUFFERED_PARTIAL: only the first chunk is seen, so nothing is held back
+//   - NONE: no body is sent, the rules are not used
+type StreamBodyConfig struct {
+	Mode     string        `yaml:"mode" json:"mode"`
+	Request  []ReplaceRule `yaml:"request" json:"request"`
+	Response []ReplaceRule `yaml:"response" json:"response"`
+}
+
+// ReplaceRule replaces every occurrence of Find with Replace
+type ReplaceRule struct {
+	Find    string `yaml:"find" json:"find"`
+	Replace string `yaml:"replace" json:"replace"`
+}
+
+// IsEmpty reports whether there are no streaming changes at all
+func (c StreamBodyConfig) IsEmpty() bool {
+	return len(c.Request) == 0 && len(c.Response) == 0
+}
+
+func (c StreamBodyConfig) validate() error {
+	if _, err := parseBodySendMode(c.Mode); err != nil {
+		return err
+	}
+	for i, r := range c.Request {
+		if r.Find == "" {
+			return fmt.Errorf("request[%d]: find is required", i)
+		}
+	}
+	for i, r := range c.Response {
+		if r.Find == "" {
+			return fmt.Errorf("response[%d]: find is required", i)
+		}
+	}
+	return nil
+}
+
+// replacer is the compiled form of a list of ReplaceRules
+type replacer struct {
+	find    [][]byte
+	replace [][]byte
+
+	// changesLength is true if any rule makes the body longer or shorter
+	changesLength bool
+}
+
+func newReplacer(rules []ReplaceRule) *replacer {
+	r := &replacer{}
+	for _, rule := range rules {
+		r.find = append(r.find, []byte(rule.Find))
+		r.replace = append(r.replace, []byte(rule.Replace))
+		if len(rule.Find) != len(rule.Replace) {
+			r.changesLength = true
+		}
+	}
+	return r
+}
+
+// apply runs the replacements over data. Unless final is set, a tail of
+// data that could be the start of a match is returned as rest instead of
+// being written to out, so it can be retried with the next chunk.
+// Rules are tried in order at each position; the first match wins.
+func (r *replacer) apply(data []byte, final bool) (out, rest []byte) {
+	var buf bytes.Buffer
+	i := 0
+scan:
+	for i < len(data) {
+		for n, find := range r.find {
+			if bytes.HasPrefix(data[i:], find) {
+				buf.Write(r.replace[n])
+				i += len(find)
+				continue scan
+			}
+		}
+		if !final {
+			for _, find := range r.find {
+				if len(data)-i < len(find) && bytes.HasPrefix(find, data[i:]) {
+					// Might be the start of a match; wait for more data
+					break scan
+				}
+			}
+		}
+		buf.WriteByte(data[i])
+		i++
+	}
+	return buf.Bytes(), data[i:]
+}
+
+// StreamReplaceProcessor does literal find/replace on request and response
+// bodies as they stream through, one chunk at a time
+type StreamReplaceProcessor struct {
+	BaseProcessor
+
+	name     string
+	mode     extprocfilterv3.ProcessingMode_BodySendMode
+	request  *replacer
+	response *replacer
+}
+
+// NewStreamReplaceProcessor builds the processor for a set of streaming body changes
+func NewStreamReplaceProcessor(name string, cfg StreamBodyConfig) (*StreamReplaceProcessor, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	mode, _ := parseBodySendMode(cfg.Mode)
+	return &StreamReplaceProcessor{
+		name:     name,
+		mode:     mode,
+		request:  newReplacer(cfg.Request),
+		response: newReplacer(cfg.Response),
+	}, nil
+}
+
+func (p *StreamReplaceProcessor) Name() string { return p.name }
+
+// RequestHeaders drops Content-Length if the body is going to change size
+// as it streams; the header can't be fixed once the body is on its way
+func (p *StreamReplaceProcessor) RequestHeaders(sc *StreamContext, headers *extprocv3.HttpHeaders) (*Result, error) {
+	return p.headers(p.request, &sc.RequestBody), nil
+}
+
+// ResponseHeaders does the same as RequestHeaders for the response body
+func (p *StreamReplaceProcessor) ResponseHeaders(sc *StreamContext, headers *extprocv3.HttpHeaders) (*Result, error) {
+	return p.headers(p.response, &sc.ResponseBody), nil
+}
+
+// RequestBody rewrites one request body chunk
+func (p *StreamReplaceProcessor) RequestBody(sc *StreamContext, body *extprocv3.HttpBody) (*Result, error) {
+	return p.chunk(sc, p.name+":request", p.request, &sc.RequestBody, sc.RequestHeaders, body), nil
+}
+
+// ResponseBody rewrites one response body chunk
+func (p *StreamReplaceProcessor) ResponseBody(sc *StreamContext, body *extprocv3.HttpBody) (*Result, error) {
+	return p.chunk(sc, p.name+":response", p.response, &sc.ResponseBody, sc.ResponseHeaders, body), nil
+}
+
+// RequestTrailers fails if request body bytes are still held back
+func (p *StreamReplaceProcessor) RequestTrailers(sc *StreamContext, trailers *extprocv3.HttpTrailers) (*Result, error) {
+	return nil, p.checkPending(sc, p.name+":request")
+}
+
+// ResponseTrailers fails if response body bytes are still held back
+func (p *StreamReplaceProcessor) ResponseTrailers(sc *StreamContext, trailers *extprocv3.HttpTrailers) (*Result, error) {
+	return nil, p.checkPending(sc, p.name+":response")
+}
+
+func (p *StreamReplaceProcessor) headers(r *replacer, stream *BodyStream) *Result {
+	if len(r.find) == 0 || !stream.Expected || !r.changesLength {
+		return nil
+	}
+	if p.mode != extprocfilterv3.ProcessingMode_STREAMED && p.mode != extprocfilterv3.ProcessingMode_BUFFERED_PARTIAL {
+		return nil
+	}
+	return &Result{HeaderMutation: &extprocv3.HeaderMutation{RemoveHeaders: []string{"content-length"}}}
+}
+
+func (p *StreamReplaceProcessor) chunk(sc *StreamContext, key string, r *replacer, stream *BodyStream, headers *extprocv3.HttpHeaders, body *extprocv3.HttpBody) *Result {
+	if len(r.find) == 0 || p.mode == extprocfilterv3.ProcessingMode_NONE {
+		return nil
+	}
+
+	// Bytes held back from the previous chunk go in front of this one
+	data := body.GetBody()
+	pending, _ := sc.State(key).([]byte)
+	if len(pending) > 0 {
+		data = append(append([]byte{}, pending...), data...)
+	}
+
+	// Only STREAMED mode sends more chunks, so only then is it safe to hold
+	// back. A body that ends with trailers has no last chunk to flush on.
+	final := stream.EndOfStream || p.mode != extprocfilterv3.ProcessingMode_STREAMED || trailersExpected(headers)
+	out, rest := r.apply(data, final)
+	sc.SetState(key, append([]byte(nil), rest...))
+
+	if len(pending) == 0 && len(rest) == 0 && bytes.Equal(out, body.GetBody()) {
+		return nil
+	}
+	sc.Logger().Debugw("Rewrote body chunk", "processor", p.name, "chunk", stream.Index,
+		"bytes_in", len(body.GetBody()), "bytes_out", len(out), "held_back", len(rest))
+
+	if len(out) == 0 {
+		return ClearChunk()
+	}
+	result := ReplaceChunk(out)
+	if p.mode == extprocfilterv3.ProcessingMode_BUFFERED && stream.Whole() {
+		result.HeaderMutation = &extprocv3.HeaderMutation{
+			SetHeaders: []*corev3.HeaderValueOption{setHeader("content-length", strconv.Itoa(len(out)))},
+		}
+	}
+	return result
+}
+
+// heldBackKey names the state holding the bytes held back from the body
+// the message of phase belongs to, for message deadline fallbacks
+func (p *StreamReplaceProcessor) heldBackKey(phase Phase) string {
+	switch phase {
+	case PhaseRequestBody, PhaseRequestTrailers:
+		return p.name + ":request"
+	case PhaseResponseBody, PhaseResponseTrailers:
+		return p.name + ":response"
+	}
+	return ""
+}
+
+// checkPending fails if bytes were held back for a body that ended with
+// trailers nobody announced: a trailers response can't carry body bytes,
+// so the body would reach the other side cut short
+func (p *StreamReplaceProcessor) checkPending(sc *StreamContext, key string) error {
+	if pending, _ := sc.State(key).([]byte); len(pending) > 0 {
+		return fmt.Errorf("body ended with unannounced trailers while %d bytes were held back", len(pending))
+	}
+	return nil
+}
+
+// trailersExpected reports whether a body may end with trailers instead of
+// a last chunk: gRPC bodies do, and HTTP/1.1 announces them with Trailer
+func trailersExpected(headers *extprocv3.HttpHeaders) bool {
+	if _, ok := getHeader(headers, "trailer"); ok {
+		return true
+	}
+	contentType, _ := getHeader(headers, "content-type")
+	return strings.HasPrefix(strings.ToLower(contentType), "application/grpc")
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+func TestStreamReplaceChunks(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers *extprocv3.HttpHeaders
+		chunks  []string
+		// trailers ends the body with trailers instead of end_of_stream
+		trailers bool
+		// want is what goes upstream for each chunk
+		want []string
+		// failed is true if the trailers hook fails because bytes were
+		// still held back
+		failed bool
+	}{
+		{
+			name:    "match split across chunks",
+			headers: testHeaders("content-type", "text/plain"),
+			chunks:  []string{"a sec", "ret b"},
+			want:    []string{"a ", "[x] b"},
+		},
+		{
+			name:     "announced trailers hold nothing back",
+			headers:  testHeaders("content-type", "text/plain", "trailer", "x-checksum"),
+			chunks:   []string{"a sec", "ret secret"},
+			trailers: true,
+			want:     []string{"a sec", "ret [x]"},
+		},
+		{
+			name:     "gRPC holds nothing back",
+			headers:  testHeaders("content-type", "application/grpc+proto"),
+			chunks:   []string{"a sec", "ret"},
+			trailers: true,
+			want:     []string{"a sec", "ret"},
+		},
+		{
+			name:     "unannounced trailers after a full chunk",
+			headers:  testHeaders("content-type", "text/plain"),
+			chunks:   []string{"a secret"},
+			trailers: true,
+			want:     []string{"a [x]"},
+		},
+		{
+			name:     "unannounced trailers with bytes held back",
+			headers:  testHeaders("content-type", "text/plain"),
+			chunks:   []string{"a sec"},
+			trailers: true,
+			want:     []string{"a "},
+			failed:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewStreamReplaceProcessor("stream", StreamBodyConfig{
+				Request: []ReplaceRule{{Find: "secret", Replace: "[x]"}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sc := NewStreamContext(context.Background())
+			sc.RequestHeaders = tt.headers
+			if _, err := p.RequestHeaders(sc, tt.headers); err != nil {
+				t.Fatal(err)
+			}
+			for i, chunk := range tt.chunks {
+				last := i == len(tt.chunks)-1
+				body := &extprocv3.HttpBody{Body: []byte(chunk), EndOfStream: last && !tt.trailers}
+				sc.RequestBody.next(body)
+				result, err := p.RequestBody(sc, body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := chunk
+				if result != nil {
+					got = string(result.BodyMutation.GetBody())
+				}
+				if got != tt.want[i] {
+					t.Errorf("chunk %d = %q, want %q", i, got, tt.want[i])
+				}
+			}
+			if tt.trailers {
+				_, err := p.RequestTrailers(sc, &extprocv3.HttpTrailers{})
+				if failed := err != nil; failed != tt.failed {
+					t.Fatalf("trailers failed = %v (%v), want %v", failed, err, tt.failed)
+				}
+				if tt.failed {
+					return
+				}
+			}
+			if pending, _ := sc.State("stream:request").([]byte); len(pending) > 0 {
+				t.Errorf("%q still held back at the end of the body", pending)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/solo-io/go-utils/contextutils"
+	"google.golang.org/grpc/credentials"
+)
+
+// ServerTLS serves the gRPC listener's certificate and, with a client CA,
+// verifies Envoy's client certificate (mutual TLS). Callers can be
+// narrowed further to an allow-list of SPIFFE IDs or SANs.
+//
+// The certificate, key and CA files are checked for changes from the
+// handshake path, at most once per interval, so rotated certificates (for
+// example a renewed Kubernetes secret) are picked up without a restart.
+// Open connections keep the certificate they were set up with.
+type ServerTLS struct {
+	certFile, keyFile, clientCAFile string
+	allowedSPIFFEIDs, allowedSANs   []string
+	interval                        time.Duration
+
+	mu        sync.Mutex
+	config    atomic.Pointer[tls.Config]
+	lastCheck atomic.Int64 // unix nanos of the last check
+	lastHash  [sha256.Size]byte
+}
+
+// NewServerTLS loads the certificate files once and fails if they can't be
+// used
+func NewServerTLS(o *Options) (*ServerTLS, error) {
+	s := &ServerTLS{
+		certFile:         o.TLSCertFile,
+		keyFile:          o.TLSKeyFile,
+		clientCAFile:     o.TLSClientCAFile,
+		allowedSPIFFEIDs: o.TLSAllowedSPIFFEIDs,
+		allowedSANs:      o.TLSAllowedSANs,
+		interval:         o.TLSReloadInterval,
+	}
+	data, hash, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	config, err := s.build(data)
+	if err != nil {
+		return nil, err
+	}
+	s.config.Store(config)
+	s.lastHash = hash
+	s.lastCheck.Store(time.Now().UnixNano())
+	return s, nil
+}
+
+// Credentials returns the transport credentials for grpc.NewServer
+func (s *ServerTLS) Credentials() credentials.TransportCredentials {
+	return credentials.NewTLS(&tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return s.current(), nil
+		},
+	})
+}
+
+// MutualTLS reports whether client certificates are required
+func (s *ServerTLS) MutualTLS() bool {
+	return s.clientCAFile != ""
+}
+
+// current returns the config for a new handshake, reloading the files
+// first if the check interval has passed and they changed
+func (s *ServerTLS) current() *tls.Config {
+	if s.interval > 0 && time.Since(time.Unix(0, s.lastCheck.Load())) >= s.interval {
+		// Only one handshake does the check; the others use the current config
+		if s.mu.TryLock() {
+			s.reload()
+			s.mu.Unlock()
+		}
+	}
+	return s.config.Load()
+}
+
+func (s *ServerTLS) reload() {
+	s.lastCheck.Store(time.Now().UnixNano())
+	logger := contextutils.LoggerFrom(context.Background())
+	data, hash, err := s.read()
+	if err != nil {
+		logger.Errorw("Reloading TLS certificate failed, keeping the current one", "error", err)
+		return
+	}
+	if hash == s.lastHash {
+		return
+	}
+	config, err := s.build(data)
+	if err != nil {
+		// lastHash stays as it was: the certificate and key are often
+		// written one after the other, so a mismatch is retried on the
+		// next check
+		logger.Errorw("Reloading TLS certificate failed, keeping the current one", "error", err)
+		return
+	}
+	s.config.Store(config)
+	s.lastHash = hash
+	logger.Infow("Reloaded TLS certificate", "cert", s.certFile, "not_after", certNotAfter(config))
+}
+
+// tlsFiles is the content of the certificate, key and CA files
+type tlsFiles struct {
+	cert, key, clientCA []byte
+}
+
+func (s *ServerTLS) read() (tlsFiles, [sha256.Size]byte, error) {
+	var data tlsFiles
+	var err error
+	if data.cert, err = os.ReadFile(s.certFile); err != nil {
+		return data, [sha256.Size]byte{}, err
+	}
+	if data.key, err = os.ReadFile(s.keyFile); err != nil {
+		return data, [sha256.Size]byte{}, err
+	}
+	if s.clientCAFile != "" {
+		if data.clientCA, err = os.ReadFile(s.clientCAFile); err != nil {
+			return data, [sha256.Size]byte{}, err
+		}
+	}
+	h := sha256.New()
+	for _, b := range [][]byte{data.cert, data.key, data.clientCA} {
+		fmt.Fprintf(h, "%d:", len(b))
+		h.Write(b)
+	}
+	var hash [sha256.Size]byte
+	copy(hash[:], h.Sum(nil))
+	return data, hash, nil
+}
+
+// build turns the file content into a server config
+func (s *ServerTLS) build(data tlsFiles) (*tls.Config, error) {
+	cert, err := tls.X509KeyPair(data.cert, data.key)
+	if err != nil {
+		return nil, fmt.Errorf("%s and %s: %w", s.certFile, s.keyFile, err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.certFile, err)
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		// gRPC runs over HTTP/2; the config returned from
+		// GetConfigForClient replaces the one credentials.NewTLS set it on
+		NextProtos: []string{"h2"},
+	}
+	if data.clientCA != nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data.clientCA) {
+			return nil, fmt.Errorf("%s: no PEM certificates found", s.clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.VerifyConnection = s.verifyPeer
+	}
+	return config, nil
+}
+
+// verifyPeer checks an already verified client certificate against the
+// allow-lists. With no lists any certificate signed by the CA is accepted.
+func (s *ServerTLS) verifyPeer(cs tls.ConnectionState) error {
+	if len(s.allowedSPIFFEIDs) == 0 && len(s.allowedSANs) == 0 {
+		return nil
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("no client certificate")
+	}
+	leaf := cs.PeerCertificates[0]
+	for _, u := range leaf.URIs {
+		if u.Scheme == "spiffe" && matchesAny(s.allowedSPIFFEIDs, u.String()) {
+			return nil
+		}
+	}
+	sans := certSANs(leaf)
+	for _, san := range sans {
+		if matchesAny(s.allowedSANs, san) {
+			return nil
+		}
+	}
+	metrics.TLSRejections.Inc("not_allowed")
+	contextutils.LoggerFrom(context.Background()).Warnw("Rejected TLS client: certificate is not in the allow-list",
+		"subject", leaf.Subject.String(), "sans", sans)
+	return fmt.Errorf("client certificate %q is not allowed", leaf.Subject.String())
+}
+
+// certSANs lists a certificate's subject alternative names
+func certSANs(cert *x509.Certificate) []string {
+	var sans []string
+	sans = append(sans, cert.DNSNames...)
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	sans = append(sans, cert.EmailAddresses...)
+	return sans
+}
+
+// matchesAny reports whether s matches one of the patterns. A pattern is
+// matched exactly, except that one "*" matches any run of characters:
+// "spiffe://cluster.local/ns/gloo-system/*" or "*.gloo-system.svc".
+func matchesAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		before, after, wildcard := strings.Cut(p, "*")
+		if !wildcard {
+			if p == s {
+				return true
+			}
+			continue
+		}
+		if len(s) >= len(before)+len(after) && strings.HasPrefix(s, before) && strings.HasSuffix(s, after) {
+			return true
+		}
+	}
+	return false
+}
+
+func certNotAfter(config *tls.Config) time.Time {
+	return config.Certificates[0].Leaf.NotAfter
+}
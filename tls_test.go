@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+var testSerial int64
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSerial++
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(testSerial),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM leaf certificate and key with the given SANs; names
+// with a scheme are URI SANs, the others DNS names
+func (ca *testCA) issue(t *testing.T, names ...string) (certPEM, keyPEM []byte, serial int64) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSerial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(testSerial),
+		Subject:      pkix.Name{CommonName: names[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, name := range names {
+		if u, err := url.Parse(name); err == nil && u.Scheme != "" {
+			template.URIs = append(template.URIs, u)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		testSerial
+}
+
+func (ca *testCA) clientCert(t *testing.T, names ...string) *tls.Certificate {
+	t.Helper()
+	certPEM, keyPEM, _ := ca.issue(t, names...)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cert
+}
+
+// newTestServerTLS writes a server certificate signed by ca and returns
+// the ServerTLS for it
+func newTestServerTLS(t *testing.T, ca *testCA, o *Options) *ServerTLS {
+	t.Helper()
+	dir := t.TempDir()
+	o.TLSCertFile = filepath.Join(dir, "tls.crt")
+	o.TLSKeyFile = filepath.Join(dir, "tls.key")
+	o.TLSClientCAFile = filepath.Join(dir, "ca.crt")
+	certPEM, keyPEM, _ := ca.issue(t, "extproc.test")
+	writeTestFile(t, o.TLSCertFile, certPEM)
+	writeTestFile(t, o.TLSKeyFile, keyPEM)
+	writeTestFile(t, o.TLSClientCAFile, ca.pem)
+	s, err := NewServerTLS(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// handshake connects to s with the client certificate, if any, and
+// returns the server's certificate and the server side's handshake error
+func handshake(t *testing.T, s *ServerTLS, ca *testCA, client *tls.Certificate) (*x509.Certificate, error) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		conn := tls.Server(serverConn, &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return s.current(), nil
+			},
+		})
+		err := conn.Handshake()
+		// Closing tells the client whether its certificate was accepted
+		serverConn.Close()
+		serverErr <- err
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	config := &tls.Config{RootCAs: roots, ServerName: "extproc.test", NextProtos: []string{"h2"}}
+	if client != nil {
+		config.Certificates = []tls.Certificate{*client}
+	}
+	conn := tls.Client(clientConn, config)
+	var leaf *x509.Certificate
+	if conn.Handshake() == nil {
+		leaf = conn.ConnectionState().PeerCertificates[0]
+	}
+	clientConn.Close()
+	return leaf, <-serverErr
+}
+
+func TestMatchesAny(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"spiffe://cluster.local/ns/gloo/sa/envoy", "spiffe://cluster.local/ns/gloo/sa/envoy", true},
+		{"spiffe://cluster.local/ns/gloo/sa/envoy", "spiffe://cluster.local/ns/gloo/sa/envoy2", false},
+		{"spiffe://cluster.local/ns/gloo/*", "spiffe://cluster.local/ns/gloo/sa/envoy", true},
+		{"spiffe://cluster.local/ns/gloo/*", "spiffe://cluster.local/ns/other/sa/envoy", false},
+		{"*.gloo.svc", "envoy.gloo.svc", true},
+		{"*.gloo.svc", "gloo.svc", false},
+		{"*.gloo.svc", "envoy.gloo.svc.evil.example", false},
+		{"envoy-*.gloo.svc", "envoy-1.gloo.svc", true},
+		// The prefix and suffix must not overlap
+		{"ab*ba", "aba", false},
+		{"*", "anything", true},
+	}
+	for _, tt := range tests {
+		if got := matchesAny([]string{tt.pattern}, tt.s); got != tt.want {
+			t.Errorf("matchesAny(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+	if matchesAny(nil, "envoy.gloo.svc") {
+		t.Error("an empty allow-list matched")
+	}
+}
+
+func TestServerTLSClientCertificates(t *testing.T) {
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+	s := newTestServerTLS(t, ca, &Options{
+		TLSAllowedSPIFFEIDs: []string{"spiffe://cluster.local/ns/gloo-system/*"},
+		TLSAllowedSANs:      []string{"*.gloo-system.svc"},
+	})
+
+	tests := []struct {
+		name    string
+		client  *tls.Certificate
+		allowed bool
+		// notAllowed is whether the rejection comes from the allow-lists
+		notAllowed bool
+	}{
+		{name: "allowed SPIFFE ID", client: ca.clientCert(t, "spiffe://cluster.local/ns/gloo-system/sa/gateway-proxy"), allowed: true},
+		{name: "allowed DNS SAN", client: ca.clientCert(t, "gateway-proxy.gloo-system.svc"), allowed: true},
+		{name: "SPIFFE ID not in the list", client: ca.clientCert(t, "spiffe://cluster.local/ns/default/sa/app"), notAllowed: true},
+		{name: "DNS SAN not in the list", client: ca.clientCert(t, "app.default.svc"), notAllowed: true},
+		{name: "signed by another CA", client: otherCA.clientCert(t, "gateway-proxy.gloo-system.svc")},
+		{name: "no client certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rejections := metrics.TLSRejections.Value("not_allowed")
+			_, err := handshake(t, s, ca, tt.client)
+			if tt.allowed != (err == nil) {
+				t.Errorf("handshake error %v, want allowed %v", err, tt.allowed)
+			}
+			var want uint64
+			if tt.notAllowed {
+				want = 1
+			}
+			if got := metrics.TLSRejections.Value("not_allowed") - rejections; got != want {
+				t.Errorf("not_allowed rejections went up by %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestServerTLSAnyClientOfTheCA(t *testing.T) {
+	ca := newTestCA(t)
+	s := newTestServerTLS(t, ca, &Options{})
+	if _, err := handshake(t, s, ca, ca.clientCert(t, "anything.example")); err != nil {
+		t.Errorf("without allow-lists a certificate of the CA was rejected: %v", err)
+	}
+}
+
+func TestServerTLSRotation(t *testing.T) {
+	ca := newTestCA(t)
+	s := newTestServerTLS(t, ca, &Options{TLSReloadInterval: time.Hour})
+	client := ca.clientCert(t, "gateway-proxy.gloo-system.svc")
+	first, err := handshake(t, s, ca, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM, keyPEM, serial := ca.issue(t, "extproc.test")
+	// Until the interval has passed the files aren't looked at
+	writeTestFile(t, s.certFile, certPEM)
+	if leaf, _ := handshake(t, s, ca, client); leaf == nil || leaf.SerialNumber.Cmp(first.SerialNumber) != 0 {
+		t.Error("certificate reloaded before the interval passed")
+	}
+
+	// A new certificate with the old key is kept out, and the old one
+	// served, until the key is written too
+	s.lastCheck.Store(0)
+	if leaf, _ := handshake(t, s, ca, client); leaf == nil || leaf.SerialNumber.Cmp(first.SerialNumber) != 0 {
+		t.Error("certificate without its key was loaded")
+	}
+	writeTestFile(t, s.keyFile, keyPEM)
+	s.lastCheck.Store(0)
+	leaf, err := handshake(t, s, ca, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.SerialNumber.Int64() != serial {
+		t.Errorf("serving certificate %v after rotation, want %d", leaf.SerialNumber, serial)
+	}
+
+	// A broken file keeps the rotated certificate
+	writeTestFile(t, s.certFile, []byte("not a certificate"))
+	s.lastCheck.Store(0)
+	if leaf, _ := handshake(t, s, ca, client); leaf == nil || leaf.SerialNumber.Int64() != serial {
+		t.Error("a broken certificate file replaced the working one")
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+// TraceContext is this service's place in a W3C trace
+// (https://www.w3.org/TR/trace-context/). The service acts as one span:
+// SpanID is ours, ParentID is the caller's span, if there was one.
+type TraceContext struct {
+	TraceID  [16]byte
+	SpanID   [8]byte
+	ParentID [8]byte
+	Flags    byte
+	// State is the tracestate header, passed on unchanged
+	State string
+}
+
+// traceFlagSampled is the sampled bit of the trace flags
+const traceFlagSampled = 0x01
+
+// Sampled reports whether the caller asked for this trace to be recorded
+func (t *TraceContext) Sampled() bool {
+	return t.Flags&traceFlagSampled != 0
+}
+
+// HasParent reports whether the trace was continued from the caller
+func (t *TraceContext) HasParent() bool {
+	return t.ParentID != [8]byte{}
+}
+
+// Traceparent returns the traceparent header naming our span as the parent
+func (t *TraceContext) Traceparent() string {
+	return "00-" + hex.EncodeToString(t.TraceID[:]) + "-" + hex.EncodeToString(t.SpanID[:]) +
+		"-" + hex.EncodeToString([]byte{t.Flags})
+}
+
+// TraceIDString returns the trace ID in hex
+func (t *TraceContext) TraceIDString() string {
+	return hex.EncodeToString(t.TraceID[:])
+}
+
+// continueTrace starts our span as a child of the incoming traceparent.
+// If there is none, or it is invalid, a new trace is started and the
+// tracestate is dropped, as the spec requires. A new trace is not sampled:
+// nothing here records it, so upstream isn't asked to either.
+func continueTrace(traceparent, tracestate string) *TraceContext {
+	t := &TraceContext{}
+	randomNonZero(t.SpanID[:])
+
+	if traceID, parentID, flags, ok := parseTraceparent(traceparent); ok {
+		t.TraceID, t.ParentID, t.Flags = traceID, parentID, flags
+		if validTracestate(tracestate) {
+			t.State = tracestate
+		}
+		return t
+	}
+	randomNonZero(t.TraceID[:])
+	return t
+}
+
+// parseTraceparent parses "00-<trace-id>-<parent-id>-<flags>". Later
+// versions are accepted as long as they start with the same four fields.
+func parseTraceparent(s string) (traceID [16]byte, parentID [8]byte, flags byte, ok bool) {
+	s = strings.TrimSpace(s)
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || !isLowerHex(parts[0]) || parts[0] == "ff" {
+		return traceID, parentID, 0, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return traceID, parentID, 0, false
+	}
+	if !decodeHexField(parts[1], traceID[:]) || !decodeHexField(parts[2], parentID[:]) {
+		return traceID, parentID, 0, false
+	}
+	var f [1]byte
+	if !decodeHexField(parts[3], f[:]) {
+		return traceID, parentID, 0, false
+	}
+	if traceID == [16]byte{} || parentID == [8]byte{} {
+		return traceID, parentID, 0, false
+	}
+	return traceID, parentID, f[0], true
+}
+
+// decodeHexField decodes exactly len(dst) bytes of lower-case hex
+func decodeHexField(s string, dst []byte) bool {
+	if len(s) != 2*len(dst) || !isLowerHex(s) {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// validTracestate does a light check of the tracestate list: at most 32
+// key=value members, no empty keys
+func validTracestate(s string) bool {
+	if s == "" || len(s) > 512 {
+		return false
+	}
+	members := strings.Split(s, ",")
+	if len(members) > 32 {
+		return false
+	}
+	for _, m := range members {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+		key, _, found := strings.Cut(m, "=")
+		if !found || key == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// randomNonZero fills b with random bytes that aren't all zero (an
+// all-zero trace or span ID is invalid)
+func randomNonZero(b []byte) {
+	for {
+		randomBytes(b)
+		for _, c := range b {
+			if c != 0 {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const (
+		traceID  = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentID = "00f067aa0ba902b7"
+	)
+	tests := []struct {
+		name, header string
+		ok           bool
+		flags        byte
+	}{
+		{"sampled", "00-" + traceID + "-" + parentID + "-01", true, 0x01},
+		{"not sampled", "00-" + traceID + "-" + parentID + "-00", true, 0x00},
+		{"unknown flags are kept", "00-" + traceID + "-" + parentID + "-09", true, 0x09},
+		{"surrounding spaces", " 00-" + traceID + "-" + parentID + "-01 ", true, 0x01},
+		{"later version", "01-" + traceID + "-" + parentID + "-01", true, 0x01},
+		{"later version with more fields", "cc-" + traceID + "-" + parentID + "-01-what-the-future-holds", true, 0x01},
+		{"version 00 with more fields", "00-" + traceID + "-" + parentID + "-01-extra", false, 0},
+		{"version ff", "ff-" + traceID + "-" + parentID + "-01", false, 0},
+		{"upper case version", "0A-" + traceID + "-" + parentID + "-01", false, 0},
+		{"upper case trace ID", "00-" + strings.ToUpper(traceID) + "-" + parentID + "-01", false, 0},
+		{"zero trace ID", "00-" + strings.Repeat("0", 32) + "-" + parentID + "-01", false, 0},
+		{"zero parent ID", "00-" + traceID + "-" + strings.Repeat("0", 16) + "-01", false, 0},
+		{"short trace ID", "00-" + traceID[2:] + "-" + parentID + "-01", false, 0},
+		{"short flags", "00-" + traceID + "-" + parentID + "-1", false, 0},
+		{"missing flags", "00-" + traceID + "-" + parentID, false, 0},
+		{"empty", "", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotTrace, gotParent, flags, ok := parseTraceparent(tt.header)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if hex.EncodeToString(gotTrace[:]) != traceID || hex.EncodeToString(gotParent[:]) != parentID || flags != tt.flags {
+				t.Errorf("got %x %x %02x, want %s %s %02x", gotTrace, gotParent, flags, traceID, parentID, tt.flags)
+			}
+		})
+	}
+}
+
+func TestValidTracestate(t *testing.T) {
+	tests := []struct {
+		state string
+		want  bool
+	}{
+		{"vendor=value", true},
+		{"a=1,b=2", true},
+		{"a=1, b=2 ,,c=3", true},
+		{"tenant@vendor=x", true},
+		{"", false},
+		{"novalue", false},
+		{"=value", false},
+		{"a=1,b", false},
+		{strings.Repeat("k=v,", 32) + "k=v", false},
+		{"k=" + strings.Repeat("v", 511), false},
+	}
+	for _, tt := range tests {
+		if got := validTracestate(tt.state); got != tt.want {
+			t.Errorf("validTracestate(%q) = %v, want %v", tt.state, got, tt.want)
+		}
+	}
+}
+
+func TestContinueTrace(t *testing.T) {
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	trace := continueTrace(parent, "vendor=value")
+	if !trace.HasParent() || trace.TraceIDString() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace %+v does not continue the parent", trace)
+	}
+	if !trace.Sampled() || trace.State != "vendor=value" {
+		t.Errorf("flags %02x, state %q: want the caller's", trace.Flags, trace.State)
+	}
+	forwarded := trace.Traceparent()
+	if !strings.HasPrefix(forwarded, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || strings.Contains(forwarded, "00f067aa0ba902b7") {
+		t.Errorf("forwarded traceparent %q does not name our span", forwarded)
+	}
+	if _, spanID, _, ok := parseTraceparent(forwarded); !ok || spanID != trace.SpanID {
+		t.Errorf("forwarded traceparent %q does not parse back to our span", forwarded)
+	}
+
+	// A later version is forwarded as the version we speak
+	if got := continueTrace("01"+parent[2:]+"-more", "").Traceparent(); !strings.HasPrefix(got, "00-4bf92f") {
+		t.Errorf("later version forwarded as %q", got)
+	}
+
+	// An invalid tracestate is dropped, the traceparent still continued
+	if trace := continueTrace(parent, "=broken"); !trace.HasParent() || trace.State != "" {
+		t.Errorf("trace %+v: want the parent continued without the tracestate", trace)
+	}
+
+	// Without a valid traceparent a new, unsampled trace starts and the
+	// tracestate goes
+	for _, header := range []string{"", "garbage", "00-" + strings.Repeat("0", 32) + "-00f067aa0ba902b7-01"} {
+		trace := continueTrace(header, "vendor=value")
+		if trace.HasParent() || trace.Sampled() || trace.State != "" {
+			t.Errorf("continueTrace(%q) = %+v, want a new unsampled trace", header, trace)
+		}
+		if trace.TraceID == [16]byte{} || trace.SpanID == [8]byte{} {
+			t.Errorf("continueTrace(%q) has an all-zero ID", header)
+		}
+	}
+	if a, b := continueTrace("", ""), continueTrace("", ""); a.TraceID == b.TraceID {
+		t.Error("two new traces share a trace ID")
+	}
+}
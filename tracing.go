@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"github.com/solo-io/go-utils/contextutils"
+)
+
+// TracingConfig exports a span for every stream, and one for every
+// processor that ran, to an OpenTelemetry collector over OTLP. Spans are
+// children of the incoming traceparent, so the ext_proc hop shows up next
+// to Envoy's own spans. Tracing needs trace context (requestID), which is
+// on by default.
+//
+//	tracing:
+//	  endpoint: otel-collector.observability:4317
+//	  protocol: grpc
+//	  insecure: true
+//	  sampler: parentbased_traceidratio
+//	  sampleRatio: 0.1
+type TracingConfig struct {
+	// Endpoint is the collector: host:port for grpc, a URL for http
+	// (http://collector:4318; /v1/traces is added if there is no path)
+	Endpoint string `yaml:"endpoint" json:"endpoint"`
+	// Protocol is grpc (default) or http (OTLP/HTTP with protobuf bodies)
+	Protocol string `yaml:"protocol" json:"protocol"`
+	// Insecure uses plaintext gRPC instead of TLS. For http the URL scheme decides.
+	Insecure bool `yaml:"insecure" json:"insecure"`
+	// Headers are sent with every export, e.g. an API key for a hosted collector
+	Headers map[string]string `yaml:"headers" json:"headers"`
+	// Timeout bounds each export (default 10s)
+	Timeout time.Duration `yaml:"timeout" json:"timeout"`
+
+	// ServiceName is the service.name resource attribute (default eag-extproc)
+	ServiceName string `yaml:"serviceName" json:"serviceName"`
+
+	// Sampler is one of the OpenTelemetry samplers: always_on, always_off,
+	// traceidratio, parentbased_always_on (default), parentbased_always_off
+	// or parentbased_traceidratio. The parentbased ones follow the sampled
+	// flag of the incoming traceparent and only decide for new traces.
+	Sampler string `yaml:"sampler" json:"sampler"`
+	// SampleRatio is the share of traces the traceidratio samplers keep
+	// (0 to 1, default 1)
+	SampleRatio float64 `yaml:"sampleRatio" json:"sampleRatio"`
+
+	// Batch controls how spans are queued and sent
+	Batch TracingBatchConfig `yaml:"batch" json:"batch"`
+}
+
+// TracingBatchConfig controls the span queue. Spans that don't fit in the
+// queue are dropped rather than slowing requests down.
+type TracingBatchConfig struct {
+	// MaxQueueSize is the number of spans waiting to be sent (default 2048)
+	MaxQueueSize int `yaml:"maxQueueSize" json:"maxQueueSize"`
+	// MaxExportBatchSize is the most spans sent in one export (default 512)
+	MaxExportBatchSize int `yaml:"maxExportBatchSize" json:"maxExportBatchSize"`
+	// ScheduleDelay is how long spans wait for a batch to fill (default 5s)
+	ScheduleDelay time.Duration `yaml:"scheduleDelay" json:"scheduleDelay"`
+}
+
+// Samplers understood in TracingConfig.Sampler
+const (
+	SamplerAlwaysOn                = "always_on"
+	SamplerAlwaysOff               = "always_off"
+	SamplerTraceIDRatio            = "traceidratio"
+	SamplerParentBasedAlwaysOn     = "parentbased_always_on"
+	SamplerParentBasedAlwaysOff    = "parentbased_always_off"
+	SamplerParentBasedTraceIDRatio = "parentbased_traceidratio"
+)
+
+// OTLP protocols understood in TracingConfig.Protocol
+const (
+	OTLPGRPC = "grpc"
+	OTLPHTTP = "http"
+)
+
+func (c *TracingConfig) validate() error {
+	if c.Endpoint == "" {
+		return fmt.Errorf("endpoint is required")
+	}
+	switch c.Protocol {
+	case "", OTLPGRPC:
+		if strings.Contains(c.Endpoint, "://") {
+			return fmt.Errorf("endpoint for grpc is host:port, not a URL")
+		}
+	case OTLPHTTP:
+		u, err := url.Parse(c.Endpoint)
+		if err != nil {
+			return fmt.Errorf("endpoint: %w", err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("endpoint for http must be an http:// or https:// URL")
+		}
+	default:
+		return fmt.Errorf("unknown protocol %q (use %s or %s)", c.Protocol, OTLPGRPC, OTLPHTTP)
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	switch c.Sampler {
+	case "", SamplerAlwaysOn, SamplerAlwaysOff, SamplerTraceIDRatio,
+		SamplerParentBasedAlwaysOn, SamplerParentBasedAlwaysOff, SamplerParentBasedTraceIDRatio:
+	default:
+		return fmt.Errorf("unknown sampler %q", c.Sampler)
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return fmt.Errorf("sampleRatio must be between 0 and 1")
+	}
+	if c.Batch.MaxQueueSize < 0 || c.Batch.MaxExportBatchSize < 0 || c.Batch.ScheduleDelay < 0 {
+		return fmt.Errorf("batch settings must not be negative")
+	}
+	if c.Batch.MaxQueueSize > 0 && c.Batch.MaxExportBatchSize > c.Batch.MaxQueueSize {
+		return fmt.Errorf("batch.maxExportBatchSize must not be larger than batch.maxQueueSize")
+	}
+	return nil
+}
+
+// Tracer samples streams and sends their spans to the collector in batches
+type Tracer struct {
+	sampler     string
+	ratioBound  uint64
+	serviceName string
+
+	exporter      spanExporter
+	queue         chan *spanData
+	batchSize     int
+	scheduleDelay time.Duration
+	timeout       time.Duration
+
+	flush  chan chan struct{}
+	stop   chan chan struct{}
+	closed atomic.Bool
+}
+
+// tracers keeps one tracer (and its collector connection) per config
+// across config reloads. Tracers no chain in use needs any more are
+// closed by releaseUnused.
+var tracers = struct {
+	sync.Mutex
+	byConfig map[string]*Tracer
+}{byConfig: map[string]*Tracer{}}
+
+// NewTracer returns the tracer for cfg, reusing an existing one when the
+// config hasn't changed
+func NewTracer(cfg *TracingConfig) (*Tracer, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	key, _ := json.Marshal(cfg)
+	tracers.Lock()
+	defer tracers.Unlock()
+	if t, ok := tracers.byConfig[string(key)]; ok {
+		return t, nil
+	}
+
+	t := &Tracer{
+		sampler:       cfg.Sampler,
+		serviceName:   cfg.ServiceName,
+		batchSize:     cfg.Batch.MaxExportBatchSize,
+		scheduleDelay: cfg.Batch.ScheduleDelay,
+		timeout:       cfg.Timeout,
+		flush:         make(chan chan struct{}),
+		stop:          make(chan chan struct{}),
+	}
+	if t.sampler == "" {
+		t.sampler = SamplerParentBasedAlwaysOn
+	}
+	// Same rule as the OpenTelemetry SDKs: keep the trace if the low 63
+	// bits of the trace ID are below ratio * 2^63
+	ratio := cfg.SampleRatio
+	if ratio == 0 {
+		ratio = 1
+	}
+	t.ratioBound = uint64(ratio * (1 << 63))
+	if t.serviceName == "" {
+		t.serviceName = "eag-extproc"
+	}
+	queueSize := cfg.Batch.MaxQueueSize
+	if queueSize == 0 {
+		queueSize = 2048
+	}
+	if t.batchSize == 0 {
+		t.batchSize = 512
+	}
+	if t.batchSize > queueSize {
+		t.batchSize = queueSize
+	}
+	if t.scheduleDelay == 0 {
+		t.scheduleDelay = 5 * time.Second
+	}
+	if t.timeout == 0 {
+		t.timeout = 10 * time.Second
+	}
+	t.queue = make(chan *spanData, queueSize)
+
+	var err error
+	if cfg.Protocol == OTLPHTTP {
+		t.exporter = newOTLPHTTPExporter(cfg.Endpoint, cfg.Headers)
+	} else {
+		t.exporter, err = newOTLPGRPCExporter(cfg.Endpoint, cfg.Insecure, cfg.Headers)
+	}
+	if err != nil {
+		return nil, err
+	}
+	go t.run()
+	tracers.byConfig[string(key)] = t
+	return t, nil
+}
+
+// Sample decides whether the stream's trace is recorded and sets the
+// sampled flag that is forwarded upstream to match
+func (t *Tracer) Sample(trace *TraceContext) {
+	sampled := false
+	switch {
+	case trace.HasParent() && strings.HasPrefix(t.sampler, "parentbased_"):
+		sampled = trace.Sampled()
+	case t.sampler == SamplerAlwaysOn || t.sampler == SamplerParentBasedAlwaysOn:
+		sampled = true
+	case t.sampler == SamplerTraceIDRatio || t.sampler == SamplerParentBasedTraceIDRatio:
+		sampled = binary.BigEndian.Uint64(trace.TraceID[8:])&(1<<63-1) < t.ratioBound
+	}
+	if sampled {
+		trace.Flags |= traceFlagSampled
+	} else {
+		trace.Flags &^= traceFlagSampled
+	}
+}
+
+// StartSpan starts the span for a stream. It returns nil, which every
+// Span method accepts, when the trace is not sampled.
+func (t *Tracer) StartSpan(sc *StreamContext, headers *extprocv3.HttpHeaders, start time.Time) *Span {
+	if sc.Trace == nil || !sc.Trace.Sampled() {
+		return nil
+	}
+	s := &Span{tracer: t, data: &spanData{
+		traceID:    sc.Trace.TraceID,
+		spanID:     sc.Trace.SpanID,
+		parentID:   sc.Trace.ParentID,
+		traceState: sc.Trace.State,
+		name:       "ext_proc",
+		kind:       spanKindServer,
+		start:      start,
+	}}
+	method, _ := getHeader(headers, ":method")
+	path, _ := getHeader(headers, ":path")
+	path, _, _ = strings.Cut(path, "?")
+	authority, _ := getHeader(headers, ":authority")
+	s.data.attr("http.request.method", method)
+	s.data.attr("url.path", path)
+	s.data.attr("server.address", authority)
+	s.data.attr("http.route", routeName(headers, path))
+	s.data.attr("extproc.request_id", sc.RequestID)
+	return s
+}
+
+// routeName is the Envoy route name when Envoy sends it as an attribute,
+// otherwise the path
+func routeName(headers *extprocv3.HttpHeaders, path string) string {
+	for _, attrs := range headers.GetAttributes() {
+		if v, ok := attrs.GetFields()["xds.route_name"]; ok && v.GetStringValue() != "" {
+			return v.GetStringValue()
+		}
+	}
+	return path
+}
+
+// enqueue hands a finished span to the batcher, dropping it if the queue is full
+func (t *Tracer) enqueue(d *spanData) {
+	if t.closed.Load() {
+		metrics.Spans.Inc("dropped")
+		return
+	}
+	select {
+	case t.queue <- d:
+	default:
+		metrics.Spans.Inc("dropped")
+	}
+}
+
+// run sends a batch when it is full or the schedule delay has passed
+func (t *Tracer) run() {
+	logger := contextutils.LoggerFrom(context.Background())
+	ticker := time.NewTicker(t.scheduleDelay)
+	defer ticker.Stop()
+	batch := make([]*spanData, 0, t.batchSize)
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+		err := t.exporter.Export(ctx, encodeTraces(t.serviceName, batch))
+		cancel()
+		if err != nil {
+			metrics.Spans.Add(uint64(len(batch)), "failed")
+			logger.Warnw("Failed to export spans", "spans", len(batch), "error", err)
+		} else {
+			metrics.Spans.Add(uint64(len(batch)), "exported")
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case d := <-t.queue:
+			batch = append(batch, d)
+			if len(batch) >= t.batchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-t.flush:
+			t.drain(&batch, send)
+			close(done)
+		case done := <-t.stop:
+			t.drain(&batch, send)
+			close(done)
+			return
+		}
+	}
+}
+
+// drain sends everything that is queued
+func (t *Tracer) drain(batch *[]*spanData, send func()) {
+	for len(t.queue) > 0 {
+		*batch = append(*batch, <-t.queue)
+		if len(*batch) >= t.batchSize {
+			send()
+		}
+	}
+	send()
+}
+
+// Flush sends every queued span, waiting until they are sent or ctx is done
+func (t *Tracer) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case t.flush <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close sends the queued spans, stops the batcher and closes the collector
+// connection. Spans ended after that are counted as dropped.
+func (t *Tracer) Close() {
+	t.closed.Store(true)
+	done := make(chan struct{})
+	t.stop <- done
+	<-done
+	t.exporter.Close()
+}
+
+// releaseTracers closes the tracers kept for earlier configs that are not
+// in inUse. Closing waits for the last export, so it happens in the
+// background.
+func releaseTracers(inUse map[*Tracer]bool) {
+	tracers.Lock()
+	defer tracers.Unlock()
+	for key, t := range tracers.byConfig {
+		if !inUse[t] {
+			delete(tracers.byConfig, key)
+			go t.Close()
+		}
+	}
+}
+
+// FlushTracers sends the queued spans of every tracer, e.g. before exiting
+func FlushTracers(ctx context.Context) error {
+	tracers.Lock()
+	all := make([]*Tracer, 0, len(tracers.byConfig))
+	for _, t := range tracers.byConfig {
+		all = append(all, t)
+	}
+	tracers.Unlock()
+	for _, t := range all {
+		if err := t.Flush(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Span is the span of one stream. It adds up what happened to the request
+// over all of its messages and is sent when the stream ends.
+// All methods do nothing on a nil Span, so callers don't have to check
+// whether the stream is sampled.
+type Span struct {
+	tracer *Tracer
+	data   *spanData
+
+	messages       int
+	headersSet     int
+	headersRemoved int
+	bodyMutations  int
+	immediate      *extprocv3.ImmediateResponse
+}
+
+// Record adds the reply to one message to the span
+func (s *Span) Record(response *extprocv3.ProcessingResponse) {
+	if s == nil {
+		return
+	}
+	s.messages++
+	if immediate := response.GetImmediateResponse(); immediate != nil {
+		s.immediate = immediate
+		return
+	}
+	headers, body := responseMutations(response)
+	s.headersSet += len(headers.GetSetHeaders())
+	s.headersRemoved += len(headers.GetRemoveHeaders())
+	if body != nil {
+		s.bodyMutations++
+	}
+}
+
+// Processor records one processor invocation as a child span
+func (s *Span) Processor(name string, phase Phase, start time.Time, result *Result, err error) {
+	if s == nil {
+		return
+	}
+	d := &spanData{
+		traceID:  s.data.traceID,
+		spanID:   newSpanID(),
+		parentID: s.data.spanID,
+		name:     name,
+		kind:     spanKindInternal,
+		start:    start,
+		end:      time.Now(),
+	}
+	d.attr("extproc.processor", name)
+	d.attr("extproc.phase", string(phase))
+	switch {
+	case err != nil:
+		d.fail(err.Error())
+	case result != nil && result.ImmediateResponse != nil:
+		d.attr("extproc.decision", "deny")
+		d.attr("http.response.status_code", int64(result.ImmediateResponse.GetStatus().GetCode()))
+	default:
+		d.attr("extproc.decision", "continue")
+		if result != nil {
+			d.attr("extproc.headers_set", int64(len(result.HeaderMutation.GetSetHeaders())))
+			d.attr("extproc.headers_removed", int64(len(result.HeaderMutation.GetRemoveHeaders())))
+			d.attr("extproc.body_mutated", result.BodyMutation != nil)
+		}
+	}
+	s.tracer.enqueue(d)
+}
+
+// End finishes the span and queues it for export. err is the error the
+// stream ended with, if any.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	d := s.data
+	d.end = time.Now()
+	d.attr("extproc.messages", int64(s.messages))
+	if s.immediate != nil {
+		d.attr("extproc.decision", "deny")
+		d.attr("extproc.reason", strings.TrimPrefix(s.immediate.GetDetails(), "ext_proc_"))
+		d.attr("http.response.status_code", int64(s.immediate.GetStatus().GetCode()))
+	} else {
+		d.attr("extproc.decision", "continue")
+	}
+	d.attr("extproc.headers_set", int64(s.headersSet))
+	d.attr("extproc.headers_removed", int64(s.headersRemoved))
+	d.attr("extproc.body_mutations", int64(s.bodyMutations))
+	if err != nil {
+		d.fail(err.Error())
+	}
+	s.tracer.enqueue(d)
+}
+
+// newSpanID returns a random, non-zero span ID
+func newSpanID() [8]byte {
+	var id [8]byte
+	randomNonZero(id[:])
+	return id
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// testCollector stands in for an OTLP collector and keeps the export
+// requests it receives
+type testCollector struct {
+	mu       sync.Mutex
+	requests [][]byte
+	headers  []map[string]string
+	received chan struct{}
+}
+
+func newTestCollector() *testCollector {
+	return &testCollector{received: make(chan struct{}, 100)}
+}
+
+func (c *testCollector) record(body []byte, headers map[string]string) {
+	c.mu.Lock()
+	c.requests = append(c.requests, body)
+	c.headers = append(c.headers, headers)
+	c.mu.Unlock()
+	c.received <- struct{}{}
+}
+
+// spans decodes every span the collector received
+func (c *testCollector) spans(t *testing.T) []testSpan {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var spans []testSpan
+	for _, body := range c.requests {
+		spans = append(spans, decodeTestSpans(t, body)...)
+	}
+	return spans
+}
+
+// serveHTTP starts an OTLP/HTTP collector answering with status
+func (c *testCollector) serveHTTP(t *testing.T, status int) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" {
+			t.Errorf("collector got %s %s", r.Method, r.URL.Path)
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("reading export: %v", err)
+		}
+		c.record(body, map[string]string{
+			"content-type":  r.Header.Get("Content-Type"),
+			"authorization": r.Header.Get("Authorization"),
+		})
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// serveGRPC starts an OTLP/gRPC collector
+func (c *testCollector) serveGRPC(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer(
+		grpc.ForceServerCodec(rawCodec{}),
+		grpc.UnknownServiceHandler(func(_ interface{}, stream grpc.ServerStream) error {
+			method, _ := grpc.MethodFromServerStream(stream)
+			if method != "/opentelemetry.proto.collector.trace.v1.TraceService/Export" {
+				t.Errorf("collector got %s", method)
+			}
+			var body []byte
+			if err := stream.RecvMsg(&body); err != nil {
+				return err
+			}
+			md, _ := metadata.FromIncomingContext(stream.Context())
+			c.record(body, map[string]string{"authorization": first(md.Get("authorization"))})
+			return stream.SendMsg(&[]byte{})
+		}))
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// testSpan is the part of an OTLP span the tests look at
+type testSpan struct {
+	service  string
+	traceID  string
+	spanID   string
+	parentID string
+	name     string
+	attrs    map[string]string
+}
+
+// decodeTestSpans reads an ExportTraceServiceRequest. Only string
+// attributes are kept.
+func decodeTestSpans(t *testing.T, body []byte) []testSpan {
+	t.Helper()
+	var spans []testSpan
+	for _, rs := range protoFields(t, body)[1] {
+		fields := protoFields(t, rs)
+		service := ""
+		for _, resource := range fields[1] {
+			for _, kv := range protoFields(t, resource)[1] {
+				if k, v := decodeTestAttr(t, kv); k == "service.name" {
+					service = v
+				}
+			}
+		}
+		for _, scopeSpans := range fields[2] {
+			for _, raw := range protoFields(t, scopeSpans)[2] {
+				sf := protoFields(t, raw)
+				s := testSpan{
+					service:  service,
+					traceID:  string(firstBytes(sf[1])),
+					spanID:   string(firstBytes(sf[2])),
+					parentID: string(firstBytes(sf[4])),
+					name:     string(firstBytes(sf[5])),
+					attrs:    map[string]string{},
+				}
+				for _, kv := range sf[9] {
+					if k, v := decodeTestAttr(t, kv); v != "" {
+						s.attrs[k] = v
+					}
+				}
+				spans = append(spans, s)
+			}
+		}
+	}
+	return spans
+}
+
+func decodeTestAttr(t *testing.T, kv []byte) (string, string) {
+	fields := protoFields(t, kv)
+	key := string(firstBytes(fields[1]))
+	if len(fields[2]) == 0 {
+		return key, ""
+	}
+	return key, string(firstBytes(protoFields(t, fields[2][0])[1]))
+}
+
+func firstBytes(values [][]byte) []byte {
+	if len(values) == 0 {
+		return nil
+	}
+	return values[0]
+}
+
+// protoFields returns the length-delimited fields of a message by number
+func protoFields(t *testing.T, b []byte) map[protowire.Number][][]byte {
+	t.Helper()
+	fields := map[protowire.Number][][]byte{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("bad tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		if typ == protowire.BytesType {
+			v, m := protowire.ConsumeBytes(b)
+			if m < 0 {
+				t.Fatalf("bad field %d: %v", num, protowire.ParseError(m))
+			}
+			fields[num] = append(fields[num], v)
+			n = m
+		} else {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				t.Fatalf("bad field %d: %v", num, protowire.ParseError(n))
+			}
+		}
+		b = b[n:]
+	}
+	return fields
+}
+
+// newTestTracer returns a tracer that is closed when the test ends
+func newTestTracer(t *testing.T, cfg *TracingConfig) *Tracer {
+	t.Helper()
+	tr, err := NewTracer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { releaseTracers(nil) })
+	return tr
+}
+
+// traceStream records a sampled stream with one processor
+func traceStream(tr *Tracer) *TraceContext {
+	sc := NewStreamContext(context.Background())
+	sc.RequestID = "req-1"
+	sc.Trace = &TraceContext{Flags: traceFlagSampled}
+	randomNonZero(sc.Trace.TraceID[:])
+	sc.Trace.SpanID = newSpanID()
+	sc.Trace.ParentID = newSpanID()
+
+	headers := testHeaders(":method", "GET", ":path", "/items?page=2", ":authority", "api.example.com")
+	span := tr.StartSpan(sc, headers, time.Now())
+	span.Processor("auth", PhaseRequestHeaders, time.Now(), nil, nil)
+	span.End(nil)
+	return sc.Trace
+}
+
+func waitReceived(t *testing.T, c *testCollector) {
+	t.Helper()
+	select {
+	case <-c.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("collector received nothing")
+	}
+}
+
+func TestOTLPExport(t *testing.T) {
+	for _, protocol := range []string{OTLPHTTP, OTLPGRPC} {
+		t.Run(protocol, func(t *testing.T) {
+			collector := newTestCollector()
+			cfg := &TracingConfig{
+				Protocol:    protocol,
+				Insecure:    true,
+				Headers:     map[string]string{"authorization": "Bearer token"},
+				ServiceName: "gateway-" + protocol,
+				Batch:       TracingBatchConfig{ScheduleDelay: time.Hour},
+			}
+			if protocol == OTLPHTTP {
+				cfg.Endpoint = collector.serveHTTP(t, http.StatusOK)
+			} else {
+				cfg.Endpoint = collector.serveGRPC(t)
+			}
+			tr := newTestTracer(t, cfg)
+			exported := metrics.Spans.Value("exported")
+
+			trace := traceStream(tr)
+			if err := tr.Flush(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := metrics.Spans.Value("exported") - exported; got != 2 {
+				t.Errorf("exported counter went up by %d, want 2", got)
+			}
+			collector.mu.Lock()
+			headers := collector.headers[0]
+			collector.mu.Unlock()
+			if headers["authorization"] != "Bearer token" {
+				t.Errorf("authorization header = %q", headers["authorization"])
+			}
+			if protocol == OTLPHTTP && headers["content-type"] != "application/x-protobuf" {
+				t.Errorf("content-type = %q", headers["content-type"])
+			}
+
+			spans := collector.spans(t)
+			if len(spans) != 2 {
+				t.Fatalf("collector got %d spans, want 2", len(spans))
+			}
+			processor, stream := spans[0], spans[1]
+			for _, s := range spans {
+				if s.service != cfg.ServiceName {
+					t.Errorf("span %q has service.name %q", s.name, s.service)
+				}
+				if s.traceID != string(trace.TraceID[:]) {
+					t.Errorf("span %q is not in the stream's trace", s.name)
+				}
+			}
+			if stream.name != "ext_proc" || stream.spanID != string(trace.SpanID[:]) || stream.parentID != string(trace.ParentID[:]) {
+				t.Errorf("stream span %q does not continue the incoming traceparent", stream.name)
+			}
+			if processor.name != "auth" || processor.parentID != stream.spanID {
+				t.Errorf("processor span %q is not a child of the stream span", processor.name)
+			}
+			want := map[string]string{
+				"http.request.method": "GET",
+				"url.path":            "/items",
+				"server.address":      "api.example.com",
+				"extproc.request_id":  "req-1",
+				"extproc.decision":    "continue",
+			}
+			for k, v := range want {
+				if stream.attrs[k] != v {
+					t.Errorf("stream span %s = %q, want %q", k, stream.attrs[k], v)
+				}
+			}
+			if processor.attrs["extproc.phase"] != string(PhaseRequestHeaders) {
+				t.Errorf("processor span phase = %q", processor.attrs["extproc.phase"])
+			}
+		})
+	}
+}
+
+func TestOTLPExportFailed(t *testing.T) {
+	collector := newTestCollector()
+	tr := newTestTracer(t, &TracingConfig{
+		Endpoint: collector.serveHTTP(t, http.StatusInternalServerError),
+		Protocol: OTLPHTTP,
+		Batch:    TracingBatchConfig{ScheduleDelay: time.Hour},
+	})
+	exported, failed := metrics.Spans.Value("exported"), metrics.Spans.Value("failed")
+
+	traceStream(tr)
+	if err := tr.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := metrics.Spans.Value("failed") - failed; got != 2 {
+		t.Errorf("failed counter went up by %d, want 2", got)
+	}
+	if got := metrics.Spans.Value("exported") - exported; got != 0 {
+		t.Errorf("exported counter went up by %d, want 0", got)
+	}
+}
+
+func TestOTLPQueueFull(t *testing.T) {
+	collector := newTestCollector()
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		collector.record(nil, nil)
+		<-release
+	}))
+	t.Cleanup(srv.Close)
+	tr := newTestTracer(t, &TracingConfig{
+		Endpoint: srv.URL,
+		Protocol: OTLPHTTP,
+		Batch:    TracingBatchConfig{MaxQueueSize: 1, MaxExportBatchSize: 1, ScheduleDelay: time.Hour},
+	})
+	dropped := metrics.Spans.Value("dropped")
+
+	// The first span is sent on its own and the export hangs; of the next
+	// two, one waits in the queue and the other doesn't fit
+	tr.enqueue(&spanData{name: "sent"})
+	waitReceived(t, collector)
+	tr.enqueue(&spanData{name: "queued"})
+	tr.enqueue(&spanData{name: "dropped"})
+	close(release)
+
+	if got := metrics.Spans.Value("dropped") - dropped; got != 1 {
+		t.Errorf("dropped counter went up by %d, want 1", got)
+	}
+	if err := tr.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(collector.received); got != 1 {
+		t.Errorf("collector got %d more exports, want 1", got)
+	}
+}
+
+func TestReleaseTracers(t *testing.T) {
+	collector := newTestCollector()
+	endpoint := collector.serveHTTP(t, http.StatusOK)
+	cfg := func(service string) *TracingConfig {
+		return &TracingConfig{
+			Endpoint:    endpoint,
+			Protocol:    OTLPHTTP,
+			ServiceName: service,
+			Batch:       TracingBatchConfig{ScheduleDelay: time.Hour},
+		}
+	}
+	active := newTestTracer(t, cfg("active"))
+	old := newTestTracer(t, cfg("old"))
+
+	exported := metrics.Spans.Value("exported")
+	traceStream(old)
+	releaseTracers(map[*Tracer]bool{active: true})
+
+	// Closing the old tracer sends what it still had queued
+	deadline := time.Now().Add(5 * time.Second)
+	for metrics.Spans.Value("exported")-exported < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the released tracer's queued spans were not exported")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, s := range collector.spans(t) {
+		if s.service != "old" {
+			t.Errorf("span from %q exported, want only the released tracer's", s.service)
+		}
+	}
+
+	dropped := metrics.Spans.Value("dropped")
+	traceStream(old)
+	if got := metrics.Spans.Value("dropped") - dropped; got != 2 {
+		t.Errorf("spans ended on a closed tracer: dropped went up by %d, want 2", got)
+	}
+
+	if tr, _ := NewTracer(cfg("active")); tr != active {
+		t.Error("the tracer in use was not kept")
+	}
+	if tr, _ := NewTracer(cfg("old")); tr == old {
+		t.Error("a released tracer was reused")
+	}
+}
+
+func TestTracerSample(t *testing.T) {
+	const (
+		sampledParent   = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+		unsampledParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"
+	)
+	tests := []struct {
+		sampler, traceparent string
+		want                 bool
+	}{
+		{SamplerParentBasedAlwaysOn, "", true},
+		{SamplerParentBasedAlwaysOn, sampledParent, true},
+		{SamplerParentBasedAlwaysOn, unsampledParent, false},
+		{SamplerParentBasedAlwaysOff, "", false},
+		{SamplerParentBasedAlwaysOff, sampledParent, true},
+		{SamplerAlwaysOn, unsampledParent, true},
+		{SamplerAlwaysOff, sampledParent, false},
+		{SamplerAlwaysOff, "", false},
+	}
+	ids, err := NewRequestIDProcessor(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		c := NewChain()
+		c.AddRequestID(ids)
+		c.SetTracer(newTestTracer(t, &TracingConfig{Endpoint: "localhost:4317", Insecure: true, Sampler: tt.sampler}))
+		sc := NewStreamContext(context.Background())
+		c.Identify(sc, testHeaders("traceparent", tt.traceparent))
+		if sc.Trace.Sampled() != tt.want {
+			t.Errorf("%s with traceparent %q: sampled %v, want %v", tt.sampler, tt.traceparent, sc.Trace.Sampled(), tt.want)
+		}
+	}
+
+	// Without a tracer nothing records a new trace, so it isn't sampled
+	c := NewChain()
+	c.AddRequestID(ids)
+	sc := NewStreamContext(context.Background())
+	c.Identify(sc, testHeaders())
+	if sc.Trace.Sampled() {
+		t.Error("new trace sampled without a tracer")
+	}
+}